@@ -3,6 +3,8 @@ package archive
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"github.com/buppyio/bpy/fs"
 	"github.com/buppyio/bpy/fs/fsutil"
 	"github.com/buppyio/bpy/testhelp"
 	"io"
@@ -10,7 +12,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTar(t *testing.T) {
@@ -40,11 +44,11 @@ func TestTar(t *testing.T) {
 		t.Fatal(err)
 	}
 	store := testhelp.NewMemStore()
-	dirEnt, err := fsutil.CpHostToFs(store, randd)
+	dirEnt, err := fsutil.CpHostToFs(store, randd, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = Tar(store, dirEnt.HTree.Data, outtar)
+	err = Tar(store, dirEnt.HTree.Data, outtar, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -129,11 +133,11 @@ func TestZip(t *testing.T) {
 		t.Fatal(err)
 	}
 	store := testhelp.NewMemStore()
-	dirEnt, err := fsutil.CpHostToFs(store, randd)
+	dirEnt, err := fsutil.CpHostToFs(store, randd, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = Zip(store, dirEnt.HTree.Data, outzip)
+	err = Zip(store, dirEnt.HTree.Data, outzip, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,3 +190,186 @@ func TestZip(t *testing.T) {
 	}
 
 }
+
+func TestImportTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Unix(1234567890, 0)
+	for _, e := range []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{tar.Header{Name: "a/b/c.txt", Typeflag: tar.TypeReg, Mode: 0600}, "old"},
+		{tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0700}, ""},
+		{tar.Header{Name: "./a/b/c.txt", Typeflag: tar.TypeReg, Mode: 0600}, "new"},
+		{tar.Header{Name: "../d.txt", Typeflag: tar.TypeReg, Mode: 0644}, "d"},
+		{tar.Header{Name: "e/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "d.txt", Mode: 0777}, ""},
+		{tar.Header{Name: "e/hard", Typeflag: tar.TypeLink, Linkname: "a/b/c.txt"}, ""},
+		{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, ""},
+	} {
+		e.hdr.Size = int64(len(e.contents))
+		e.hdr.ModTime = mtime
+		err := tw.WriteHeader(&e.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(tw, e.contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := testhelp.NewMemStore()
+	dirEnt, err := ImportTar(store, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	err = fs.WalkDir(store, dirEnt.HTree.Data, func(entPath string, ent fs.DirEnt) error {
+		found[entPath] = ent.EntMode.String()
+		if ent.EntModTime != mtime.Unix() {
+			t.Errorf("%s has mtime %d", entPath, ent.EntModTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"a":         "drwx------",
+		"a/b":       "drwxr-xr-x",
+		"a/b/c.txt": "-rw-------",
+		"d.txt":     "-rw-r--r--",
+		"e":         "drwxr-xr-x",
+		"e/hard":    "-rw-------",
+		"link":      "Lrwxrwxrwx",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("imported %v", found)
+	}
+	rdr, err := fs.Open(store, dirEnt.HTree.Data, "/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "new" {
+		t.Fatalf("c.txt has contents %q", contents)
+	}
+
+	var exported bytes.Buffer
+	err = Tar(store, dirEnt.HTree.Data, &exported, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&exported)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("exported tar has no symlink")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "link" {
+			if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "d.txt" || hdr.Size != 0 {
+				t.Fatalf("bad exported symlink %+v", hdr)
+			}
+			break
+		}
+	}
+
+	tw = tar.NewWriter(&buf)
+	for _, hdr := range []tar.Header{
+		{Name: "f", Typeflag: tar.TypeReg},
+		{Name: "f/g", Typeflag: tar.TypeReg},
+	} {
+		err = tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	_, err = ImportTar(store, &buf, nil)
+	if err == nil {
+		t.Fatal("expected an error importing a file below a file")
+	}
+}
+
+func TestImportZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	mtime := time.Unix(1234567890, 0)
+	for _, e := range []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"a/", os.ModeDir | 0700, ""},
+		{"a/b.txt", 0600, "hello"},
+		{"c/d.txt", 0644, "world"},
+		{"link", os.ModeSymlink | 0777, "a/b.txt"},
+	} {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: mtime}
+		hdr.SetMode(e.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(w, e.contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := testhelp.NewMemStore()
+	dirEnt, err := ImportZip(store, bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	err = fs.WalkDir(store, dirEnt.HTree.Data, func(entPath string, ent fs.DirEnt) error {
+		found[entPath] = ent.EntMode.String()
+		if ent.EntModTime != mtime.Unix() {
+			t.Errorf("%s has mtime %d", entPath, ent.EntModTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"a":       "drwx------",
+		"a/b.txt": "-rw-------",
+		"c":       "drwxr-xr-x",
+		"c/d.txt": "-rw-r--r--",
+		"link":    "Lrwxrwxrwx",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("imported %v", found)
+	}
+	for p, expected := range map[string]string{"/a/b.txt": "hello", "/link": "a/b.txt"} {
+		rdr, err := fs.Open(store, dirEnt.HTree.Data, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Fatalf("%s has contents %q", p, contents)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/progress"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// importDir is a directory being built from the entries of an archive,
+// which may come in any order and leave out parent directories.
+type importDir struct {
+	mode    os.FileMode
+	modTime int64
+	dirs    map[string]*importDir
+	files   map[string]fs.DirEnt
+}
+
+func newImportDir(modTime int64) *importDir {
+	return &importDir{
+		mode:    os.ModeDir | 0755,
+		modTime: modTime,
+		dirs:    make(map[string]*importDir),
+		files:   make(map[string]fs.DirEnt),
+	}
+}
+
+// lookup returns the directory at p, creating it and any missing parents.
+func (d *importDir) lookup(p string, modTime int64) (*importDir, error) {
+	if p == "/" {
+		return d, nil
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		if _, ok := d.files[name]; ok {
+			return nil, fmt.Errorf("%s is not a directory", name)
+		}
+		child, ok := d.dirs[name]
+		if !ok {
+			child = newImportDir(modTime)
+			d.dirs[name] = child
+		}
+		d = child
+	}
+	return d, nil
+}
+
+func (d *importDir) addDir(p string, mode os.FileMode, modTime int64) error {
+	dir, err := d.lookup(p, modTime)
+	if err != nil {
+		return err
+	}
+	dir.mode = os.ModeDir | mode.Perm()
+	dir.modTime = modTime
+	return nil
+}
+
+// addFile adds a file, replacing an earlier file with the same path
+// like extracting the archive would.
+func (d *importDir) addFile(p string, ent fs.DirEnt) error {
+	dir, err := d.lookup(path.Dir(p), ent.EntModTime)
+	if err != nil {
+		return err
+	}
+	ent.EntName = path.Base(p)
+	if _, ok := dir.dirs[ent.EntName]; ok {
+		return fmt.Errorf("%s is a directory", p)
+	}
+	dir.files[ent.EntName] = ent
+	return nil
+}
+
+func (d *importDir) write(store bpy.CStore) (fs.DirEnt, error) {
+	ents := make(fs.DirEnts, 0, len(d.dirs)+len(d.files))
+	for name, child := range d.dirs {
+		ent, err := child.write(store)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		ent.EntName = name
+		ents = append(ents, ent)
+	}
+	for _, ent := range d.files {
+		ents = append(ents, ent)
+	}
+	dirEnt, err := fs.WriteDir(store, ents, d.mode)
+	dirEnt.EntModTime = d.modTime
+	return dirEnt, err
+}
+
+// importFile stores a file, mode is kept as is so symlinks can be stored
+// with their target as contents.
+func importFile(store bpy.CStore, r io.Reader, mode os.FileMode, modTime time.Time, prog *progress.Progress) (fs.DirEnt, error) {
+	w := htree.NewWriter(store)
+	size, err := io.Copy(w, prog.Reader(r, progress.BytesIn))
+	if err != nil {
+		w.Close()
+		return fs.DirEnt{}, err
+	}
+	tree, err := w.Close()
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	prog.Add(progress.Files, 1)
+	return fs.DirEnt{
+		EntSize:    size,
+		EntMode:    mode,
+		EntModTime: modTime.Unix(),
+		HTree:      tree,
+	}, nil
+}
+
+func (d *importDir) importFile(store bpy.CStore, p string, r io.Reader, mode os.FileMode, modTime time.Time, prog *progress.Progress) error {
+	ent, err := importFile(store, r, mode, modTime, prog)
+	if err != nil {
+		return err
+	}
+	return d.addFile(p, ent)
+}
+
+// link adds p as a copy of the file at target, which must already have
+// been added.
+func (d *importDir) link(p, target string) error {
+	target = path.Clean("/" + target)
+	dir, err := d.lookup(path.Dir(target), 0)
+	if err != nil {
+		return err
+	}
+	ent, ok := dir.files[path.Base(target)]
+	if !ok {
+		return fmt.Errorf("%s links to missing file %s", p, target)
+	}
+	return d.addFile(p, ent)
+}
+
+// ImportTar stores the directories, regular files, hard links and symbolic
+// links of the tar stream as a new directory, other entries are skipped.
+// Hard links become copies of their target, and symbolic links are stored
+// with their target as contents. prog may be nil.
+func ImportTar(store bpy.CStore, in io.Reader, prog *progress.Progress) (fs.DirEnt, error) {
+	root := newImportDir(time.Now().Unix())
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = root.addDir(p, mode, hdr.ModTime.Unix())
+		case tar.TypeReg, tar.TypeRegA:
+			err = root.importFile(store, p, tr, mode.Perm(), hdr.ModTime, prog)
+		case tar.TypeLink:
+			err = root.link(p, hdr.Linkname)
+		case tar.TypeSymlink:
+			err = root.importFile(store, p, strings.NewReader(hdr.Linkname), os.ModeSymlink|mode.Perm(), hdr.ModTime, prog)
+		}
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+	}
+	return root.write(store)
+}
+
+// ImportZip stores the directories, regular files and symbolic links of
+// the zip archive of the given size as a new directory, other entries are
+// skipped. Symbolic links are stored with their target as contents. prog
+// may be nil.
+func ImportZip(store bpy.CStore, in io.ReaderAt, size int64, prog *progress.Progress) (fs.DirEnt, error) {
+	zr, err := zip.NewReader(in, size)
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	root := newImportDir(time.Now().Unix())
+	for _, f := range zr.File {
+		p := path.Clean("/" + f.Name)
+		if p == "/" {
+			continue
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = root.addDir(p, mode, f.Modified.Unix())
+		case mode.IsRegular(), mode&os.ModeSymlink != 0:
+			err = importZipFile(store, root, p, f, mode&(os.ModeSymlink|os.ModePerm), prog)
+		}
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+	}
+	return root.write(store)
+}
+
+func importZipFile(store bpy.CStore, root *importDir, p string, f *zip.File, mode os.FileMode, prog *progress.Progress) error {
+	rdr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	err = root.importFile(store, p, rdr, mode, f.Modified, prog)
+	if err != nil {
+		rdr.Close()
+		return err
+	}
+	return rdr.Close()
+}
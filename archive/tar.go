@@ -4,27 +4,31 @@ import (
 	"archive/tar"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/progress"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
 )
 
-func Tar(store bpy.CStore, dirHash [32]byte, out io.Writer) error {
+// prog may be nil.
+func Tar(store bpy.CStore, dirHash [32]byte, out io.Writer, prog *progress.Progress) error {
 	tw := tar.NewWriter(out)
-	err := writeTar(store, "", dirHash, tw)
+	err := writeTar(store, "", dirHash, tw, prog)
 	if err != nil {
 		return err
 	}
 	return tw.Close()
 }
 
-func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Writer) error {
+func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Writer, prog *progress.Progress) error {
 	ents, err := fs.ReadDir(store, dirHash)
 	if err != nil {
 		return err
 	}
 	for _, ent := range ents[1:] {
 		if ent.IsDir() {
-			err = writeTar(store, path.Join(curpath, ent.EntName), ent.HTree.Data, out)
+			err = writeTar(store, path.Join(curpath, ent.EntName), ent.HTree.Data, out, prog)
 			if err != nil {
 				return err
 			}
@@ -34,8 +38,18 @@ func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Write
 		if err != nil {
 			return err
 		}
-		hdr, err := tar.FileInfoHeader(&ent, "")
+		link := ""
+		if ent.EntMode&os.ModeSymlink != 0 {
+			target, err := ioutil.ReadAll(f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			link = string(target)
+		}
+		hdr, err := tar.FileInfoHeader(&ent, link)
 		if err != nil {
+			f.Close()
 			return err
 		}
 		hdr.Name = path.Join(curpath, ent.EntName)
@@ -43,10 +57,11 @@ func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Write
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(out, f)
+		_, err = io.Copy(prog.Writer(out, progress.BytesOut), f)
 		if err != nil {
 			return err
 		}
+		prog.Add(progress.Files, 1)
 		err = f.Close()
 		if err != nil {
 			return err
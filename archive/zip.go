@@ -4,27 +4,29 @@ import (
 	"archive/zip"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/progress"
 	"io"
 	"path"
 )
 
-func Zip(store bpy.CStore, dirHash [32]byte, out io.Writer) error {
+// prog may be nil.
+func Zip(store bpy.CStore, dirHash [32]byte, out io.Writer, prog *progress.Progress) error {
 	zw := zip.NewWriter(out)
-	err := writeZip(store, "", dirHash, zw)
+	err := writeZip(store, "", dirHash, zw, prog)
 	if err != nil {
 		return err
 	}
 	return zw.Close()
 }
 
-func writeZip(store bpy.CStore, curpath string, dirHash [32]byte, out *zip.Writer) error {
+func writeZip(store bpy.CStore, curpath string, dirHash [32]byte, out *zip.Writer, prog *progress.Progress) error {
 	ents, err := fs.ReadDir(store, dirHash)
 	if err != nil {
 		return err
 	}
 	for _, ent := range ents[1:] {
 		if ent.IsDir() {
-			err = writeZip(store, path.Join(curpath, ent.EntName), ent.HTree.Data, out)
+			err = writeZip(store, path.Join(curpath, ent.EntName), ent.HTree.Data, out, prog)
 			if err != nil {
 				return err
 			}
@@ -34,17 +36,24 @@ func writeZip(store bpy.CStore, curpath string, dirHash [32]byte, out *zip.Write
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 		hdr, err := zip.FileInfoHeader(&ent)
 		if err != nil {
+			f.Close()
 			return err
 		}
 		hdr.Name = path.Join(curpath, ent.EntName)
 		outfile, err := out.CreateHeader(hdr)
 		if err != nil {
+			f.Close()
 			return err
 		}
-		_, err = io.Copy(outfile, f)
+		_, err = io.Copy(prog.Writer(outfile, progress.BytesOut), f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		prog.Add(progress.Files, 1)
+		err = f.Close()
 		if err != nil {
 			return err
 		}
@@ -141,4 +141,19 @@ func TestEncryptedBpack(t *testing.T) {
 			t.Fatalf("k=(%v) %v != %v", []byte(k), v, gotv)
 		}
 	}
+	offsets := make([]uint64, 0, len(r.Idx))
+	sizes := make([]uint32, 0, len(r.Idx))
+	for _, ent := range r.Idx {
+		offsets = append(offsets, ent.Offset)
+		sizes = append(sizes, ent.Size)
+	}
+	vals, err := r.GetAtV(offsets, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ent := range r.Idx {
+		if !bytes.Equal(has[ent.Key], vals[i]) {
+			t.Fatalf("k=(%v) %v != %v", []byte(ent.Key), has[ent.Key], vals[i])
+		}
+	}
 }
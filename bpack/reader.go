@@ -45,6 +45,38 @@ func (r *Reader) GetAt(offset uint64, sz uint32) ([]byte, error) {
 	return buf, err
 }
 
+// RangeReader is implemented by pack files that can read many ranges in one request.
+type RangeReader interface {
+	ReadV(offsets []uint64, sizes []uint32) ([][]byte, error)
+}
+
+// GetAtV reads many values at once, in a single request if the
+// underlying file is a RangeReader.
+func (r *Reader) GetAtV(offsets []uint64, sizes []uint32) ([][]byte, error) {
+	rv, ok := r.r.(RangeReader)
+	if !ok {
+		bufs := make([][]byte, len(offsets))
+		for i := range offsets {
+			buf, err := r.GetAt(offsets[i], sizes[i])
+			if err != nil {
+				return nil, err
+			}
+			bufs[i] = buf
+		}
+		return bufs, nil
+	}
+	bufs, err := rv.ReadV(offsets, sizes)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bufs {
+		if uint32(len(bufs[i])) != sizes[i] {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return bufs, nil
+}
+
 func (r *Reader) Close() error {
 	return r.r.Close()
 }
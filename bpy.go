@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
 )
 
 type CStore interface {
@@ -19,6 +20,38 @@ type CStore interface {
 	Close() error
 }
 
+// BatchGetter is implemented by stores that fetch many chunks at
+// once faster than one at a time.
+type BatchGetter interface {
+	GetMany([][32]byte) ([][]byte, error)
+}
+
+// GetMany fetches the chunks in one batch if the store supports it,
+// otherwise it fetches them concurrently.
+func GetMany(store CStore, hashes [][32]byte) ([][]byte, error) {
+	batcher, ok := store.(BatchGetter)
+	if ok {
+		return batcher.GetMany(hashes)
+	}
+	vals := make([][]byte, len(hashes))
+	errs := make([]error, len(hashes))
+	var wg sync.WaitGroup
+	for i := range hashes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vals[i], errs[i] = store.Get(hashes[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
 type Key struct {
 	CipherKey [32]byte
 	HmacKey   [32]byte
@@ -0,0 +1,412 @@
+package browse
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/archive"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/rootfs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHistoryLimit = 100
+
+// Entry describes a file or directory in API responses.
+type Entry struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Mode      string `json:"mode"`
+	IsDir     bool   `json:"is_dir"`
+	MTime     int64  `json:"mtime"`
+	HTreeHash string `json:"htree_hash"`
+}
+
+// Ref describes a snapshot in the history.
+type Ref struct {
+	Hash      string `json:"hash"`
+	CreatedAt int64  `json:"created_at"`
+	Root      string `json:"root"`
+	Prev      string `json:"prev,omitempty"`
+}
+
+// Change is a path that was added, removed or changed between two
+// snapshots. The contents of added and removed directories are not listed.
+type Change struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	IsDir  bool   `json:"is_dir"`
+}
+
+// GCStatus reports the last gc started through the API.
+type GCStatus struct {
+	Running    bool   `json:"running"`
+	StartedAt  int64  `json:"started_at,omitempty"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newEntryInfo(p string, ent fs.DirEnt) Entry {
+	return Entry{
+		Path:      p,
+		Name:      path.Base(p),
+		Size:      ent.EntSize,
+		Mode:      ent.EntMode.String(),
+		IsDir:     ent.IsDir(),
+		MTime:     ent.EntModTime,
+		HTreeHash: hex.EncodeToString(ent.HTree.Data[:]),
+	}
+}
+
+func newRefInfo(hash [32]byte, ref refs.Ref) Ref {
+	info := Ref{
+		Hash:      hex.EncodeToString(hash[:]),
+		CreatedAt: ref.CreatedAt,
+		Root:      hex.EncodeToString(ref.Root[:]),
+	}
+	if ref.HasPrev {
+		info.Prev = hex.EncodeToString(ref.Prev[:])
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(buf, '\n'))
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) error {
+	for _, m := range methods {
+		if r.Method == m {
+			return nil
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	return errStatus(http.StatusMethodNotAllowed)
+}
+
+// serveAPI serves the request for the endpoint p, which is the request
+// path without the /api prefix.
+func (h *Handler) serveAPI(w http.ResponseWriter, r *http.Request, p string) error {
+	name := strings.TrimPrefix(p, "/")
+	rest := "/"
+	idx := strings.Index(name, "/")
+	if idx != -1 {
+		rest = cleanPath(name[idx:])
+		name = name[:idx]
+	}
+	var methods []string
+	switch name {
+	case "ls", "stat", "raw", "history", "diff":
+		methods = []string{"GET", "HEAD"}
+	case "put":
+		methods = []string{"POST"}
+	case "gc":
+		methods = []string{"GET", "HEAD", "POST"}
+	default:
+		return errStatus(http.StatusNotFound)
+	}
+	err := allowMethods(w, r, methods...)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "ls":
+		return h.apiLs(w, r, rest)
+	case "stat":
+		return h.apiStat(w, r, rest)
+	case "raw":
+		return h.apiRaw(w, r, rest)
+	case "history":
+		return h.apiHistory(w, r)
+	case "diff":
+		return h.apiDiff(w, r)
+	case "put":
+		return h.apiPut(w, r, rest)
+	default:
+		return h.apiGC(w, r)
+	}
+}
+
+func (h *Handler) apiLs(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, false)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !ent.IsDir() {
+		return &httpError{code: http.StatusBadRequest, msg: "not a directory"}
+	}
+	ents, err := fs.ReadDir(v.store, ent.HTree.Data)
+	if err != nil {
+		return err
+	}
+	result := make([]Entry, 0, len(ents)-1)
+	for _, ent := range ents[1:] {
+		result = append(result, newEntryInfo(path.Join(p, ent.EntName), ent))
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *Handler) apiStat(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, false)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newEntryInfo(p, ent))
+	return nil
+}
+
+func (h *Handler) apiRaw(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, false)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !ent.Mode().IsRegular() {
+		return &httpError{code: http.StatusBadRequest, msg: "not a file"}
+	}
+	return serveFile(w, r, v.store, ent)
+}
+
+func (h *Handler) apiHistory(w http.ResponseWriter, r *http.Request) error {
+	limit := defaultHistoryLimit
+	if r.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			return &httpError{code: http.StatusBadRequest, msg: "bad limit"}
+		}
+	}
+	store, refHash, ref, err := h.head()
+	if err != nil {
+		return err
+	}
+	defer store.Release()
+	var result []Ref
+	for {
+		result = append(result, newRefInfo(refHash, ref))
+		if !ref.HasPrev || len(result) == limit {
+			break
+		}
+		refHash = ref.Prev
+		ref, err = refs.GetRef(store, refHash)
+		if err != nil {
+			return err
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// children returns the entries of the directory at p below root, nil
+// if there is no such directory or root is nil.
+func children(store bpy.CStore, root *[32]byte, p string) (fs.DirEnts, error) {
+	if root == nil {
+		return nil, nil
+	}
+	ent, ok, err := fs.Lookup(store, *root, p)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	if !ent.IsDir() {
+		return nil, &httpError{code: http.StatusBadRequest, msg: "not a directory"}
+	}
+	ents, err := fs.ReadDir(store, ent.HTree.Data)
+	if err != nil {
+		return nil, err
+	}
+	return ents[1:], nil
+}
+
+func (h *Handler) apiDiff(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	to, err := h.viewRef(q.Get("to"), false)
+	if err != nil {
+		return err
+	}
+	defer to.store.Release()
+	var fromRoot *[32]byte
+	if q.Get("from") != "" {
+		from, err := h.viewRef(q.Get("from"), false)
+		if err != nil {
+			return err
+		}
+		defer from.store.Release()
+		fromRoot = &from.ref.Root
+	} else if to.ref.HasPrev {
+		prev, err := refs.GetRef(to.store, to.ref.Prev)
+		if err != nil {
+			return err
+		}
+		fromRoot = &prev.Root
+	}
+	p := cleanPath(q.Get("path"))
+	fromEnts, err := children(to.store, fromRoot, p)
+	if err != nil {
+		return err
+	}
+	toEnts, err := children(to.store, &to.ref.Root, p)
+	if err != nil {
+		return err
+	}
+	changes := []Change{}
+	err = diff(to.store, p, fromEnts, toEnts, &changes)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	writeJSON(w, http.StatusOK, changes)
+	return nil
+}
+
+func diff(store bpy.CStore, dirPath string, from, to fs.DirEnts, changes *[]Change) error {
+	old := make(map[string]fs.DirEnt)
+	for _, ent := range from {
+		old[ent.EntName] = ent
+	}
+	for _, ent := range to {
+		p := path.Join(dirPath, ent.EntName)
+		prev, ok := old[ent.EntName]
+		delete(old, ent.EntName)
+		switch {
+		case !ok:
+			*changes = append(*changes, Change{Path: p, Change: "added", IsDir: ent.IsDir()})
+		case prev.IsDir() != ent.IsDir():
+			*changes = append(*changes, Change{Path: p, Change: "removed", IsDir: prev.IsDir()})
+			*changes = append(*changes, Change{Path: p, Change: "added", IsDir: ent.IsDir()})
+		case ent.IsDir():
+			if prev.EntMode != ent.EntMode {
+				*changes = append(*changes, Change{Path: p, Change: "changed", IsDir: true})
+			}
+			if prev.HTree.Data == ent.HTree.Data {
+				continue
+			}
+			prevEnts, err := fs.ReadDir(store, prev.HTree.Data)
+			if err != nil {
+				return err
+			}
+			ents, err := fs.ReadDir(store, ent.HTree.Data)
+			if err != nil {
+				return err
+			}
+			err = diff(store, p, prevEnts[1:], ents[1:], changes)
+			if err != nil {
+				return err
+			}
+		case prev.HTree.Data != ent.HTree.Data || prev.EntMode != ent.EntMode:
+			*changes = append(*changes, Change{Path: p, Change: "changed"})
+		}
+	}
+	for _, ent := range old {
+		*changes = append(*changes, Change{Path: path.Join(dirPath, ent.EntName), Change: "removed", IsDir: ent.IsDir()})
+	}
+	return nil
+}
+
+// apiPut stores the uploaded tar as a new directory at p.
+func (h *Handler) apiPut(w http.ResponseWriter, r *http.Request, p string) error {
+	if !h.opts.Writable {
+		return &httpError{code: http.StatusForbidden, msg: "uploads are disabled"}
+	}
+	if p == "/" {
+		return &httpError{code: http.StatusBadRequest, msg: "cannot replace the root"}
+	}
+	store := h.fs.Store()
+	defer store.Release()
+	ent, err := archive.ImportTar(store, r.Body, nil)
+	if err != nil {
+		return &httpError{code: http.StatusBadRequest, msg: "error importing tar: " + err.Error()}
+	}
+	err = h.fs.UpdateWith(store, func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		_, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok {
+			return fs.DirEnt{}, &httpError{code: http.StatusConflict, msg: p + " already exists"}
+		}
+		parent, ok, err := fs.Lookup(store, root, path.Dir(p))
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok && !parent.IsDir() {
+			return fs.DirEnt{}, &httpError{code: http.StatusConflict, msg: path.Dir(p) + " is not a directory"}
+		}
+		newRoot, err := fs.MkdirAll(store, root, path.Dir(p), 0755)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		return fs.Insert(store, newRoot.HTree.Data, p, ent)
+	})
+	if err == rootfs.ErrStoreReplaced {
+		return &httpError{code: http.StatusServiceUnavailable, msg: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newEntryInfo(p, ent))
+	return nil
+}
+
+func (h *Handler) apiGC(w http.ResponseWriter, r *http.Request) error {
+	h.gcLock.Lock()
+	defer h.gcLock.Unlock()
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusOK, h.gcStatus)
+		return nil
+	}
+	if h.opts.GC == nil {
+		return &httpError{code: http.StatusForbidden, msg: "gc is disabled"}
+	}
+	if h.gcStatus.Running {
+		return &httpError{code: http.StatusConflict, msg: "gc already running"}
+	}
+	h.gcStatus = GCStatus{Running: true, StartedAt: time.Now().Unix()}
+	go func() {
+		err := h.opts.GC()
+		h.gcLock.Lock()
+		defer h.gcLock.Unlock()
+		h.gcStatus.Running = false
+		h.gcStatus.FinishedAt = time.Now().Unix()
+		if err != nil {
+			h.gcStatus.Error = err.Error()
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, h.gcStatus)
+	return nil
+}
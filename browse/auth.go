@@ -0,0 +1,46 @@
+package browse
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Auth holds the credentials RequireAuth accepts. Browsers use HTTP
+// basic auth with User and Password, other tools can send Token as a
+// bearer token. Empty credentials are never accepted.
+type Auth struct {
+	User     string
+	Password string
+	Token    string
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a Auth) check(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if ok && a.Password != "" {
+		return equal(user, a.User) && equal(password, a.Password)
+	}
+	authz := r.Header.Get("Authorization")
+	if a.Token != "" && strings.HasPrefix(authz, "Bearer ") {
+		return equal(strings.TrimPrefix(authz, "Bearer "), a.Token)
+	}
+	return false
+}
+
+// RequireAuth only passes requests with valid credentials on to h.
+func RequireAuth(h http.Handler, a Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.check(r) {
+			if a.Password != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="bpy", charset="UTF-8"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,510 @@
+package browse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/archive"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/rootfs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxSnapshots     = 100
+	maxSearchResults = 500
+	timeFormat       = "2006-01-02 15:04:05"
+)
+
+// Handler serves a read only web interface to the drive, with listings
+// of any snapshot in the history, filename search and archive downloads,
+// and a JSON API below /api/. Only API requests may change anything, and
+// only when enabled by the options.
+type Handler struct {
+	fs   *rootfs.FS
+	opts Options
+
+	gcLock   sync.Mutex
+	gcStatus GCStatus
+}
+
+// Options enable the API requests that change the drive.
+type Options struct {
+	// Writable allows uploads through the API.
+	Writable bool
+	// GC is run when a gc is started through the API, nil disables it.
+	GC func() error
+}
+
+func NewHandler(f *rootfs.FS, opts Options) *Handler {
+	return &Handler{fs: f, opts: opts}
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func errStatus(code int) error {
+	return &httpError{code: code, msg: http.StatusText(code)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	var err error
+	switch {
+	case api:
+		err = h.serveAPI(w, r, r.URL.Path[4:])
+	case r.Method != "GET" && r.Method != "HEAD":
+		w.Header().Set("Allow", "GET, HEAD")
+		err = errStatus(http.StatusMethodNotAllowed)
+	case strings.HasPrefix(r.URL.Path, "/raw/"):
+		err = h.serveRaw(w, r, cleanPath(r.URL.Path[4:]))
+	case strings.HasPrefix(r.URL.Path, "/archive/"):
+		err = h.serveArchive(w, r, cleanPath(r.URL.Path[8:]))
+	default:
+		err = h.serveDir(w, r, cleanPath(r.URL.Path))
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		herr, ok := err.(*httpError)
+		if ok {
+			code = herr.code
+		} else {
+			log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		}
+		if api {
+			writeJSON(w, code, apiError{Error: err.Error()})
+			return
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).Format(timeFormat)
+}
+
+type snapshot struct {
+	Hash      string
+	CreatedAt string
+	Selected  bool
+}
+
+// view is the snapshot a request is for, the latest one unless the
+// ref query parameter selects an older one.
+type view struct {
+	store     *rootfs.Store
+	param     string
+	ref       refs.Ref
+	snapshots []snapshot
+}
+
+func (h *Handler) head() (*rootfs.Store, [32]byte, refs.Ref, error) {
+	store, refHash, ref, err := h.fs.Head()
+	if err == rootfs.ErrRootMissing {
+		return nil, [32]byte{}, refs.Ref{}, &httpError{code: http.StatusNotFound, msg: err.Error()}
+	}
+	return store, refHash, ref, err
+}
+
+func (h *Handler) view(r *http.Request, listSnapshots bool) (*view, error) {
+	return h.viewRef(r.URL.Query().Get("ref"), listSnapshots)
+}
+
+// viewRef returns a view of the snapshot with the hex ref hash param,
+// or the latest one if it is empty.
+// viewRef finds the snapshot with the hash param, the store of the view
+// must be released.
+func (h *Handler) viewRef(param string, listSnapshots bool) (*view, error) {
+	store, refHash, ref, err := h.head()
+	if err != nil {
+		return nil, err
+	}
+	v, err := findRef(store, refHash, ref, param, listSnapshots)
+	if err != nil {
+		store.Release()
+		return nil, err
+	}
+	return v, nil
+}
+
+func findRef(store *rootfs.Store, refHash [32]byte, ref refs.Ref, param string, listSnapshots bool) (*view, error) {
+	var err error
+	v := &view{
+		store: store,
+		param: param,
+		ref:   ref,
+	}
+	var want [32]byte
+	if v.param != "" {
+		buf, err := hex.DecodeString(v.param)
+		if err != nil || len(buf) != len(want) {
+			return nil, &httpError{code: http.StatusBadRequest, msg: "bad snapshot hash"}
+		}
+		copy(want[:], buf)
+	}
+
+	found := v.param == ""
+	listed := v.param == ""
+	for i := 0; ; i++ {
+		if !found && refHash == want {
+			v.ref = ref
+			found = true
+		}
+		if listSnapshots && i < maxSnapshots {
+			s := snapshot{
+				Hash:      hex.EncodeToString(refHash[:]),
+				CreatedAt: formatTime(ref.CreatedAt),
+			}
+			if i == 0 {
+				s.Hash = ""
+				s.Selected = v.param == ""
+			} else if v.param != "" && refHash == want {
+				s.Selected = true
+				listed = true
+			}
+			v.snapshots = append(v.snapshots, s)
+		}
+		if !ref.HasPrev || found && (!listSnapshots || i+1 >= maxSnapshots) {
+			break
+		}
+		refHash = ref.Prev
+		ref, err = refs.GetRef(store, refHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, &httpError{code: http.StatusNotFound, msg: "snapshot not in history"}
+	}
+	if listSnapshots && !listed {
+		v.snapshots = append(v.snapshots, snapshot{
+			Hash:      v.param,
+			CreatedAt: formatTime(v.ref.CreatedAt),
+			Selected:  true,
+		})
+	}
+	return v, nil
+}
+
+// link returns a link to p in the snapshot being viewed.
+func (v *view) link(p string, query url.Values) string {
+	if v.param != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("ref", v.param)
+	}
+	u := url.URL{Path: p, RawQuery: query.Encode()}
+	return u.String()
+}
+
+func (v *view) lookup(p string) (fs.DirEnt, error) {
+	ent, ok, err := fs.Lookup(v.store, v.ref.Root, p)
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	if !ok {
+		return fs.DirEnt{}, errStatus(http.StatusNotFound)
+	}
+	return ent, nil
+}
+
+type crumb struct {
+	Name string
+	Link string
+}
+
+type entry struct {
+	Name    string
+	Link    string
+	Mode    string
+	Size    string
+	ModTime string
+	Status  string
+}
+
+type page struct {
+	Path      string
+	Ref       string
+	Crumbs    []crumb
+	Snapshots []snapshot
+	Query     string
+	Truncated bool
+	DiffSince string
+	TarLink   string
+	ZipLink   string
+	Entries   []entry
+}
+
+func newEntry(link string, name string, ent fs.DirEnt) entry {
+	e := entry{
+		Name:    name,
+		Link:    link,
+		Mode:    ent.Mode().String(),
+		Size:    "-",
+		ModTime: formatTime(ent.EntModTime),
+	}
+	if !ent.IsDir() {
+		e.Size = fmt.Sprintf("%d", ent.EntSize)
+	}
+	return e
+}
+
+func (v *view) entry(p string, name string, ent fs.DirEnt) entry {
+	if ent.IsDir() {
+		return newEntry(v.link(p, nil), name, ent)
+	}
+	return newEntry(v.link("/raw"+p, nil), name, ent)
+}
+
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, true)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !ent.IsDir() {
+		http.Redirect(w, r, v.link("/raw"+p, nil), http.StatusFound)
+		return nil
+	}
+
+	pg := &page{
+		Path:      p,
+		Ref:       v.param,
+		Snapshots: v.snapshots,
+		Query:     r.URL.Query().Get("q"),
+		TarLink:   v.link("/archive"+p, url.Values{"format": {"tar"}}),
+		ZipLink:   v.link("/archive"+p, url.Values{"format": {"zip"}}),
+	}
+	pg.Crumbs = append(pg.Crumbs, crumb{Name: "/", Link: v.link("/", nil)})
+	if p != "/" {
+		names := strings.Split(p[1:], "/")
+		for i, name := range names {
+			crumbPath := "/" + strings.Join(names[:i+1], "/")
+			pg.Crumbs = append(pg.Crumbs, crumb{Name: name, Link: v.link(crumbPath, nil)})
+		}
+	}
+
+	if pg.Query != "" {
+		err = v.search(pg, p, ent)
+	} else {
+		err = v.list(pg, p, ent)
+	}
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = pageTemplate.Execute(&buf, pg)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// list fills in the entries of the directory, marking the ones that
+// differ from the previous snapshot.
+func (v *view) list(pg *page, p string, dir fs.DirEnt) error {
+	ents, err := fs.ReadDir(v.store, dir.HTree.Data)
+	if err != nil {
+		return err
+	}
+	var prevParam string
+	var prevEnts map[string]fs.DirEnt
+	if v.ref.HasPrev {
+		prevRef, err := refs.GetRef(v.store, v.ref.Prev)
+		if err != nil {
+			return err
+		}
+		prevParam = hex.EncodeToString(v.ref.Prev[:])
+		pg.DiffSince = formatTime(prevRef.CreatedAt)
+		prevEnts = make(map[string]fs.DirEnt)
+		prevDir, ok, err := fs.Lookup(v.store, prevRef.Root, p)
+		if err != nil {
+			return err
+		}
+		if ok && prevDir.IsDir() {
+			prev, err := fs.ReadDir(v.store, prevDir.HTree.Data)
+			if err != nil {
+				return err
+			}
+			for _, ent := range prev[1:] {
+				prevEnts[ent.EntName] = ent
+			}
+		}
+	}
+
+	var dirs, files []entry
+	for _, ent := range ents[1:] {
+		if !ent.IsDir() && !ent.Mode().IsRegular() {
+			continue
+		}
+		e := v.entry(path.Join(p, ent.EntName), ent.EntName, ent)
+		if prevEnts != nil {
+			prev, ok := prevEnts[ent.EntName]
+			switch {
+			case !ok:
+				e.Status = "added"
+			case prev.HTree.Data != ent.HTree.Data || prev.EntMode != ent.EntMode:
+				e.Status = "changed"
+			}
+			delete(prevEnts, ent.EntName)
+		}
+		if ent.IsDir() {
+			dirs = append(dirs, e)
+		} else {
+			files = append(files, e)
+		}
+	}
+	pg.Entries = append(dirs, files...)
+
+	prevView := &view{param: prevParam}
+	var removed fs.DirEnts
+	for _, ent := range prevEnts {
+		if !ent.IsDir() && !ent.Mode().IsRegular() {
+			continue
+		}
+		removed = append(removed, ent)
+	}
+	sort.Sort(removed)
+	for _, ent := range removed {
+		e := prevView.entry(path.Join(p, ent.EntName), ent.EntName, ent)
+		e.Status = "removed"
+		pg.Entries = append(pg.Entries, e)
+	}
+	return nil
+}
+
+var errEnoughResults = errors.New("enough results")
+
+// search fills in the entries below the directory whose name contains
+// the query, or matches it if it is a glob pattern.
+func (v *view) search(pg *page, p string, dir fs.DirEnt) error {
+	query := strings.ToLower(pg.Query)
+	glob := strings.ContainsAny(query, "*?[")
+	if glob {
+		_, err := path.Match(query, "")
+		if err != nil {
+			return &httpError{code: http.StatusBadRequest, msg: "bad search pattern"}
+		}
+	}
+	err := fs.WalkDir(v.store, dir.HTree.Data, func(entPath string, ent fs.DirEnt) error {
+		name := strings.ToLower(ent.EntName)
+		match := strings.Contains(name, query)
+		if glob {
+			match, _ = path.Match(query, name)
+		}
+		if !match || !ent.IsDir() && !ent.Mode().IsRegular() {
+			return nil
+		}
+		if len(pg.Entries) == maxSearchResults {
+			pg.Truncated = true
+			return errEnoughResults
+		}
+		pg.Entries = append(pg.Entries, v.entry(path.Join(p, entPath), entPath, ent))
+		return nil
+	})
+	if err == errEnoughResults {
+		return nil
+	}
+	return err
+}
+
+func (h *Handler) serveRaw(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, false)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	if ent.IsDir() {
+		http.Redirect(w, r, v.link(p, nil), http.StatusFound)
+		return nil
+	}
+	if !ent.Mode().IsRegular() {
+		return errStatus(http.StatusNotFound)
+	}
+	return serveFile(w, r, v.store, ent)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, store bpy.CStore, ent fs.DirEnt) error {
+	f, err := fs.OpenEnt(store, ent)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+hex.EncodeToString(ent.HTree.Data[:])+`"`)
+	http.ServeContent(w, r, ent.EntName, ent.ModTime(), f)
+	return nil
+}
+
+func (h *Handler) serveArchive(w http.ResponseWriter, r *http.Request, p string) error {
+	v, err := h.view(r, false)
+	if err != nil {
+		return err
+	}
+	defer v.store.Release()
+	ent, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !ent.IsDir() {
+		return &httpError{code: http.StatusBadRequest, msg: "not a directory"}
+	}
+
+	write := archive.Tar
+	contentType := "application/x-tar"
+	ext := ".tar"
+	switch r.URL.Query().Get("format") {
+	case "", "tar":
+	case "zip":
+		write = archive.Zip
+		contentType = "application/zip"
+		ext = ".zip"
+	default:
+		return &httpError{code: http.StatusBadRequest, msg: "unknown archive format"}
+	}
+	name := path.Base(p)
+	if p == "/" {
+		name = "bpy"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	if r.Method == "HEAD" {
+		return nil
+	}
+	// The status is sent with the first write, so errors can only be logged.
+	err = write(v.store, ent.HTree.Data, w, nil)
+	if err != nil {
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package browse
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/rootfs"
+	"github.com/buppyio/bpy/rootfs/rootfstest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update commits the files in one snapshot, files with no contents are
+// removed.
+func update(t *testing.T, f *rootfs.FS, files map[string]string) {
+	err := f.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		for p, contents := range files {
+			newRoot, err := fs.MkdirAll(store, root, path.Dir(p), 0755)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			root = newRoot.HTree.Data
+			_, ok, err := fs.Lookup(store, root, p)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			if ok {
+				newRoot, err = fs.Remove(store, root, p)
+				if err != nil {
+					return fs.DirEnt{}, err
+				}
+				root = newRoot.HTree.Data
+			}
+			if contents == "" {
+				continue
+			}
+			tw := htree.NewWriter(store)
+			_, err = io.WriteString(tw, contents)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			tree, err := tw.Close()
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			newRoot, err = fs.Insert(store, root, p, fs.DirEnt{
+				EntSize:    int64(len(contents)),
+				EntMode:    0644,
+				EntModTime: time.Now().Unix(),
+				HTree:      tree,
+			})
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			root = newRoot.HTree.Data
+		}
+		ents, err := fs.ReadDir(store, root)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		return ents[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rowClass(t *testing.T, listing, name string) string {
+	re := regexp.MustCompile(`<tr( class="(\w+)")?><td>[^<]*</td><td><a href="[^"]*">` + regexp.QuoteMeta(name) + `</a>`)
+	m := re.FindStringSubmatch(listing)
+	if m == nil {
+		t.Fatalf("%s missing from listing: %s", name, listing)
+	}
+	return m[2]
+}
+
+func TestBrowse(t *testing.T) {
+	f, cleanup := rootfstest.New(t)
+	defer cleanup()
+	srv := httptest.NewServer(NewHandler(f, Options{}))
+	defer srv.Close()
+
+	get := func(p string, expected int) (string, http.Header) {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("GET %s: expected %d, got %d: %s", p, expected, resp.StatusCode, data)
+		}
+		return string(data), resp.Header
+	}
+
+	update(t, f, map[string]string{"/docs/a.txt": "alpha", "/docs/b.txt": "beta"})
+	update(t, f, map[string]string{"/<b>.txt": "top"})
+
+	listing, _ := get("/", http.StatusOK)
+	if strings.Contains(listing, "<b>.txt") {
+		t.Fatal("names are not escaped")
+	}
+	if rowClass(t, listing, "&lt;b&gt;.txt") != "added" || rowClass(t, listing, "docs") != "" {
+		t.Fatalf("bad highlighting: %s", listing)
+	}
+
+	store, oldHash, _, err := f.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Release()
+	old := hex.EncodeToString(oldHash[:])
+	update(t, f, map[string]string{"/docs/a.txt": "alpha 2", "/docs/b.txt": "", "/docs/c.txt": "gamma"})
+
+	listing, _ = get("/docs", http.StatusOK)
+	if !strings.Contains(listing, `<a href="/docs">docs</a>`) {
+		t.Fatalf("bad breadcrumbs: %s", listing)
+	}
+	if rowClass(t, listing, "a.txt") != "changed" || rowClass(t, listing, "c.txt") != "added" || rowClass(t, listing, "b.txt") != "removed" {
+		t.Fatalf("bad highlighting: %s", listing)
+	}
+	if !strings.Contains(listing, `<option value="`+old+`">`) {
+		t.Fatalf("snapshot missing from picker: %s", listing)
+	}
+
+	listing, _ = get("/docs?ref="+old, http.StatusOK)
+	if rowClass(t, listing, "b.txt") != "" || strings.Contains(listing, "c.txt") {
+		t.Fatalf("bad snapshot listing: %s", listing)
+	}
+	if !strings.Contains(listing, `<a href="/raw/docs/a.txt?ref=`+old+`">`) {
+		t.Fatalf("links do not keep the snapshot: %s", listing)
+	}
+	if body, _ := get("/raw/docs/a.txt?ref="+old, http.StatusOK); body != "alpha" {
+		t.Fatalf("snapshot file has contents %q", body)
+	}
+	if body, _ := get("/raw/docs/a.txt", http.StatusOK); body != "alpha 2" {
+		t.Fatalf("file has contents %q", body)
+	}
+	if body, _ := get("/docs/a.txt", http.StatusOK); body != "alpha 2" {
+		t.Fatal("file listing did not redirect to the file")
+	}
+
+	listing, _ = get("/?q=A.TXT", http.StatusOK)
+	if rowClass(t, listing, "docs/a.txt") != "" || strings.Contains(listing, "c.txt") {
+		t.Fatalf("bad search results: %s", listing)
+	}
+	listing, _ = get("/?q=*.txt&ref="+old, http.StatusOK)
+	for _, name := range []string{"docs/a.txt", "docs/b.txt", "&lt;b&gt;.txt"} {
+		rowClass(t, listing, name)
+	}
+	get("/?q=[", http.StatusBadRequest)
+
+	for _, format := range []string{"tar", "zip"} {
+		body, hdr := get("/archive/docs?format="+format+"&ref="+old, http.StatusOK)
+		if hdr.Get("Content-Disposition") != "attachment; filename=docs."+format {
+			t.Fatalf("bad content disposition: %s", hdr.Get("Content-Disposition"))
+		}
+		var names []string
+		if format == "tar" {
+			tr := tar.NewReader(strings.NewReader(body))
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, hdr.Name)
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, zf := range zr.File {
+				names = append(names, zf.Name)
+			}
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"a.txt", "b.txt"}) {
+			t.Fatalf("bad %s contents: %v", format, names)
+		}
+	}
+	get("/archive/docs/a.txt", http.StatusBadRequest)
+	get("/archive/docs?format=rar", http.StatusBadRequest)
+
+	get("/missing", http.StatusNotFound)
+	get("/raw/missing", http.StatusNotFound)
+	get("/?ref=zz", http.StatusBadRequest)
+	get("/?ref="+strings.Repeat("0", 64), http.StatusNotFound)
+}
+
+func TestAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		auth     Auth
+		user     string
+		password string
+		token    string
+		expected int
+	}{
+		{Auth{User: "bpy", Password: "secret"}, "bpy", "secret", "", http.StatusOK},
+		{Auth{User: "bpy", Password: "secret"}, "bpy", "wrong", "", http.StatusUnauthorized},
+		{Auth{User: "bpy", Password: "secret"}, "other", "secret", "", http.StatusUnauthorized},
+		{Auth{User: "bpy", Password: "secret"}, "", "", "secret", http.StatusUnauthorized},
+		{Auth{User: "bpy", Password: "secret"}, "", "", "", http.StatusUnauthorized},
+		{Auth{Token: "tok"}, "", "", "tok", http.StatusOK},
+		{Auth{Token: "tok"}, "", "", "wrong", http.StatusUnauthorized},
+		{Auth{User: "bpy", Token: "tok"}, "bpy", "", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		LogRequests(RequireAuth(ok, tc.auth)).ServeHTTP(w, r)
+		if w.Code != tc.expected {
+			t.Fatalf("%+v: expected %d, got %d", tc, tc.expected, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && tc.auth.Password != "" && w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%+v: missing WWW-Authenticate", tc)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewHandler(nil, Options{}).ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST was not refused, got %d", w.Code)
+	}
+}
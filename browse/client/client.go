@@ -0,0 +1,185 @@
+// Package client talks to the JSON API served by bpy browse.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/buppyio/bpy/browse"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Error is returned for requests the server answered with an error.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+// Client sends requests to the server at URL, authenticating with Token
+// if it is set, or else with User and Password if Password is set.
+type Client struct {
+	URL      string
+	Token    string
+	User     string
+	Password string
+	HTTP     *http.Client
+}
+
+func New(serverURL string) *Client {
+	return &Client{
+		URL:  strings.TrimSuffix(serverURL, "/"),
+		HTTP: http.DefaultClient,
+	}
+}
+
+func (c *Client) newRequest(method, endpoint, p string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := url.URL{Path: "/api/" + endpoint + p, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, c.URL+u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request, expected int) (*http.Response, error) {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == expected {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Error == "" {
+		apiErr.Error = strings.TrimSpace(string(data))
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+}
+
+func (c *Client) call(method, endpoint, p string, query url.Values, body io.Reader, expected int, result interface{}) error {
+	req, err := c.newRequest(method, endpoint, p, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, expected)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func refQuery(ref string) url.Values {
+	query := url.Values{}
+	if ref != "" {
+		query.Set("ref", ref)
+	}
+	return query
+}
+
+// Ls lists the directory at p, ref is the hash of the snapshot to read or
+// empty for the latest one.
+func (c *Client) Ls(p, ref string) ([]browse.Entry, error) {
+	var ents []browse.Entry
+	err := c.call("GET", "ls", p, refQuery(ref), nil, http.StatusOK, &ents)
+	return ents, err
+}
+
+func (c *Client) Stat(p, ref string) (browse.Entry, error) {
+	var ent browse.Entry
+	err := c.call("GET", "stat", p, refQuery(ref), nil, http.StatusOK, &ent)
+	return ent, err
+}
+
+// Open reads the file at p from offset off, reading to the end of the file
+// if length is negative.
+func (c *Client) Open(p, ref string, off, length int64) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", "raw", p, refQuery(ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	expected := http.StatusOK
+	if off != 0 || length >= 0 {
+		end := ""
+		if length >= 0 {
+			if length == 0 {
+				return ioutil.NopCloser(strings.NewReader("")), nil
+			}
+			end = strconv.FormatInt(off+length-1, 10)
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+end)
+		expected = http.StatusPartialContent
+	}
+	resp, err := c.do(req, expected)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// History lists at most limit snapshots starting with the latest one,
+// the server picks the limit if it is zero.
+func (c *Client) History(limit int) ([]browse.Ref, error) {
+	query := url.Values{}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var history []browse.Ref
+	err := c.call("GET", "history", "", query, nil, http.StatusOK, &history)
+	return history, err
+}
+
+// Diff lists the changes below p between the snapshots from and to. An
+// empty to is the latest snapshot, and an empty from the one before to.
+func (c *Client) Diff(from, to, p string) ([]browse.Change, error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+	if p != "" {
+		query.Set("path", p)
+	}
+	var changes []browse.Change
+	err := c.call("GET", "diff", "", query, nil, http.StatusOK, &changes)
+	return changes, err
+}
+
+// PutTar stores the contents of the tar stream as a new directory at p.
+func (c *Client) PutTar(p string, tar io.Reader) (browse.Entry, error) {
+	var ent browse.Entry
+	err := c.call("POST", "put", p, nil, tar, http.StatusCreated, &ent)
+	return ent, err
+}
+
+// StartGC starts a gc on the server, GCStatus reports when it is done.
+func (c *Client) StartGC() (browse.GCStatus, error) {
+	var status browse.GCStatus
+	err := c.call("POST", "gc", "", nil, nil, http.StatusAccepted, &status)
+	return status, err
+}
+
+func (c *Client) GCStatus() (browse.GCStatus, error) {
+	var status browse.GCStatus
+	err := c.call("GET", "gc", "", nil, nil, http.StatusOK, &status)
+	return status, err
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"github.com/buppyio/bpy/browse"
+	"github.com/buppyio/bpy/rootfs/rootfstest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func makeTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func expectStatus(t *testing.T, err error, status int) {
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != status {
+		t.Fatalf("expected a %d error, got %v", status, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	f, cleanup := rootfstest.New(t)
+	defer cleanup()
+	release := make(chan struct{})
+	srv := httptest.NewServer(browse.RequireAuth(browse.NewHandler(f, browse.Options{
+		Writable: true,
+		GC: func() error {
+			<-release
+			return errors.New("gc failed")
+		},
+	}), browse.Auth{Token: "secret"}))
+	defer srv.Close()
+
+	_, err := New(srv.URL).Ls("/", "")
+	expectStatus(t, err, http.StatusUnauthorized)
+	c := New(srv.URL)
+	c.Token = "secret"
+
+	ent, err := c.PutTar("/imports/one", makeTar(t, map[string]string{"a.txt": "hello", "sub/b.txt": "world"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ent.IsDir || ent.Path != "/imports/one" {
+		t.Fatalf("bad put result: %+v", ent)
+	}
+	_, err = c.PutTar("/imports/one", makeTar(t, nil))
+	expectStatus(t, err, http.StatusConflict)
+	_, err = c.PutTar("/imports/one/a.txt/x", makeTar(t, nil))
+	expectStatus(t, err, http.StatusConflict)
+
+	ents, err := c.Ls("/imports/one", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[0].Path != "/imports/one/a.txt" || ents[0].Size != 5 || !ents[1].IsDir {
+		t.Fatalf("bad listing: %+v", ents)
+	}
+	_, err = c.Ls("/imports/one/a.txt", "")
+	expectStatus(t, err, http.StatusBadRequest)
+	ent, err = c.Stat("/imports/one/sub/b.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Name != "b.txt" || ent.Size != 5 || ent.Mode != "-rw-r--r--" {
+		t.Fatalf("bad stat: %+v", ent)
+	}
+	_, err = c.Stat("/missing", "")
+	expectStatus(t, err, http.StatusNotFound)
+
+	for _, tc := range []struct {
+		off, length int64
+		expected    string
+	}{
+		{0, -1, "hello"},
+		{1, 3, "ell"},
+		{2, -1, "llo"},
+		{0, 0, ""},
+	} {
+		rdr, err := c.Open("/imports/one/a.txt", "", tc.off, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr.Close()
+		if string(data) != tc.expected {
+			t.Fatalf("read %q at %d, expected %q", data, tc.off, tc.expected)
+		}
+	}
+	_, err = c.Open("/imports/one", "", 0, -1)
+	expectStatus(t, err, http.StatusBadRequest)
+
+	_, err = c.PutTar("/imports/two", makeTar(t, map[string]string{"c.txt": "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := c.History(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Prev != history[1].Hash || history[2].Prev != "" {
+		t.Fatalf("bad history: %+v", history)
+	}
+	history, err = c.History(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 refs, got %d", len(history))
+	}
+	_, err = c.Stat("/imports/two", history[1].Hash)
+	expectStatus(t, err, http.StatusNotFound)
+
+	changes, err := c.Diff("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []browse.Change{{Path: "/imports/two", Change: "added", IsDir: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("bad diff: %+v", changes)
+	}
+	changes, err = c.Diff(history[0].Hash, history[1].Hash, "/imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []browse.Change{{Path: "/imports/two", Change: "removed", IsDir: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("bad reverse diff: %+v", changes)
+	}
+	_, err = c.Diff("zz", "", "")
+	expectStatus(t, err, http.StatusBadRequest)
+
+	status, err := c.StartGC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running {
+		t.Fatal("gc not running")
+	}
+	_, err = c.StartGC()
+	expectStatus(t, err, http.StatusConflict)
+	close(release)
+	for status.Running {
+		time.Sleep(10 * time.Millisecond)
+		status, err = c.GCStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.Error != "gc failed" || status.FinishedAt == 0 {
+		t.Fatalf("bad gc status: %+v", status)
+	}
+
+	readOnly := httptest.NewServer(browse.NewHandler(f, browse.Options{}))
+	defer readOnly.Close()
+	c = New(readOnly.URL)
+	_, err = c.PutTar("/imports/three", makeTar(t, nil))
+	expectStatus(t, err, http.StatusForbidden)
+	_, err = c.StartGC()
+	expectStatus(t, err, http.StatusForbidden)
+	if _, err = c.Stat("/imports/two", ""); err != nil {
+		t.Fatal(err)
+	}
+}
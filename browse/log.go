@@ -0,0 +1,47 @@
+package browse
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.size += int64(n)
+	return n, err
+}
+
+// LogRequests logs every request to h with its response status, size and
+// duration.
+func LogRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		user, _, _ := r.BasicAuth()
+		if user == "" {
+			user = "-"
+		}
+		log.Printf("%s %s %s %s %d %d %s", r.RemoteAddr, user, r.Method, r.URL.RequestURI(), sw.status, sw.size, time.Since(start))
+	})
+}
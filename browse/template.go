@@ -0,0 +1,84 @@
+package browse
+
+import (
+	"html/template"
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+<meta http-equiv="Content-Language" content="en" />
+<title>bpy - {{.Path}}</title>
+<style>
+body {
+	font-family: monospace;
+	color: #000;
+	background-color: #fff;
+}
+
+form {
+	display: inline;
+	margin-right: 1em;
+}
+
+table thead td {
+	font-weight: bold;
+}
+
+table td {
+	padding: 0 0.4em;
+}
+
+#content table td {
+	white-space: nowrap;
+	vertical-align: top;
+}
+
+#files tr:hover td {
+	background-color: #eee;
+}
+
+#files tr.added td {
+	background-color: #dfd;
+}
+
+#files tr.changed td {
+	background-color: #ffd;
+}
+
+#files tr.removed td {
+	background-color: #fdd;
+	text-decoration: line-through;
+}
+</style>
+</head>
+<body>
+<div id="nav">
+<p id="path">{{range $i, $c := .Crumbs}}{{if gt $i 1}}/{{end}}<a href="{{$c.Link}}">{{$c.Name}}</a>{{end}}</p>
+<p>
+<form method="get" action="{{.Path}}">
+<select name="ref">
+{{range $i, $s := .Snapshots}}<option value="{{$s.Hash}}"{{if $s.Selected}} selected{{end}}>{{$s.CreatedAt}}{{if eq $i 0}} (latest){{end}}</option>
+{{end}}</select>
+<input type="submit" value="view" />
+</form>
+<form method="get" action="{{.Path}}">
+{{if .Ref}}<input type="hidden" name="ref" value="{{.Ref}}" />
+{{end}}<input type="text" name="q" value="{{.Query}}" placeholder="search names" />
+<input type="submit" value="search" />
+</form>
+download as <a href="{{.TarLink}}">tar</a> <a href="{{.ZipLink}}">zip</a>
+</p>
+{{if .Query}}<p>names below {{.Path}} matching '{{.Query}}'{{if .Truncated}}, showing the first {{len .Entries}}{{end}}</p>
+{{else if .DiffSince}}<p>highlighting changes since {{.DiffSince}}</p>
+{{end}}</div>
+<div id="content">
+<table id="files">
+<thead><tr><td>Mode</td><td>Name</td><td>Size</td><td>Modified</td></tr></thead>
+{{range .Entries}}<tr{{if .Status}} class="{{.Status}}"{{end}}><td>{{.Mode}}</td><td><a href="{{.Link}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+</div>
+</body>
+</html>
+`))
@@ -5,9 +5,9 @@ import (
 	"github.com/buppyio/bpy/cmd/bpy/common"
 	"github.com/buppyio/bpy/cstore/cache"
 	"log"
-	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -58,7 +58,7 @@ func runForever(newCon, conOk, conClosed chan struct{}) {
 
 func CacheDaemon() {
 	dbArg := flag.String("db", "", "path to dbfile")
-	addrArg := flag.String("addr", common.DefaultCacheListenAddr, "address to listen on")
+	addrArg := flag.String("addr", "", "address to listen on, unix:PATH for a unix socket, defaults to BPY_CACHE_LISTEN_ADDR")
 	nohupArg := flag.Bool("nohup", false, "ignore HUP signals")
 	sizeArg := flag.Int64("size", 1024*1024*1024, "max size of cache in bytes")
 	idleTimeoutArg := flag.Int64("idle-timeout", -1, "close if no connections after this many seconds")
@@ -72,7 +72,16 @@ func CacheDaemon() {
 		log.Fatalf("please specify a db file")
 	}
 
-	c, err := cache.NewCache(*dbArg, 0755, uint64(*sizeArg))
+	cfg, err := common.GetConfig()
+	if err != nil {
+		log.Fatalf("error getting config: %s", err)
+	}
+	addr := *addrArg
+	if addr == "" {
+		addr = cfg.CacheListenAddr
+	}
+
+	c, err := cache.NewCache(*dbArg, 0600, uint64(*sizeArg))
 	if err != nil {
 		log.Fatalf("error creating: %s", err.Error())
 	}
@@ -82,8 +91,11 @@ func CacheDaemon() {
 		log.Fatalf("error creating cache server: %s", err.Error())
 	}
 
-	log.Printf("listening on %s", *addrArg)
-	l, err := net.Listen("tcp", *addrArg)
+	log.Printf("listening on %s", addr)
+	if !strings.HasPrefix(addr, "unix:") && cfg.CacheSecret == "" {
+		log.Printf("warning: listening on tcp without BPY_CACHE_SECRET, anyone who can connect to %s can read and write the cache", addr)
+	}
+	l, err := cache.Listen(addr)
 	if err != nil {
 		log.Fatalf("error listening: %s", err.Error())
 	}
@@ -110,8 +122,13 @@ func CacheDaemon() {
 		select {
 		case <-conOk:
 			go func() {
-				server.ServeConn(c)
-				log.Printf("%s disconnected", c.RemoteAddr())
+				err := cache.Accept(c, cfg.CacheSecret)
+				if err != nil {
+					log.Printf("rejecting %s: %s", c.RemoteAddr(), err.Error())
+				} else {
+					server.ServeConn(c)
+					log.Printf("%s disconnected", c.RemoteAddr())
+				}
 				c.Close()
 				conClosed <- struct{}{}
 			}()
@@ -13,13 +13,21 @@ import (
 
 func Cat() {
 	whenArg := flag.String("when", "", "time query")
+	metaArg := flag.Bool("meta", false, "print file metadata instead of contents")
+	jsonArg := flag.Bool("json", false, "with -meta, print metadata as json lines")
+	formatArg := flag.String("format", "", "with -meta, print metadata using a go template, e.g. '{{.Size}}'")
 
 	flag.Parse()
 
-	if len(flag.Args()) != 1 {
+	if len(flag.Args()) == 0 {
 		common.Die("please specify a path\n")
 	}
 
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
 	cfg, err := common.GetConfig()
 	if err != nil {
 		common.Die("error getting config: %s\n", err)
@@ -71,6 +79,18 @@ func Cat() {
 	}
 
 	for _, fpath := range flag.Args() {
+		if *metaArg {
+			ent, err := fs.Walk(store, ref.Root, fpath)
+			if err != nil {
+				common.Die("error getting %s: %s\n", fpath, err.Error())
+			}
+			info := common.NewEntInfo(fpath, ent)
+			err = printer.Print(info, info.LongFormat())
+			if err != nil {
+				common.Die("io error: %s\n", err.Error())
+			}
+			continue
+		}
 		rdr, err := fs.Open(store, ref.Root, fpath)
 		if err != nil {
 			common.Die("error opening %s: %s\n", fpath, err.Error())
@@ -79,6 +99,10 @@ func Cat() {
 		if err != nil {
 			common.Die("io error: %s\n", err.Error())
 		}
+		err = rdr.Close()
+		if err != nil {
+			common.Die("error closing %s: %s\n", fpath, err.Error())
+		}
 	}
 	err = store.Close()
 	if err != nil {
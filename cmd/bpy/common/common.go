@@ -7,11 +7,12 @@ import (
 	"github.com/buppyio/bpy/cstore"
 	"github.com/buppyio/bpy/cstore/cache"
 	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/ratelimit"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
 	"github.com/buppyio/bpy/remote/client"
 	"io"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -38,7 +39,9 @@ func (s *slave) Write(buf []byte) (int, error) {
 }
 
 func (s *slave) Close() error {
-	return s.cmd.Process.Kill()
+	err := s.cmd.Process.Kill()
+	s.cmd.Wait()
+	return err
 }
 
 func dialRemote(cmdstr string) (io.ReadWriteCloser, error) {
@@ -69,22 +72,22 @@ func dialRemote(cmdstr string) (io.ReadWriteCloser, error) {
 	}, nil
 }
 
+// GetCacheClient connects to the cache daemon, starting one in the
+// background if none is listening.
 func GetCacheClient(cfg *Config) (*cache.Client, error) {
-	conn, err := net.Dial("tcp", cfg.CacheListenAddr)
+	conn, err := cache.Dial(cfg.CacheListenAddr, cfg.CacheSecret)
 	if err != nil {
 		cmd := exec.Command(os.Args[0], "cache-daemon", "-addr", cfg.CacheListenAddr, "-nohup", "-idle-timeout=30", "-db", cfg.CacheFile)
 		cmd.Dir = cfg.BuppyPath
 		cmd.Start()
-		connected := false
 		for i := 0; i < 10; i++ {
-			conn, err = net.Dial("tcp", cfg.CacheListenAddr)
-			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
+			conn, err = cache.Dial(cfg.CacheListenAddr, cfg.CacheSecret)
+			if err == nil {
+				break
 			}
-			connected = true
+			time.Sleep(100 * time.Millisecond)
 		}
-		if !connected {
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -106,12 +109,28 @@ func GetKey(cfg *Config) (bpy.Key, error) {
 	return bpy.ReadKey(f)
 }
 
-func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
-	slv, err := dialRemote(cfg.RemoteCommand)
+func attachRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
+	dial := func() (client.ReadWriteCloser, error) {
+		return dialRemote(cfg.RemoteCommand)
+	}
+	if cfg.RemoteAddr != "" {
+		var err error
+		dial, err = remote.TLSDialer(cfg.RemoteAddr, k, cfg.RemoteFingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := client.Dial(dial, hex.EncodeToString(k.Id[:]))
 	if err != nil {
 		return nil, err
 	}
-	c, err := client.Attach(slv, hex.EncodeToString(k.Id[:]))
+	c.UploadLimit = ratelimit.NewLimiter(cfg.LimitUpload, cfg.LimitSchedule)
+	c.DownloadLimit = ratelimit.NewLimiter(cfg.LimitDownload, cfg.LimitSchedule)
+	return c, nil
+}
+
+func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
+	c, err := attachRemote(cfg, k)
 	if err != nil {
 		return nil, err
 	}
@@ -163,15 +182,34 @@ func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
 	return c, nil
 }
 
+// GetIndexCachePath returns the pack index cache directory for the key, creating it if needed.
+func GetIndexCachePath(cfg *Config, k *bpy.Key) (string, error) {
+	curIdxCache := filepath.Join(cfg.ICachePath, hex.EncodeToString(k.Id[:]))
+	err := os.MkdirAll(curIdxCache, IdxCachePermissions)
+	if err != nil {
+		return "", err
+	}
+	return curIdxCache, nil
+}
+
 func GetCStore(cfg *Config, k *bpy.Key, remote *client.Client) (bpy.CStore, error) {
+	return GetProgressCStore(cfg, k, remote, nil)
+}
+
+// GetProgressCStore returns a store that reports the chunks it writes to prog.
+func GetProgressCStore(cfg *Config, k *bpy.Key, remote *client.Client, prog *progress.Progress) (bpy.CStore, error) {
 	var store bpy.CStore
 
-	curIdxCache := filepath.Join(cfg.ICachePath, hex.EncodeToString(k.Id[:]))
-	err := os.MkdirAll(curIdxCache, IdxCachePermissions)
+	curIdxCache, err := GetIndexCachePath(cfg, k)
 	if err != nil {
 		return nil, err
 	}
-	store, err = cstore.NewWriter(remote, k.CipherKey, curIdxCache)
+	opts := cstore.ReaderOptions{
+		PackReaders: cfg.PackReaders,
+		ReadAhead:   int(cfg.ReadAhead),
+		CoalesceGap: cstore.DefaultReaderOptions.CoalesceGap,
+	}
+	store, err = cstore.NewWriter(remote, k.CipherKey, curIdxCache, opts, prog)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,11 @@
 package common
 
 import (
+	"flag"
 	"fmt"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/ratelimit"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -9,23 +13,45 @@ import (
 )
 
 const (
-	DefaultCacheListenAddr = "127.0.0.1:8877"
+	DefaultCacheSocketName = "cache.sock"
 )
 
+var limitUploadArg, limitDownloadArg, limitScheduleArg *string
+
+// AddLimitFlags registers the bandwidth limit flags, for the commands
+// that talk to the remote.
+func AddLimitFlags() {
+	limitUploadArg = flag.String("limit-upload", "", "limit remote uploads to this many bytes per second, e.g. 512K or 2M")
+	limitDownloadArg = flag.String("limit-download", "", "limit remote downloads to this many bytes per second, e.g. 512K or 2M")
+	limitScheduleArg = flag.String("limit-schedule", "", "only apply bandwidth limits during these local times, e.g. 08:00-18:00")
+}
+
 type Config struct {
-	BuppyPath       string
-	RemoteCommand   string
-	ICachePath      string
-	CacheFile       string
-	CacheSize       int64
-	CacheListenAddr string
-	KeyPath         string
+	BuppyPath         string
+	RemoteCommand     string
+	RemoteAddr        string
+	RemoteFingerprint string
+	ICachePath        string
+	CacheFile         string
+	CacheSize         int64
+	CacheListenAddr   string
+	CacheSecret       string
+	KeyPath           string
+	LimitUpload       int64
+	LimitDownload     int64
+	LimitSchedule     ratelimit.Schedule
+	PackReaders       int
+	ReadAhead         int64
 }
 
 func GetConfig() (*Config, error) {
 	cfg := &Config{}
 
-	err := setEnvConfigValues(cfg)
+	err := setFlagConfigValues(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = setEnvConfigValues(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +62,26 @@ func GetConfig() (*Config, error) {
 	return cfg, nil
 }
 
+func setFlagConfigValues(cfg *Config) error {
+	if limitUploadArg == nil {
+		return nil
+	}
+	var err error
+	cfg.LimitUpload, err = ratelimit.ParseRate(*limitUploadArg)
+	if err != nil {
+		return fmt.Errorf("error parsing -limit-upload (%s): %s", *limitUploadArg, err)
+	}
+	cfg.LimitDownload, err = ratelimit.ParseRate(*limitDownloadArg)
+	if err != nil {
+		return fmt.Errorf("error parsing -limit-download (%s): %s", *limitDownloadArg, err)
+	}
+	cfg.LimitSchedule, err = ratelimit.ParseSchedule(*limitScheduleArg)
+	if err != nil {
+		return fmt.Errorf("error parsing -limit-schedule (%s): %s", *limitScheduleArg, err)
+	}
+	return nil
+}
+
 func setEnvConfigValues(cfg *Config) error {
 	if cfg.BuppyPath == "" {
 		cfg.BuppyPath = os.Getenv("BPY_PATH")
@@ -43,6 +89,12 @@ func setEnvConfigValues(cfg *Config) error {
 	if cfg.RemoteCommand == "" {
 		cfg.RemoteCommand = os.Getenv("BPY_REMOTE_CMD")
 	}
+	if cfg.RemoteAddr == "" {
+		cfg.RemoteAddr = os.Getenv("BPY_REMOTE_ADDR")
+	}
+	if cfg.RemoteFingerprint == "" {
+		cfg.RemoteFingerprint = os.Getenv("BPY_REMOTE_FINGERPRINT")
+	}
 	if cfg.ICachePath == "" {
 		cfg.ICachePath = os.Getenv("BPY_ICACHE_PATH")
 	}
@@ -52,6 +104,9 @@ func setEnvConfigValues(cfg *Config) error {
 	if cfg.CacheListenAddr == "" {
 		cfg.CacheListenAddr = os.Getenv("BPY_CACHE_LISTEN_ADDR")
 	}
+	if cfg.CacheSecret == "" {
+		cfg.CacheSecret = os.Getenv("BPY_CACHE_SECRET")
+	}
 	if cfg.CacheSize == 0 {
 		szStr := os.Getenv("BPY_CACHE_SIZE")
 		if szStr != "" {
@@ -65,6 +120,50 @@ func setEnvConfigValues(cfg *Config) error {
 	if cfg.KeyPath == "" {
 		cfg.CacheFile = os.Getenv("BPY_KEY_PATH")
 	}
+	if cfg.LimitUpload == 0 {
+		limitStr := os.Getenv("BPY_LIMIT_UPLOAD")
+		v, err := ratelimit.ParseRate(limitStr)
+		if err != nil {
+			return fmt.Errorf("error parsing BPY_LIMIT_UPLOAD (%s): %s", limitStr, err)
+		}
+		cfg.LimitUpload = v
+	}
+	if cfg.LimitDownload == 0 {
+		limitStr := os.Getenv("BPY_LIMIT_DOWNLOAD")
+		v, err := ratelimit.ParseRate(limitStr)
+		if err != nil {
+			return fmt.Errorf("error parsing BPY_LIMIT_DOWNLOAD (%s): %s", limitStr, err)
+		}
+		cfg.LimitDownload = v
+	}
+	if len(cfg.LimitSchedule) == 0 {
+		schedStr := os.Getenv("BPY_LIMIT_SCHEDULE")
+		v, err := ratelimit.ParseSchedule(schedStr)
+		if err != nil {
+			return fmt.Errorf("error parsing BPY_LIMIT_SCHEDULE (%s): %s", schedStr, err)
+		}
+		cfg.LimitSchedule = v
+	}
+	if cfg.PackReaders == 0 {
+		nStr := os.Getenv("BPY_PACK_READERS")
+		if nStr != "" {
+			v, err := strconv.Atoi(nStr)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_PACK_READERS (%s): %s", nStr, err)
+			}
+			cfg.PackReaders = v
+		}
+	}
+	if cfg.ReadAhead == 0 {
+		szStr := os.Getenv("BPY_READ_AHEAD")
+		if szStr != "" {
+			v, err := progress.ParseBytes(szStr)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_READ_AHEAD (%s): %s", szStr, err)
+			}
+			cfg.ReadAhead = v
+		}
+	}
 	return nil
 }
 
@@ -89,7 +188,13 @@ func setDefaultConfigValues(cfg *Config) error {
 		cfg.KeyPath = filepath.Join(cfg.BuppyPath, "bpy.key")
 	}
 	if cfg.CacheListenAddr == "" {
-		cfg.CacheListenAddr = DefaultCacheListenAddr
+		cfg.CacheListenAddr = "unix:" + filepath.Join(cfg.BuppyPath, DefaultCacheSocketName)
+	}
+	if cfg.PackReaders == 0 {
+		cfg.PackReaders = cstore.DefaultReaderOptions.PackReaders
+	}
+	if cfg.ReadAhead == 0 {
+		cfg.ReadAhead = int64(cstore.DefaultReaderOptions.ReadAhead)
 	}
 	return nil
 }
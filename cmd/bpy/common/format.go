@@ -0,0 +1,110 @@
+package common
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"io"
+	"text/template"
+	"time"
+)
+
+type EntInfo struct {
+	Path       string `json:"path"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Mode       string `json:"mode"`
+	MTime      int64  `json:"mtime"`
+	HTreeDepth int    `json:"htree_depth"`
+	HTreeHash  string `json:"htree_hash"`
+}
+
+func NewEntInfo(entPath string, ent fs.DirEnt) EntInfo {
+	return EntInfo{
+		Path:       entPath,
+		Name:       ent.EntName,
+		Size:       ent.EntSize,
+		Mode:       ent.EntMode.String(),
+		MTime:      ent.EntModTime,
+		HTreeDepth: ent.HTree.Depth,
+		HTreeHash:  hex.EncodeToString(ent.HTree.Data[:]),
+	}
+}
+
+// LongFormat renders an entry like 'ls -l'.
+func (info EntInfo) LongFormat() string {
+	suffix := ""
+	if info.Mode[0] == 'd' {
+		suffix = "/"
+	}
+	return fmt.Sprintf("%s %12d %s %s%s", info.Mode, info.Size, time.Unix(info.MTime, 0).Format("2006-01-02 15:04"), info.Path, suffix)
+}
+
+type RefInfo struct {
+	Hash      string `json:"hash"`
+	CreatedAt int64  `json:"created_at"`
+	Root      string `json:"root"`
+	Prev      string `json:"prev,omitempty"`
+}
+
+func NewRefInfo(hash [32]byte, ref refs.Ref) RefInfo {
+	info := RefInfo{
+		Hash:      hex.EncodeToString(hash[:]),
+		CreatedAt: ref.CreatedAt,
+		Root:      hex.EncodeToString(ref.Root[:]),
+	}
+	if ref.HasPrev {
+		info.Prev = hex.EncodeToString(ref.Prev[:])
+	}
+	return info
+}
+
+// Printer writes values as JSON lines, or through a text/template,
+// falling back to a plain text rendering chosen by the command.
+type Printer struct {
+	out  io.Writer
+	json bool
+	tmpl *template.Template
+}
+
+func NewPrinter(out io.Writer, jsonOut bool, format string) (*Printer, error) {
+	p := &Printer{
+		out:  out,
+		json: jsonOut,
+	}
+	if format != "" {
+		if jsonOut {
+			return nil, fmt.Errorf("-json and -format cannot be used together")
+		}
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing format: %s", err.Error())
+		}
+		p.tmpl = tmpl
+	}
+	return p, nil
+}
+
+func (p *Printer) Print(v interface{}, plain string) error {
+	switch {
+	case p.json:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = p.out.Write(append(buf, '\n'))
+		return err
+	case p.tmpl != nil:
+		err := p.tmpl.Execute(p.out, v)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(p.out, "\n")
+		return err
+	default:
+		_, err := fmt.Fprintln(p.out, plain)
+		return err
+	}
+}
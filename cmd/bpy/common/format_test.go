@@ -0,0 +1,76 @@
+package common
+
+import (
+	"bytes"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPrinter(t *testing.T) {
+	mtime := time.Date(2016, 1, 2, 3, 4, 0, 0, time.Local)
+	ent := fs.DirEnt{
+		EntName:    "a.txt",
+		EntSize:    5,
+		EntMode:    0644,
+		EntModTime: mtime.Unix(),
+		HTree:      htree.HTree{Depth: 1, Data: [32]byte{0xab}},
+	}
+	info := NewEntInfo("/dir/a.txt", ent)
+	ref := refs.Ref{CreatedAt: 10, Root: [32]byte{1}}
+
+	for _, tc := range []struct {
+		json     bool
+		format   string
+		v        interface{}
+		plain    string
+		expected string
+	}{
+		{false, "", info, info.LongFormat(), "-rw-r--r--            5 2016-01-02 03:04 /dir/a.txt\n"},
+		{false, "{{.Name}} {{.Size}} {{.HTreeDepth}}", info, "", "a.txt 5 1\n"},
+		{true, "", info, "", `{"path":"/dir/a.txt","name":"a.txt","size":5,"mode":"-rw-r--r--","mtime":` +
+			strconv.FormatInt(mtime.Unix(), 10) + `,"htree_depth":1,"htree_hash":"ab00000000000000000000000000000000000000000000000000000000000000"}` + "\n"},
+		{true, "", NewRefInfo([32]byte{2}, ref), "", `{"hash":"0200000000000000000000000000000000000000000000000000000000000000",` +
+			`"created_at":10,"root":"0100000000000000000000000000000000000000000000000000000000000000"}` + "\n"},
+		{false, "{{.Prev}}", NewRefInfo([32]byte{2}, refs.Ref{HasPrev: true, Prev: [32]byte{3}}), "",
+			"0300000000000000000000000000000000000000000000000000000000000000\n"},
+	} {
+		var out bytes.Buffer
+		p, err := NewPrinter(&out, tc.json, tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Print(tc.v, tc.plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.expected {
+			t.Fatalf("printed %q, expected %q", out.String(), tc.expected)
+		}
+	}
+
+	dirInfo := NewEntInfo("/dir", fs.DirEnt{EntName: "dir", EntMode: os.ModeDir | 0755, EntModTime: mtime.Unix()})
+	if dirInfo.LongFormat() != "drwxr-xr-x            0 2016-01-02 03:04 /dir/" {
+		t.Fatalf("bad long format %q", dirInfo.LongFormat())
+	}
+
+	_, err := NewPrinter(&bytes.Buffer{}, true, "{{.Name}}")
+	if err == nil {
+		t.Fatal("expected -json and -format to conflict")
+	}
+	_, err = NewPrinter(&bytes.Buffer{}, false, "{{.Name")
+	if err == nil {
+		t.Fatal("expected a template parse error")
+	}
+	p, err := NewPrinter(&bytes.Buffer{}, false, "{{.Missing}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Print(info, "") == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
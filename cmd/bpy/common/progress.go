@@ -0,0 +1,31 @@
+package common
+
+import (
+	"github.com/buppyio/bpy/progress"
+	"os"
+	"time"
+)
+
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// StartProgress reports progress of op on stderr, as JSON events if jsonEvents
+// is set, otherwise as a live line when stderr is a terminal. Call Finish on
+// the result to print the summary.
+func StartProgress(op string, jsonEvents bool) *progress.Progress {
+	prog := progress.New(op)
+	switch {
+	case jsonEvents:
+		prog.Report(os.Stderr, progress.JSON, time.Second)
+	case isTerminal(os.Stderr):
+		prog.Report(os.Stderr, progress.Live, 250*time.Millisecond)
+	default:
+		prog.Report(os.Stderr, progress.Summary, time.Second)
+	}
+	return prog
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/when"
+	"path"
+)
+
+// GetRefAt returns the version of ref at the time spec whenArg,
+// or ref itself if whenArg is empty.
+func GetRefAt(store bpy.CStore, ref refs.Ref, whenArg string) (refs.Ref, error) {
+	_, ref, err := GetRefHashAt(store, [32]byte{}, ref, whenArg)
+	return ref, err
+}
+
+// GetRefHashAt is GetRefAt for the ref stored at hash, also returning the
+// hash of the version it finds.
+func GetRefHashAt(store bpy.CStore, hash [32]byte, ref refs.Ref, whenArg string) ([32]byte, refs.Ref, error) {
+	if whenArg == "" {
+		return hash, ref, nil
+	}
+	refTime, err := when.Parse(whenArg)
+	if err != nil {
+		return [32]byte{}, refs.Ref{}, fmt.Errorf("error parsing 'when' arg: %s", err.Error())
+	}
+	hashPast, refPast, ok, err := refs.GetHashAtTime(store, hash, ref, refTime)
+	if err != nil {
+		return [32]byte{}, refs.Ref{}, fmt.Errorf("error looking at ref history: %s", err.Error())
+	}
+	if !ok {
+		return [32]byte{}, refs.Ref{}, fmt.Errorf("ref did not exist at %s", refTime.String())
+	}
+	return hashPast, refPast, nil
+}
+
+// InsertAt returns root with ent added at destPath, creating missing parent
+// folders. An existing file at destPath is replaced if replace is set, it
+// stays in the history.
+func InsertAt(store bpy.CStore, root [32]byte, destPath string, ent fs.DirEnt, replace bool) (fs.DirEnt, error) {
+	destPath = path.Clean("/" + destPath)
+	if destPath == "/" {
+		return fs.DirEnt{}, errors.New("cannot replace the root")
+	}
+	for dir := path.Dir(destPath); dir != "/"; dir = path.Dir(dir) {
+		parent, ok, err := fs.Lookup(store, root, dir)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok && !parent.IsDir() {
+			return fs.DirEnt{}, fmt.Errorf("'%s' is not a directory", dir)
+		}
+	}
+	existing, ok, err := fs.Lookup(store, root, destPath)
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	if ok {
+		if !replace {
+			return fs.DirEnt{}, fmt.Errorf("'%s' already exists", destPath)
+		}
+		if existing.IsDir() {
+			return fs.DirEnt{}, fmt.Errorf("'%s' is a directory", destPath)
+		}
+		newRoot, err := fs.Remove(store, root, destPath)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		root = newRoot.HTree.Data
+	}
+	newRoot, err := fs.MkdirAll(store, root, path.Dir(destPath), 0755)
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	return fs.Insert(store, newRoot.HTree.Data, destPath, ent)
+}
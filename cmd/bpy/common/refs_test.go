@@ -0,0 +1,56 @@
+package common
+
+import (
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/testhelp"
+	"os"
+	"testing"
+)
+
+func TestInsertAt(t *testing.T) {
+	store := testhelp.NewMemStore()
+	root, err := fs.EmptyDir(store, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.EmptyDir(store, os.ModeDir|0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = InsertAt(store, root.HTree.Data, "a/b/c", dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, mode := range map[string]string{"/a": "drwxr-xr-x", "/a/b": "drwxr-xr-x", "/a/b/c": "drwx------"} {
+		ent, ok, err := fs.Lookup(store, root.HTree.Data, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || ent.EntMode.String() != mode {
+			t.Fatalf("%s missing or has mode %s", p, ent.EntMode)
+		}
+	}
+
+	file := fs.DirEnt{EntMode: 0644}
+	root, err = InsertAt(store, root.HTree.Data, "/a/f", file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path    string
+		replace bool
+		err     string
+	}{
+		{"/a/b/c", false, "'/a/b/c' already exists"},
+		{"/a/b/c", true, "'/a/b/c' is a directory"},
+		{"/a/f", false, "'/a/f' already exists"},
+		{"/a/f/g", true, "'/a/f' is not a directory"},
+		{"/a/f/g/h", true, "'/a/f' is not a directory"},
+		{"/", true, "cannot replace the root"},
+	} {
+		_, err = InsertAt(store, root.HTree.Data, tc.path, file, tc.replace)
+		if err == nil || err.Error() != tc.err {
+			t.Fatalf("inserting %s: expected %q, got %v", tc.path, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package du
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"os"
+	"path"
+	"time"
+)
+
+type duInfo struct {
+	Path        string `json:"path"`
+	Ref         string `json:"ref"`
+	CreatedAt   int64  `json:"created_at"`
+	Files       int64  `json:"files"`
+	Logical     int64  `json:"logical"`
+	Stored      int64  `json:"stored"`
+	Chunks      int64  `json:"chunks"`
+	Incremental int64  `json:"incremental"`
+}
+
+type dirUsage struct {
+	files int64
+	bytes int64
+}
+
+// chunkSet counts the stored size of each chunk once.
+type chunkSet struct {
+	seen   map[[32]byte]struct{}
+	chunks int64
+	stored int64
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{seen: make(map[[32]byte]struct{})}
+}
+
+type sizer struct {
+	store bpy.CStore
+	sizes map[[32]byte]uint32
+	dirs  map[[32]byte]dirUsage
+}
+
+func (s *sizer) add(set *chunkSet, hash [32]byte) bool {
+	_, ok := set.seen[hash]
+	if ok {
+		return false
+	}
+	set.seen[hash] = struct{}{}
+	set.chunks += 1
+	set.stored += int64(s.sizes[hash])
+	return true
+}
+
+func (s *sizer) markNode(set *chunkSet, hash [32]byte) error {
+	if !s.add(set, hash) {
+		return nil
+	}
+	data, err := s.store.Get(hash)
+	if err != nil {
+		return err
+	}
+	if data[0] == 0 {
+		return nil
+	}
+	for i := 1; i < len(data); i += 40 {
+		var child [32]byte
+		copy(child[:], data[i+8:i+40])
+		if data[0] == 1 {
+			s.add(set, child)
+			continue
+		}
+		err = s.markNode(set, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sizer) markTree(set *chunkSet, tree htree.HTree) error {
+	if tree.Depth == 0 {
+		s.add(set, tree.Data)
+		return nil
+	}
+	return s.markNode(set, tree.Data)
+}
+
+func (s *sizer) markDir(set *chunkSet, tree htree.HTree) error {
+	_, ok := set.seen[tree.Data]
+	if ok {
+		// Everything below a directory is marked along with it.
+		return nil
+	}
+	err := s.markTree(set, tree)
+	if err != nil {
+		return err
+	}
+	ents, err := fs.ReadDir(s.store, tree.Data)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents[1:] {
+		if ent.IsDir() {
+			err = s.markDir(set, ent.HTree)
+		} else {
+			err = s.markTree(set, ent.HTree)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sizer) logical(hash [32]byte) (dirUsage, error) {
+	usage, ok := s.dirs[hash]
+	if ok {
+		return usage, nil
+	}
+	ents, err := fs.ReadDir(s.store, hash)
+	if err != nil {
+		return usage, err
+	}
+	for _, ent := range ents[1:] {
+		if ent.IsDir() {
+			sub, err := s.logical(ent.HTree.Data)
+			if err != nil {
+				return usage, err
+			}
+			usage.files += sub.files
+			usage.bytes += sub.bytes
+			continue
+		}
+		usage.files += 1
+		usage.bytes += ent.EntSize
+	}
+	s.dirs[hash] = usage
+	return usage, nil
+}
+
+var errNoPath = errors.New("no such file or directory")
+
+// usage fills in the logical size of duPath in ref and marks its chunks in set.
+func (s *sizer) usage(set *chunkSet, refHash [32]byte, ref refs.Ref, duPath string) (duInfo, error) {
+	info := duInfo{
+		Path:      duPath,
+		Ref:       hex.EncodeToString(refHash[:]),
+		CreatedAt: ref.CreatedAt,
+	}
+	ent, ok, err := fs.Lookup(s.store, ref.Root, duPath)
+	if err != nil {
+		return info, err
+	}
+	if !ok {
+		return info, errNoPath
+	}
+	if ent.IsDir() {
+		usage, err := s.logical(ent.HTree.Data)
+		if err != nil {
+			return info, err
+		}
+		info.Files = usage.files
+		info.Logical = usage.bytes
+		err = s.markDir(set, ent.HTree)
+		if err != nil {
+			return info, err
+		}
+	} else {
+		info.Files = 1
+		info.Logical = ent.EntSize
+		err = s.markTree(set, ent.HTree)
+		if err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// refUsage returns the usage of duPath in ref and the chunks it uses, the
+// ref itself is counted when duPath is the whole drive.
+func (s *sizer) refUsage(refHash [32]byte, ref refs.Ref, duPath string) (duInfo, *chunkSet, error) {
+	set := newChunkSet()
+	if path.Clean("/"+duPath) == "/" {
+		err := s.markNode(set, refHash)
+		if err != nil {
+			return duInfo{}, set, err
+		}
+	}
+	info, err := s.usage(set, refHash, ref, duPath)
+	info.Stored = set.stored
+	info.Chunks = set.chunks
+	info.Incremental = set.stored
+	return info, set, err
+}
+
+// incremental is the stored size of the chunks in set that prev lacks.
+func (s *sizer) incremental(set, prev *chunkSet) int64 {
+	size := int64(0)
+	for hash := range set.seen {
+		_, ok := prev.seen[hash]
+		if !ok {
+			size += int64(s.sizes[hash])
+		}
+	}
+	return size
+}
+
+// history returns the usage of duPath in each ref, newest first, charging
+// each version for the chunks the version before it lacks. Versions
+// without duPath are reported as empty. all holds the chunks of every
+// version.
+func (s *sizer) history(hashes [][32]byte, history []refs.Ref, duPath string) ([]duInfo, *chunkSet, error) {
+	all := newChunkSet()
+	prev := newChunkSet()
+	infos := make([]duInfo, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		info, set, err := s.refUsage(hashes[i], history[i], duPath)
+		if err != nil && err != errNoPath {
+			return nil, nil, err
+		}
+		info.Incremental = s.incremental(set, prev)
+		for hash := range set.seen {
+			s.add(all, hash)
+		}
+		infos[i] = info
+		prev = set
+	}
+	return infos, all, nil
+}
+
+func Du() {
+	whenArg := flag.String("when", "", "time query")
+	historyArg := flag.Bool("history", false, "show the incremental stored size of each version in the history")
+	jsonArg := flag.Bool("json", false, "print usage as json lines")
+	formatArg := flag.String("format", "", "print usage using a go template, e.g. '{{.Logical}} {{.Stored}}'")
+	flag.Parse()
+
+	duPath := "/"
+	if len(flag.Args()) > 1 {
+		common.Die("please specify a single path\n")
+	} else if len(flag.Args()) == 1 {
+		duPath = flag.Args()[0]
+	}
+
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	idxCache, err := common.GetIndexCachePath(cfg, &k)
+	if err != nil {
+		common.Die("error getting index cache: %s\n", err.Error())
+	}
+
+	indexes, err := cstore.ReadPackIndexes(c, k.CipherKey, idxCache)
+	if err != nil {
+		common.Die("error reading pack indexes: %s\n", err.Error())
+	}
+
+	s := &sizer{
+		store: store,
+		sizes: make(map[[32]byte]uint32),
+		dirs:  make(map[[32]byte]dirUsage),
+	}
+	for _, pack := range indexes {
+		for _, ent := range pack.Idx {
+			var hash [32]byte
+			copy(hash[:], ent.Key)
+			s.sizes[hash] = ent.Size
+		}
+	}
+
+	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root missing\n")
+	}
+
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		common.Die("error fetching ref: %s\n", err.Error())
+	}
+
+	if !*historyArg {
+		refHash, ref, err := common.GetRefHashAt(store, rootHash, ref, *whenArg)
+		if err != nil {
+			common.Die("%s\n", err.Error())
+		}
+		info, set, err := s.refUsage(refHash, ref, duPath)
+		if err != nil {
+			common.Die("error getting usage of %s: %s\n", duPath, err.Error())
+		}
+		if ref.HasPrev {
+			prevRef, err := refs.GetRef(store, ref.Prev)
+			if err != nil {
+				common.Die("error fetching ref: %s\n", err.Error())
+			}
+			_, prevSet, err := s.refUsage(ref.Prev, prevRef, duPath)
+			if err != nil && err != errNoPath {
+				common.Die("error getting usage of %s: %s\n", duPath, err.Error())
+			}
+			info.Incremental = s.incremental(set, prevSet)
+		}
+		plain := fmt.Sprintf("files: %d\nlogical: %s\nstored: %s\nchunks: %d\nincremental: %s",
+			info.Files, progress.FormatBytes(info.Logical), progress.FormatBytes(info.Stored), info.Chunks,
+			progress.FormatBytes(info.Incremental))
+		err = printer.Print(info, plain)
+		if err != nil {
+			common.Die("io error: %s\n", err.Error())
+		}
+	} else {
+		hashes := [][32]byte{rootHash}
+		history := []refs.Ref{ref}
+		for ref.HasPrev {
+			hashes = append(hashes, ref.Prev)
+			ref, err = refs.GetRef(store, ref.Prev)
+			if err != nil {
+				common.Die("error fetching ref: %s\n", err.Error())
+			}
+			history = append(history, ref)
+		}
+
+		infos, all, err := s.history(hashes, history, duPath)
+		if err != nil {
+			common.Die("error getting usage of %s: %s\n", duPath, err.Error())
+		}
+		for _, info := range infos {
+			plain := fmt.Sprintf("%s@%s logical=%s stored=%s incremental=%s", info.Ref, time.Unix(info.CreatedAt, 0),
+				progress.FormatBytes(info.Logical), progress.FormatBytes(info.Stored), progress.FormatBytes(info.Incremental))
+			err = printer.Print(info, plain)
+			if err != nil {
+				common.Die("io error: %s\n", err.Error())
+			}
+		}
+		total := fmt.Sprintf("total stored: %s in %d chunks", progress.FormatBytes(all.stored), all.chunks)
+		if !*jsonArg && *formatArg == "" {
+			fmt.Println(total)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,131 @@
+package du
+
+import (
+	"encoding/hex"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/testhelp"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sizingStore records the size of each chunk like a pack index would.
+type sizingStore struct {
+	bpy.CStore
+	sizes map[[32]byte]uint32
+}
+
+func (s *sizingStore) Put(val []byte) ([32]byte, error) {
+	hash, err := s.CStore.Put(val)
+	s.sizes[hash] = uint32(len(val))
+	return hash, err
+}
+
+func writeFile(t *testing.T, store bpy.CStore, name, contents string) fs.DirEnt {
+	w := htree.NewWriter(store)
+	_, err := w.Write([]byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.DirEnt{EntName: name, EntSize: int64(len(contents)), EntMode: 0644, HTree: tree}
+}
+
+func TestHistory(t *testing.T) {
+	store := &sizingStore{CStore: testhelp.NewMemStore(), sizes: make(map[[32]byte]uint32)}
+	s := &sizer{
+		store: store,
+		sizes: store.sizes,
+		dirs:  make(map[[32]byte]dirUsage),
+	}
+
+	a := writeFile(t, store, "a.txt", strings.Repeat("a", 1000))
+	b := writeFile(t, store, "b.txt", strings.Repeat("b", 2000))
+	c := writeFile(t, store, "c.txt", strings.Repeat("c", 3000))
+	d, err := fs.WriteDir(store, fs.DirEnts{a}, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.EntName = "d"
+	root1, err := fs.WriteDir(store, fs.DirEnts{b, d}, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root2, err := fs.Insert(store, root1.HTree.Data, "/", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root3, err := fs.Remove(store, root2.HTree.Data, "/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes [][32]byte
+	var history []refs.Ref
+	for i, root := range []fs.DirEnt{root1, root2, root3} {
+		ref := refs.Ref{CreatedAt: int64(i), Root: root.HTree.Data}
+		if i != 0 {
+			ref.HasPrev = true
+			ref.Prev = hashes[0]
+		}
+		hash, err := refs.PutRef(store, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append([][32]byte{hash}, hashes...)
+		history = append([]refs.Ref{ref}, history...)
+	}
+
+	infos, all, err := s.history(hashes, history, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, info := range infos {
+		if info.Ref != hex.EncodeToString(hashes[i][:]) {
+			t.Fatalf("version %d has ref %s", i, info.Ref)
+		}
+	}
+	v3, v2, v1 := infos[0], infos[1], infos[2]
+	if v1.Files != 2 || v1.Logical != 3000 || v2.Files != 3 || v2.Logical != 6000 || v3.Files != 2 || v3.Logical != 4000 {
+		t.Fatalf("bad logical sizes %+v", infos)
+	}
+	if v1.Incremental != v1.Stored {
+		t.Fatalf("first version has incremental %d and stored %d", v1.Incremental, v1.Stored)
+	}
+	expected := int64(store.sizes[c.HTree.Data] + store.sizes[root2.HTree.Data] + store.sizes[hashes[1]])
+	if v2.Incremental != expected {
+		t.Fatalf("second version has incremental %d, expected %d", v2.Incremental, expected)
+	}
+	if v3.Stored >= v2.Stored {
+		t.Fatalf("removing a file did not shrink stored size, %d >= %d", v3.Stored, v2.Stored)
+	}
+	if v3.Stored != v2.Stored-int64(store.sizes[b.HTree.Data]+store.sizes[root2.HTree.Data]+store.sizes[hashes[1]])+int64(store.sizes[root3.HTree.Data]+store.sizes[hashes[0]]) {
+		t.Fatalf("third version is not sized on its own, stored %d", v3.Stored)
+	}
+	// Nothing comes back after being dropped, so each chunk is charged once.
+	if all.stored != v1.Incremental+v2.Incremental+v3.Incremental {
+		t.Fatalf("total stored %d is not the sum of the incremental sizes %+v", all.stored, infos)
+	}
+
+	infos, _, err = s.history(hashes, history, "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos[2].Incremental != infos[2].Stored || infos[1].Incremental != 0 || infos[0].Incremental != 0 {
+		t.Fatalf("unchanged directory has incremental usage %+v", infos)
+	}
+
+	infos, _, err = s.history(hashes, history, "/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos[2].Stored != 0 || infos[1].Incremental != int64(store.sizes[c.HTree.Data]) || infos[0].Incremental != 0 {
+		t.Fatalf("bad usage of added file %+v", infos)
+	}
+}
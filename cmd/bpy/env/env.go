@@ -20,6 +20,14 @@ func Env() {
 	if err != nil {
 		common.Die(errMsg, err)
 	}
+	_, err = fmt.Printf("BPY_REMOTE_ADDR=%s\n", cfg.RemoteAddr)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_REMOTE_FINGERPRINT=%s\n", cfg.RemoteFingerprint)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
 	_, err = fmt.Printf("BPY_PATH=%s\n", cfg.BuppyPath)
 	if err != nil {
 		common.Die(errMsg, err)
@@ -40,4 +48,24 @@ func Env() {
 	if err != nil {
 		common.Die(errMsg, err)
 	}
+	_, err = fmt.Printf("BPY_LIMIT_UPLOAD=%d\n", cfg.LimitUpload)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_LIMIT_DOWNLOAD=%d\n", cfg.LimitDownload)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_LIMIT_SCHEDULE=%s\n", cfg.LimitSchedule)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_PACK_READERS=%d\n", cfg.PackReaders)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_READ_AHEAD=%d\n", cfg.ReadAhead)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
 }
@@ -0,0 +1,207 @@
+package find
+
+import (
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/when"
+	"path"
+	"strings"
+	"time"
+)
+
+type seenKey struct {
+	path string
+	hash [32]byte
+}
+
+type sizeFilter struct {
+	cmp  int
+	size int64
+}
+
+func parseSize(s string) (sizeFilter, error) {
+	f := sizeFilter{}
+	switch {
+	case strings.HasPrefix(s, "+"):
+		f.cmp = 1
+		s = s[1:]
+	case strings.HasPrefix(s, "-"):
+		f.cmp = -1
+		s = s[1:]
+	}
+	v, err := progress.ParseBytes(s)
+	if err != nil {
+		return f, fmt.Errorf("bad size '%s'", s)
+	}
+	f.size = v
+	return f, nil
+}
+
+func (f sizeFilter) match(size int64) bool {
+	switch f.cmp {
+	case 1:
+		return size > f.size
+	case -1:
+		return size < f.size
+	default:
+		return size == f.size
+	}
+}
+
+func Find() {
+	whenArg := flag.String("when", "", "time query")
+	allHistoryArg := flag.Bool("all-history", false, "search every version in the history")
+	nameArg := flag.String("name", "", "only match entries whose name matches this glob")
+	sizeArg := flag.String("size", "", "only match files of this size, +N for larger, -N for smaller, with an optional K, M or G suffix")
+	newerArg := flag.String("newer", "", "only match entries modified after this time spec")
+	typeArg := flag.String("type", "", "only match files (f) or directories (d)")
+	flag.Parse()
+
+	findPath := "/"
+	if len(flag.Args()) > 1 {
+		common.Die("please specify a single path\n")
+	} else if len(flag.Args()) == 1 {
+		findPath = flag.Args()[0]
+	}
+
+	if *nameArg != "" {
+		_, err := path.Match(*nameArg, "")
+		if err != nil {
+			common.Die("bad -name pattern: %s\n", err.Error())
+		}
+	}
+	var size sizeFilter
+	if *sizeArg != "" {
+		var err error
+		size, err = parseSize(*sizeArg)
+		if err != nil {
+			common.Die("error parsing -size: %s\n", err.Error())
+		}
+	}
+	var newer time.Time
+	if *newerArg != "" {
+		var err error
+		newer, err = when.Parse(*newerArg)
+		if err != nil {
+			common.Die("error parsing -newer: %s\n", err.Error())
+		}
+	}
+	switch *typeArg {
+	case "", "f", "d":
+	default:
+		common.Die("-type must be f or d\n")
+	}
+
+	match := func(ent fs.DirEnt) bool {
+		if *typeArg == "f" && ent.IsDir() || *typeArg == "d" && !ent.IsDir() {
+			return false
+		}
+		if *nameArg != "" {
+			ok, _ := path.Match(*nameArg, ent.EntName)
+			if !ok {
+				return false
+			}
+		}
+		if *sizeArg != "" && (ent.IsDir() || !size.match(ent.EntSize)) {
+			return false
+		}
+		if *newerArg != "" && !time.Unix(ent.EntModTime, 0).After(newer) {
+			return false
+		}
+		return true
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root missing\n")
+	}
+
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		common.Die("error fetching ref: %s\n", err.Error())
+	}
+
+	ref, err = common.GetRefAt(store, ref, *whenArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	// Unchanged entries are only reported for the newest version they appear in.
+	seen := make(map[seenKey]struct{})
+	for {
+		dirEnt, err := fs.Walk(store, ref.Root, findPath)
+		if err == nil && dirEnt.IsDir() {
+			err = fs.WalkDir(store, dirEnt.HTree.Data, func(entPath string, ent fs.DirEnt) error {
+				entPath = path.Join(findPath, entPath)
+				key := seenKey{path: entPath, hash: ent.HTree.Data}
+				_, ok := seen[key]
+				if ok && ent.IsDir() {
+					return fs.SkipDir
+				}
+				if ok {
+					return nil
+				}
+				seen[key] = struct{}{}
+				if !match(ent) {
+					return nil
+				}
+				if *allHistoryArg {
+					_, err := fmt.Printf("%s@%s\n", entPath, time.Unix(ref.CreatedAt, 0))
+					return err
+				}
+				_, err := fmt.Println(entPath)
+				return err
+			})
+			if err != nil {
+				common.Die("error searching %s: %s\n", findPath, err.Error())
+			}
+		} else if !*allHistoryArg {
+			if err != nil {
+				common.Die("error getting %s: %s\n", findPath, err.Error())
+			}
+			common.Die("'%s' is not a directory\n", findPath)
+		}
+
+		if !*allHistoryArg || !ref.HasPrev {
+			break
+		}
+		ref, err = refs.GetRef(store, ref.Prev)
+		if err != nil {
+			common.Die("error fetching ref: %s\n", err.Error())
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+}
@@ -1,12 +1,97 @@
 package gc
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/cmd/bpy/common"
 	"github.com/buppyio/bpy/gc"
+	"github.com/buppyio/bpy/progress"
 	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"os"
 )
 
+type packReport struct {
+	Name        string  `json:"name"`
+	Size        uint64  `json:"size"`
+	Chunks      int64   `json:"chunks"`
+	LiveChunks  int64   `json:"live_chunks"`
+	LiveBytes   uint64  `json:"live_bytes"`
+	LiveRatio   float64 `json:"live_ratio"`
+	Rewrite     bool    `json:"rewrite"`
+	Reclaimable uint64  `json:"reclaimable"`
+}
+
+func dryRun(c *client.Client, store bpy.CStore, k *bpy.Key, idxCache string, policy gc.Policy, markOpts gc.MarkOptions, jsonOut bool) {
+	usage, err := gc.DryRun(c, store, k, idxCache, policy, markOpts)
+	if err != nil {
+		common.Die("error running gc: %s\n", err.Error())
+	}
+
+	total := uint64(0)
+	enc := json.NewEncoder(os.Stdout)
+	for _, u := range usage {
+		report := packReport{
+			Name:       u.Name,
+			Size:       u.Size,
+			Chunks:     u.Chunks,
+			LiveChunks: u.LiveChunks,
+			LiveBytes:  u.LiveBytes,
+			Rewrite:    u.Rewrite,
+		}
+		action := "keep"
+		if u.Rewrite {
+			action = "rewrite"
+			report.Reclaimable = u.Reclaimable()
+		}
+		if u.Size != 0 {
+			report.LiveRatio = float64(u.LiveBytes) / float64(u.Size)
+		}
+		total += report.Reclaimable
+		if jsonOut {
+			err = enc.Encode(report)
+		} else {
+			_, err = fmt.Printf("%s %s live=%d/%d (%.1f%%) reclaimable=%s\n", action, report.Name, report.LiveChunks, report.Chunks,
+				report.LiveRatio*100, progress.FormatBytes(int64(report.Reclaimable)))
+		}
+		if err != nil {
+			common.Die("io error: %s\n", err.Error())
+		}
+	}
+	if !jsonOut {
+		fmt.Printf("total reclaimable: %s\n", progress.FormatBytes(int64(total)))
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+}
+
 func GC() {
+	jsonArg := flag.Bool("json", false, "write progress events to stderr as json lines, or the dry run report to stdout")
+	dryRunArg := flag.Bool("dry-run", false, "report the live data and reclaimable space of each pack without changing anything")
+	thresholdArg := flag.Float64("dead-threshold", gc.DefaultPolicy.DeadThreshold, "repack packs with a larger fraction of dead data")
+	smallPackArg := flag.String("small-pack", "16M", "coalesce packs smaller than this size")
+	workersArg := flag.Int("mark-workers", gc.DefaultMarkOptions.Workers, "number of chunks to fetch concurrently while marking")
+	spillDirArg := flag.String("spill-dir", "", "keep the set of live chunks in a temporary database in this directory instead of memory")
+	flag.Parse()
+
+	smallPack, err := progress.ParseBytes(*smallPackArg)
+	if err != nil {
+		common.Die("invalid -small-pack size: %s\n", *smallPackArg)
+	}
+	policy := gc.Policy{
+		DeadThreshold: *thresholdArg,
+		SmallPackSize: uint64(smallPack),
+	}
+	markOpts := gc.MarkOptions{
+		Workers: *workersArg,
+		TempDir: *spillDirArg,
+	}
+
 	cfg, err := common.GetConfig()
 	if err != nil {
 		common.Die("error getting config: %s\n", err)
@@ -28,6 +113,16 @@ func GC() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
+	idxCache, err := common.GetIndexCachePath(cfg, &k)
+	if err != nil {
+		common.Die("error getting index cache: %s\n", err.Error())
+	}
+
+	if *dryRunArg {
+		dryRun(c, store, &k, idxCache, policy, markOpts, *jsonArg)
+		return
+	}
+
 	// Stop any gc that is currently running
 	err = remote.StopGC(c)
 	if err != nil {
@@ -39,8 +134,10 @@ func GC() {
 		common.Die("error getting cache connection: %s\n", err.Error())
 	}
 
-	err = gc.GC(c, store, cache, &k)
+	prog := common.StartProgress("gc", *jsonArg)
+	err = gc.GC(c, store, cache, &k, idxCache, policy, markOpts, prog)
 	if err != nil {
 		common.Die("error running gc: %s\n", err.Error())
 	}
+	prog.Finish()
 }
@@ -10,6 +10,7 @@ import (
 
 func Get() {
 	pathArg := flag.String("path", "", "directory to get")
+	jsonArg := flag.Bool("json", false, "write progress events to stderr as json lines")
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -54,7 +55,8 @@ func Get() {
 		common.Die("error fetching ref: %s\n", err.Error())
 	}
 
-	err = fsutil.CpFsToHost(store, ref.Root, *pathArg, flag.Args()[0])
+	prog := common.StartProgress("get", *jsonArg)
+	err = fsutil.CpFsToHost(store, ref.Root, *pathArg, flag.Args()[0], prog)
 	if err != nil {
 		common.Die("error copying directory: %s\n", err.Error())
 	}
@@ -63,4 +65,5 @@ func Get() {
 	if err != nil {
 		common.Die("error closing remote: %s\n", err.Error())
 	}
+	prog.Finish()
 }
@@ -0,0 +1,239 @@
+package grep
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"io"
+	"path"
+	"regexp"
+	"time"
+)
+
+var maxLineSize = 16 * 1024 * 1024
+
+type seenKey struct {
+	path string
+	hash [32]byte
+}
+
+type match struct {
+	lineNo int
+	line   string
+}
+
+type result struct {
+	binary  bool
+	matches []match
+}
+
+func grepFile(store bpy.CStore, ent fs.DirEnt, re *regexp.Regexp, filesOnly bool) (result, error) {
+	res := result{}
+	f, err := fs.OpenEnt(store, ent)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	var buf []byte
+	lineNo := 0
+	for {
+		line, err := readLine(rdr, buf)
+		if err != nil && err != io.EOF {
+			return res, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			return res, nil
+		}
+		buf = line
+		lineNo++
+		if re.Match(line) {
+			if bytes.IndexByte(line, 0) != -1 {
+				res.binary = true
+				return res, nil
+			}
+			res.matches = append(res.matches, match{lineNo: lineNo, line: string(line)})
+			if filesOnly {
+				return res, nil
+			}
+		}
+		if err == io.EOF {
+			return res, nil
+		}
+	}
+}
+
+// readLine reads the next line into buf without its newline. Lines longer
+// than maxLineSize are cut short and the rest skipped, so one huge line
+// does not end the search of a file.
+func readLine(rdr *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for {
+		chunk, err := rdr.ReadSlice('\n')
+		if n := maxLineSize - len(buf); len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		buf = append(buf, chunk...)
+		if err != bufio.ErrBufferFull {
+			return bytes.TrimSuffix(buf, []byte("\n")), err
+		}
+	}
+}
+
+func Grep() {
+	whenArg := flag.String("when", "", "time query")
+	allHistoryArg := flag.Bool("all-history", false, "search every version in the history")
+	ignoreCaseArg := flag.Bool("i", false, "ignore case")
+	filesOnlyArg := flag.Bool("l", false, "only print the names of matching files")
+	lineNumbersArg := flag.Bool("n", false, "print line numbers")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 || len(flag.Args()) > 2 {
+		common.Die("please specify a pattern and optionally a path\n")
+	}
+	pattern := flag.Args()[0]
+	grepPath := "/"
+	if len(flag.Args()) == 2 {
+		grepPath = flag.Args()[1]
+	}
+	if *ignoreCaseArg {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		common.Die("error parsing pattern: %s\n", err.Error())
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root missing\n")
+	}
+
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		common.Die("error fetching ref: %s\n", err.Error())
+	}
+
+	ref, err = common.GetRefAt(store, ref, *whenArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	printResult := func(entPath string, res result) error {
+		name := entPath
+		if *allHistoryArg {
+			name = fmt.Sprintf("%s@%s", entPath, time.Unix(ref.CreatedAt, 0))
+		}
+		if len(res.matches) == 0 && !res.binary {
+			return nil
+		}
+		if *filesOnlyArg {
+			_, err := fmt.Println(name)
+			return err
+		}
+		if res.binary {
+			_, err := fmt.Printf("Binary file %s matches\n", name)
+			return err
+		}
+		for _, m := range res.matches {
+			var err error
+			if *lineNumbersArg {
+				_, err = fmt.Printf("%s:%d:%s\n", name, m.lineNo, m.line)
+			} else {
+				_, err = fmt.Printf("%s:%s\n", name, m.line)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	grepEnt := func(entPath string, ent fs.DirEnt, seen map[seenKey]struct{}, results map[[32]byte]result) error {
+		key := seenKey{path: entPath, hash: ent.HTree.Data}
+		_, ok := seen[key]
+		if ok && ent.IsDir() {
+			return fs.SkipDir
+		}
+		if ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+		if !ent.EntMode.IsRegular() {
+			return nil
+		}
+		// Identical contents in other files or versions are only read once.
+		res, ok := results[ent.HTree.Data]
+		if !ok {
+			res, err = grepFile(store, ent, re, *filesOnlyArg)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %s", entPath, err.Error())
+			}
+			results[ent.HTree.Data] = res
+		}
+		return printResult(entPath, res)
+	}
+
+	seen := make(map[seenKey]struct{})
+	results := make(map[[32]byte]result)
+	for {
+		ent, err := fs.Walk(store, ref.Root, grepPath)
+		if err == nil {
+			if ent.IsDir() {
+				err = fs.WalkDir(store, ent.HTree.Data, func(entPath string, ent fs.DirEnt) error {
+					return grepEnt(path.Join(grepPath, entPath), ent, seen, results)
+				})
+			} else {
+				err = grepEnt(grepPath, ent, seen, results)
+			}
+			if err != nil {
+				common.Die("%s\n", err.Error())
+			}
+		} else if !*allHistoryArg {
+			common.Die("error getting %s: %s\n", grepPath, err.Error())
+		}
+
+		if !*allHistoryArg || !ref.HasPrev {
+			break
+		}
+		ref, err = refs.GetRef(store, ref.Prev)
+		if err != nil {
+			common.Die("error fetching ref: %s\n", err.Error())
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,45 @@
+package grep
+
+import (
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/testhelp"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGrepFile(t *testing.T) {
+	store := testhelp.NewMemStore()
+	re := regexp.MustCompile("needle")
+	defer func(n int) { maxLineSize = n }(maxLineSize)
+	for _, tc := range []struct {
+		maxLineSize int
+		contents    string
+		expected    []match
+	}{
+		{16 * 1024 * 1024, strings.Repeat("a", 70*1024) + "\nneedle\n", []match{{2, "needle"}}},
+		{16 * 1024 * 1024, "needle\n\nx needle", []match{{1, "needle"}, {3, "x needle"}}},
+		{1024, strings.Repeat("b", 5000) + "\na needle\n", []match{{2, "a needle"}}},
+		{1024, "needle" + strings.Repeat("c", 5000) + "\n\nneedle", []match{{1, "needle" + strings.Repeat("c", 1018)}, {3, "needle"}}},
+	} {
+		maxLineSize = tc.maxLineSize
+		w := htree.NewWriter(store)
+		_, err := w.Write([]byte(tc.contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := grepFile(store, fs.DirEnt{EntSize: int64(len(tc.contents)), HTree: tree}, re, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.binary || !reflect.DeepEqual(res.matches, tc.expected) {
+			t.Fatalf("grep found %v, expected %v", res.matches, tc.expected)
+		}
+	}
+}
@@ -142,8 +142,15 @@ func prune() {
 }
 
 func list() {
+	jsonArg := flag.Bool("json", false, "print refs as json lines")
+	formatArg := flag.String("format", "", "print refs using a go template, e.g. '{{.Hash}} {{.CreatedAt}}'")
 	flag.Parse()
 
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
 	cfg, err := common.GetConfig()
 	if err != nil {
 		common.Die("error getting config: %s\n", err)
@@ -178,7 +185,8 @@ func list() {
 		if err != nil {
 			common.Die("error fetching ref: %s\n", err.Error())
 		}
-		_, err = fmt.Printf("%s@%s\n", hex.EncodeToString(rootHash[:]), time.Unix(ref.CreatedAt, 0))
+		plain := fmt.Sprintf("%s@%s", hex.EncodeToString(rootHash[:]), time.Unix(ref.CreatedAt, 0))
+		err = printer.Print(common.NewRefInfo(rootHash, ref), plain)
 		if err != nil {
 			common.Die("io error: %s\n", err.Error())
 		}
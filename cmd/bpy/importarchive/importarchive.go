@@ -0,0 +1,119 @@
+package importarchive
+
+import (
+	"flag"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/archive"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/remote"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+type importFunc func(store bpy.CStore, in *os.File, prog *progress.Progress) (fs.DirEnt, error)
+
+func ImportTar() {
+	importArchive("import-tar", func(store bpy.CStore, in *os.File, prog *progress.Progress) (fs.DirEnt, error) {
+		return archive.ImportTar(store, in, prog)
+	})
+}
+
+func ImportZip() {
+	importArchive("import-zip", func(store bpy.CStore, in *os.File, prog *progress.Progress) (fs.DirEnt, error) {
+		// Zip archives are read from the end, so stdin is spooled to disk first.
+		if in == os.Stdin {
+			tmp, err := ioutil.TempFile("", "bpy-import-zip")
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+			_, err = io.Copy(tmp, in)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			in = tmp
+		}
+		st, err := in.Stat()
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		return archive.ImportZip(store, in, st.Size(), prog)
+	})
+}
+
+func importArchive(op string, imp importFunc) {
+	fileArg := flag.String("f", "", "archive to import, defaults to stdin")
+	jsonArg := flag.Bool("json", false, "write progress events to stderr as json lines")
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		common.Die("please specify the dest path\n")
+	}
+	destPath := path.Clean("/" + flag.Args()[0])
+	if destPath == "/" {
+		common.Die("cannot replace the root\n")
+	}
+
+	in := os.Stdin
+	if *fileArg != "" {
+		f, err := os.Open(*fileArg)
+		if err != nil {
+			common.Die("error opening archive: %s\n", err.Error())
+		}
+		defer f.Close()
+		in = f
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		common.Die("error getting current epoch: %s\n", err.Error())
+	}
+
+	prog := common.StartProgress(op, *jsonArg)
+
+	store, err := common.GetProgressCStore(cfg, &k, c, prog)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	srcDirEnt, err := imp(store, in, prog)
+	if err != nil {
+		common.Die("error importing archive: %s\n", err.Error())
+	}
+
+	// The archive can only be read once, so only the insert is retried
+	// when another client changes the root first.
+	err = remote.UpdateRoot(c, &k, store, epoch, func(root [32]byte) (fs.DirEnt, error) {
+		return common.InsertAt(store, root, destPath, srcDirEnt, false)
+	})
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing store: %s\n", err.Error())
+	}
+	prog.Finish()
+}
@@ -2,16 +2,55 @@ package ls
 
 import (
 	"flag"
-	"fmt"
+	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/cmd/bpy/common"
 	"github.com/buppyio/bpy/fs"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
-	"github.com/buppyio/bpy/when"
+	"os"
+	"path"
 )
 
+func printDir(store bpy.CStore, printer *common.Printer, dirPath string, hash [32]byte, long, recursive bool) error {
+	ents, err := fs.ReadDir(store, hash)
+	if err != nil {
+		return err
+	}
+	// Directories are listed before files.
+	for _, listDirs := range []bool{true, false} {
+		for _, ent := range ents[1:] {
+			if ent.IsDir() != listDirs {
+				continue
+			}
+			info := common.NewEntInfo(path.Join(dirPath, ent.EntName), ent)
+			plain := info.Path
+			if ent.IsDir() {
+				plain += "/"
+			}
+			if long {
+				plain = info.LongFormat()
+			}
+			err = printer.Print(info, plain)
+			if err != nil {
+				return err
+			}
+			if ent.IsDir() && recursive {
+				err = printDir(store, printer, info.Path, ent.HTree.Data, long, recursive)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func Ls() {
 	whenArg := flag.String("when", "", "time query")
+	longArg := flag.Bool("l", false, "long format listing with mode, size and modification time")
+	recursiveArg := flag.Bool("R", false, "list subdirectories recursively")
+	jsonArg := flag.Bool("json", false, "print entries as json lines")
+	formatArg := flag.String("format", "", "print entries using a go template, e.g. '{{.Name}} {{.Size}}'")
 
 	lsPath := "/"
 	flag.Parse()
@@ -22,6 +61,11 @@ func Ls() {
 		lsPath = flag.Args()[0]
 	}
 
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
 	cfg, err := common.GetConfig()
 	if err != nil {
 		common.Die("error getting config: %s\n", err)
@@ -56,41 +100,22 @@ func Ls() {
 		common.Die("error fetching ref: %s\n", err.Error())
 	}
 
-	if *whenArg != "" {
-		refTime, err := when.Parse(*whenArg)
-		if err != nil {
-			common.Die("error parsing 'when' arg: %s\n", err.Error())
-		}
-		refPast, ok, err := refs.GetAtTime(store, ref, refTime)
-		if err != nil {
-			common.Die("error looking at ref history: %s\n", err.Error())
-		}
-		if !ok {
-			common.Die("ref did not exist at %s\n", refTime.String())
-		}
-		ref = refPast
+	ref, err = common.GetRefAt(store, ref, *whenArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
 	}
 
-	ents, err := fs.Ls(store, ref.Root, lsPath)
+	dirEnt, err := fs.Walk(store, ref.Root, lsPath)
 	if err != nil {
 		common.Die("error reading directory: %s\n", err.Error())
 	}
-
-	for _, ent := range ents[1:] {
-		if ent.EntMode.IsDir() {
-			_, err = fmt.Printf("%s/\n", ent.EntName)
-			if err != nil {
-				common.Die("io error: %s\n", err.Error())
-			}
-		}
+	if !dirEnt.IsDir() {
+		common.Die("'%s' is not a directory\n", lsPath)
 	}
-	for _, ent := range ents[1:] {
-		if !ent.EntMode.IsDir() {
-			_, err = fmt.Printf("%s\n", ent.EntName)
-			if err != nil {
-				common.Die("io error: %s\n", err.Error())
-			}
-		}
+
+	err = printDir(store, printer, "", dirEnt.HTree.Data, *longArg, *recursiveArg)
+	if err != nil {
+		common.Die("error listing directory: %s\n", err.Error())
 	}
 	err = store.Close()
 	if err != nil {
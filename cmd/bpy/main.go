@@ -5,35 +5,57 @@ import (
 	"github.com/buppyio/bpy/cmd/bpy/browse"
 	"github.com/buppyio/bpy/cmd/bpy/cachedaemon"
 	"github.com/buppyio/bpy/cmd/bpy/cat"
+	"github.com/buppyio/bpy/cmd/bpy/common"
 	"github.com/buppyio/bpy/cmd/bpy/cp"
+	"github.com/buppyio/bpy/cmd/bpy/du"
 	"github.com/buppyio/bpy/cmd/bpy/env"
+	"github.com/buppyio/bpy/cmd/bpy/find"
 	"github.com/buppyio/bpy/cmd/bpy/gc"
 	"github.com/buppyio/bpy/cmd/bpy/get"
+	"github.com/buppyio/bpy/cmd/bpy/grep"
 	"github.com/buppyio/bpy/cmd/bpy/hist"
+	"github.com/buppyio/bpy/cmd/bpy/importarchive"
 	"github.com/buppyio/bpy/cmd/bpy/ls"
 	"github.com/buppyio/bpy/cmd/bpy/mkdir"
 	"github.com/buppyio/bpy/cmd/bpy/mv"
 	"github.com/buppyio/bpy/cmd/bpy/newkey"
 	"github.com/buppyio/bpy/cmd/bpy/put"
+	"github.com/buppyio/bpy/cmd/bpy/remote"
 	"github.com/buppyio/bpy/cmd/bpy/rm"
+	"github.com/buppyio/bpy/cmd/bpy/s3gateway"
+	"github.com/buppyio/bpy/cmd/bpy/stat"
+	"github.com/buppyio/bpy/cmd/bpy/stats"
 	"github.com/buppyio/bpy/cmd/bpy/tar"
 	"github.com/buppyio/bpy/cmd/bpy/version"
+	"github.com/buppyio/bpy/cmd/bpy/webdav"
 	"github.com/buppyio/bpy/cmd/bpy/zip"
 	"os"
 )
 
 func help() {
 	fmt.Println("Please specify one of the following subcommands:")
-	fmt.Println("browse, cat, cp, env, gc, get, hist, ls, mkdir, mv, new-key, put, rm, tar, version, zip")
+	fmt.Println("browse, cat, cp, du, env, find, gc, get, grep, hist, import-tar, import-zip, ls, mkdir, mv, new-key, put, remote, rm, s3-gateway, stat, stats, tar, version, webdav, zip")
 	fmt.Println("")
 	fmt.Println("For more use -h on the sub commands.")
 	fmt.Println("Also check the docs at https://buppy.io/docs")
 	os.Exit(1)
 }
 
+// localCommands do not talk to the remote, so they take no bandwidth limits.
+var localCommands = map[string]bool{
+	"cache-daemon": true,
+	"env":          true,
+	"new-key":      true,
+	"remote":       true,
+	"version":      true,
+}
+
 func main() {
 	cmd := help
 	if len(os.Args) > 1 {
+		if !localCommands[os.Args[1]] {
+			common.AddLimitFlags()
+		}
 		switch os.Args[1] {
 		case "browse":
 			cmd = browse.Browse
@@ -45,14 +67,24 @@ func main() {
 			cmd = dbg
 		case "cp":
 			cmd = cp.Cp
+		case "du":
+			cmd = du.Du
 		case "env":
 			cmd = env.Env
+		case "find":
+			cmd = find.Find
 		case "gc":
 			cmd = gc.GC
 		case "get":
 			cmd = get.Get
+		case "grep":
+			cmd = grep.Grep
 		case "hist":
 			cmd = hist.Hist
+		case "import-tar":
+			cmd = importarchive.ImportTar
+		case "import-zip":
+			cmd = importarchive.ImportZip
 		case "ls":
 			cmd = ls.Ls
 		case "mkdir":
@@ -61,12 +93,22 @@ func main() {
 			cmd = mv.Mv
 		case "put":
 			cmd = put.Put
+		case "remote":
+			cmd = remote.Remote
 		case "rm":
 			cmd = rm.Rm
+		case "s3-gateway":
+			cmd = s3gateway.S3Gateway
+		case "stat":
+			cmd = stat.Stat
+		case "stats":
+			cmd = stats.Stats
 		case "tar":
 			cmd = tar.Tar
 		case "version":
 			cmd = version.Version
+		case "webdav":
+			cmd = webdav.WebDAV
 		case "new-key":
 			cmd = newkey.NewKey
 		case "zip":
@@ -13,8 +13,23 @@ import (
 )
 
 func Put() {
+	jsonArg := flag.Bool("json", false, "write progress events to stderr as json lines")
+	stdinArg := flag.Bool("stdin", false, "store stdin as the file given by -name")
+	nameArg := flag.String("name", "", "with -stdin, path of the file to store")
+	modeArg := flag.String("mode", "0644", "with -stdin, octal permissions of the file")
+	mtimeArg := flag.String("mtime", "", "with -stdin, time spec of the modification time, defaults to now")
 	flag.Parse()
 
+	if *stdinArg {
+		putStdin(*nameArg, *modeArg, *mtimeArg, *jsonArg)
+		return
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "name" || f.Name == "mode" || f.Name == "mtime" {
+			common.Die("-%s can only be used with -stdin\n", f.Name)
+		}
+	})
+
 	if len(flag.Args()) < 1 {
 		common.Die("please specify the local folder to put into dest\n")
 	}
@@ -54,8 +69,10 @@ func Put() {
 		common.Die("error getting current epoch: %s\n", err.Error())
 	}
 
+	prog := common.StartProgress("put", *jsonArg)
+
 	for {
-		store, err := common.GetCStore(cfg, &k, c)
+		store, err := common.GetProgressCStore(cfg, &k, c, prog)
 		if err != nil {
 			common.Die("error getting content store: %s\n", err.Error())
 		}
@@ -73,7 +90,7 @@ func Put() {
 			common.Die("error fetching ref: %s\n", err.Error())
 		}
 
-		srcDirEnt, err := fsutil.CpHostToFs(store, srcPath)
+		srcDirEnt, err := fsutil.CpHostToFs(store, srcPath, prog)
 		if err != nil {
 			common.Die("error copying data: %s\n", err.Error())
 		}
@@ -103,4 +120,5 @@ func Put() {
 			break
 		}
 	}
+	prog.Finish()
 }
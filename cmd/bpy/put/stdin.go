@@ -0,0 +1,113 @@
+package put
+
+import (
+	"flag"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/when"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+func putStdin(name, modeStr, mtimeStr string, jsonEvents bool) {
+	if len(flag.Args()) != 0 {
+		common.Die("-stdin takes no arguments, use -name to give the dest path\n")
+	}
+	if name == "" {
+		common.Die("please specify the dest path with -name\n")
+	}
+	destPath := path.Clean("/" + name)
+	if destPath == "/" {
+		common.Die("cannot replace the root\n")
+	}
+
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		common.Die("invalid mode '%s'\n", modeStr)
+	}
+
+	mtime := time.Now()
+	if mtimeStr != "" {
+		mtime, err = when.Parse(mtimeStr)
+		if err != nil {
+			common.Die("error parsing 'mtime' arg: %s\n", err.Error())
+		}
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		common.Die("error getting current epoch: %s\n", err.Error())
+	}
+
+	prog := common.StartProgress("put", jsonEvents)
+
+	store, err := common.GetProgressCStore(cfg, &k, c, prog)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	fileEnt, err := writeFile(store, prog.Reader(os.Stdin, progress.BytesIn), os.FileMode(mode), mtime)
+	if err != nil {
+		common.Die("error storing stdin: %s\n", err.Error())
+	}
+	prog.Add(progress.Files, 1)
+
+	// Stdin can only be read once, so only the insert is retried when
+	// another client changes the root first.
+	err = remote.UpdateRoot(c, &k, store, epoch, func(root [32]byte) (fs.DirEnt, error) {
+		return common.InsertAt(store, root, destPath, fileEnt, true)
+	})
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing store: %s\n", err.Error())
+	}
+	prog.Finish()
+}
+
+// writeFile stores the contents of r as a file with the given mode and
+// modification time.
+func writeFile(store bpy.CStore, r io.Reader, mode os.FileMode, mtime time.Time) (fs.DirEnt, error) {
+	w := htree.NewWriter(store)
+	size, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return fs.DirEnt{}, err
+	}
+	tree, err := w.Close()
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	return fs.DirEnt{
+		EntSize:    size,
+		EntMode:    mode,
+		EntModTime: mtime.Unix(),
+		HTree:      tree,
+	}, nil
+}
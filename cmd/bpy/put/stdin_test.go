@@ -0,0 +1,78 @@
+package put
+
+import (
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/testhelp"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putString(t *testing.T, store bpy.CStore, root [32]byte, destPath, contents string) (fs.DirEnt, error) {
+	ent, err := writeFile(store, strings.NewReader(contents), 0600, time.Unix(1234567890, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return common.InsertAt(store, root, destPath, ent, true)
+}
+
+func checkFile(t *testing.T, store bpy.CStore, root [32]byte, p, expected string) {
+	rdr, err := fs.Open(store, root, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != expected {
+		t.Fatalf("%s has contents %q", p, contents)
+	}
+}
+
+func TestPutStdin(t *testing.T) {
+	store := testhelp.NewMemStore()
+	root, err := fs.EmptyDir(store, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err = putString(t, store, root.HTree.Data, "/a/b/c.txt", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, store, root.HTree.Data, "/a/b/c.txt", "hello")
+	ent, _, err := fs.Lookup(store, root.HTree.Data, "/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.EntMode != 0600 || ent.EntModTime != 1234567890 || ent.EntSize != 5 {
+		t.Fatalf("bad file entry %+v", ent)
+	}
+
+	root, err = putString(t, store, root.HTree.Data, "/a/b/c.txt", "replaced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, store, root.HTree.Data, "/a/b/c.txt", "replaced")
+	ents, err := fs.Ls(store, root.HTree.Data, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 {
+		t.Fatalf("replacing left %d entries", len(ents)-1)
+	}
+
+	_, err = putString(t, store, root.HTree.Data, "/a/b/c.txt/d", "x")
+	if err == nil || err.Error() != "'/a/b/c.txt' is not a directory" {
+		t.Fatalf("expected a not a directory error, got %v", err)
+	}
+	_, err = putString(t, store, root.HTree.Data, "/a/b", "x")
+	if err == nil || err.Error() != "'/a/b' is a directory" {
+		t.Fatalf("expected an is a directory error, got %v", err)
+	}
+}
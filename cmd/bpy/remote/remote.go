@@ -0,0 +1,82 @@
+package remote
+
+import (
+	"flag"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/remote/server"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+type stdio struct{}
+
+func (s *stdio) Read(buf []byte) (int, error) {
+	return os.Stdin.Read(buf)
+}
+
+func (s *stdio) Write(buf []byte) (int, error) {
+	return os.Stdout.Write(buf)
+}
+
+func (s *stdio) Close() error {
+	return os.Stdout.Close()
+}
+
+func Remote() {
+	listenArg := flag.String("listen", "", "listen for tls connections on this address instead of using stdin/stdout")
+	certArg := flag.String("cert", "", "server tls certificate (defaults to DATADIR/server.crt, created if missing)")
+	keyArg := flag.String("key", "", "server tls private key (defaults to DATADIR/server.key, created if missing)")
+	allowNewKeysArg := flag.Bool("allow-new-keys", false, "pin and accept client certificates for previously unseen key ids")
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		common.Die("please specify a data directory\n")
+	}
+
+	dataDir, err := filepath.Abs(flag.Args()[0])
+	if err != nil {
+		common.Die("error getting data directory: %s\n", err.Error())
+	}
+	err = os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		common.Die("error creating data directory: %s\n", err.Error())
+	}
+
+	srv := server.NewServer(dataDir)
+
+	if *listenArg == "" {
+		err = srv.ServeConn(&stdio{})
+		if err != nil {
+			common.Die("error serving connection: %s\n", err.Error())
+		}
+		return
+	}
+
+	if *certArg == "" {
+		*certArg = filepath.Join(dataDir, "server.crt")
+	}
+	if *keyArg == "" {
+		*keyArg = filepath.Join(dataDir, "server.key")
+	}
+
+	cert, err := server.LoadOrCreateCertificate(*certArg, *keyArg)
+	if err != nil {
+		common.Die("error loading server certificate: %s\n", err.Error())
+	}
+
+	fingerprint, err := server.CertificateFingerprint(cert)
+	if err != nil {
+		common.Die("error getting server fingerprint: %s\n", err.Error())
+	}
+
+	l, err := net.Listen("tcp", *listenArg)
+	if err != nil {
+		common.Die("error listening: %s\n", err.Error())
+	}
+
+	log.Printf("listening on %s", l.Addr())
+	log.Printf("server fingerprint: %s", fingerprint)
+	log.Fatal(srv.ServeTLS(l, cert, *allowNewKeysArg))
+}
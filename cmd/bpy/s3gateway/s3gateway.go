@@ -0,0 +1,66 @@
+package s3gateway
+
+import (
+	"flag"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/rootfs"
+	"github.com/buppyio/bpy/s3gateway"
+	"log"
+	"net/http"
+)
+
+func S3Gateway() {
+	addrArg := flag.String("addr", "127.0.0.1:9000", "address to listen on")
+	flag.Parse()
+
+	buckets := []s3gateway.Bucket{{Name: "bpy", Path: "/"}}
+	if len(flag.Args()) != 0 {
+		buckets = nil
+		seen := make(map[string]bool)
+		for _, arg := range flag.Args() {
+			b, err := s3gateway.ParseBucket(arg)
+			if err != nil {
+				common.Die("%s\n", err.Error())
+			}
+			if seen[b.Name] {
+				common.Die("duplicate bucket '%s'\n", b.Name)
+			}
+			seen[b.Name] = true
+			buckets = append(buckets, b)
+		}
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting key: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	f, err := rootfs.New(c, &k, func() (bpy.CStore, error) {
+		return common.GetCStore(cfg, &k, c)
+	})
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+	defer f.Close()
+
+	for _, b := range buckets {
+		log.Printf("serving %s as bucket '%s'\n", b.Path, b.Name)
+	}
+	log.Printf("serving s3 on http://%s/\n", *addrArg)
+	err = http.ListenAndServe(*addrArg, s3gateway.NewHandler(f, buckets))
+	if err != nil {
+		common.Die("error serving s3: %s\n", err.Error())
+	}
+}
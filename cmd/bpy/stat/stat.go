@@ -0,0 +1,89 @@
+package stat
+
+import (
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"os"
+	"time"
+)
+
+func plainStat(info common.EntInfo) string {
+	return fmt.Sprintf("path: %s\nsize: %d\nmode: %s\nmtime: %s\nhtree: depth %d hash %s",
+		info.Path, info.Size, info.Mode, time.Unix(info.MTime, 0), info.HTreeDepth, info.HTreeHash)
+}
+
+func Stat() {
+	whenArg := flag.String("when", "", "time query")
+	jsonArg := flag.Bool("json", false, "print entries as json lines")
+	formatArg := flag.String("format", "", "print entries using a go template, e.g. '{{.Size}}'")
+	flag.Parse()
+
+	if len(flag.Args()) == 0 {
+		common.Die("please specify a path\n")
+	}
+
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root missing\n")
+	}
+
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		common.Die("error fetching ref: %s\n", err.Error())
+	}
+
+	ref, err = common.GetRefAt(store, ref, *whenArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	for _, fpath := range flag.Args() {
+		ent, err := fs.Walk(store, ref.Root, fpath)
+		if err != nil {
+			common.Die("error getting %s: %s\n", fpath, err.Error())
+		}
+		info := common.NewEntInfo(fpath, ent)
+		err = printer.Print(info, plainStat(info))
+		if err != nil {
+			common.Die("io error: %s\n", err.Error())
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,298 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/gc"
+	"github.com/buppyio/bpy/progress"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"os"
+	"time"
+)
+
+type sizeBucket struct {
+	Label string `json:"label"`
+	Max   uint64 `json:"max"`
+	Count int    `json:"count"`
+}
+
+type statsInfo struct {
+	Packs            int          `json:"packs"`
+	PackBytes        uint64       `json:"pack_bytes"`
+	PackSizes        []sizeBucket `json:"pack_sizes"`
+	Chunks           int64        `json:"chunks"`
+	StoredBytes      uint64       `json:"stored_bytes"`
+	AverageChunkSize float64      `json:"average_chunk_size"`
+	LogicalBytes     int64        `json:"logical_bytes"`
+	UniqueBytes      int64        `json:"unique_bytes"`
+	LiveStoredBytes  uint64       `json:"live_stored_bytes"`
+	CompressionRatio float64      `json:"compression_ratio"`
+	DedupRatio       float64      `json:"dedup_ratio"`
+	Versions         int          `json:"versions"`
+	Oldest           int64        `json:"oldest"`
+	Newest           int64        `json:"newest"`
+	ReclaimableBytes uint64       `json:"reclaimable_bytes"`
+}
+
+func newSizeBuckets() []sizeBucket {
+	return []sizeBucket{
+		{Label: "< 1 MiB", Max: 1024 * 1024},
+		{Label: "1-16 MiB", Max: 16 * 1024 * 1024},
+		{Label: "16-64 MiB", Max: 64 * 1024 * 1024},
+		{Label: "64-128 MiB", Max: 128 * 1024 * 1024},
+		{Label: ">= 128 MiB", Max: 0},
+	}
+}
+
+func addToBucket(buckets []sizeBucket, size uint64) {
+	for i := range buckets {
+		if buckets[i].Max == 0 || size < buckets[i].Max {
+			buckets[i].Count += 1
+			return
+		}
+	}
+}
+
+// sizer finds the uncompressed size of every chunk reachable from the
+// drive history, and the logical size of each version.
+type sizer struct {
+	store bpy.CStore
+	sizes map[[32]byte]int64
+	dirs  map[[32]byte]int64
+}
+
+// node records the sizes of the htree rooted at hash, end is the offset
+// of the end of the tree, or -1 when it is unknown.
+func (s *sizer) node(hash [32]byte, end int64) error {
+	_, ok := s.sizes[hash]
+	if ok {
+		return nil
+	}
+	data, err := s.store.Get(hash)
+	if err != nil {
+		return err
+	}
+	if data[0] == 0 {
+		s.sizes[hash] = int64(len(data) - 1)
+		return nil
+	}
+	s.sizes[hash] = int64(len(data))
+	for i := 1; i < len(data); i += 40 {
+		var child [32]byte
+		offset := int64(binary.LittleEndian.Uint64(data[i : i+8]))
+		copy(child[:], data[i+8:i+40])
+		childEnd := end
+		if i+40 < len(data) {
+			childEnd = int64(binary.LittleEndian.Uint64(data[i+40 : i+48]))
+		}
+		if data[0] != 1 || childEnd < 0 {
+			err = s.node(child, childEnd)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		s.sizes[child] = childEnd - offset
+	}
+	return nil
+}
+
+func (s *sizer) dir(hash [32]byte) (int64, error) {
+	logical, ok := s.dirs[hash]
+	if ok {
+		return logical, nil
+	}
+	err := s.node(hash, -1)
+	if err != nil {
+		return 0, err
+	}
+	ents, err := fs.ReadDir(s.store, hash)
+	if err != nil {
+		return 0, err
+	}
+	for _, ent := range ents[1:] {
+		if ent.IsDir() {
+			sub, err := s.dir(ent.HTree.Data)
+			if err != nil {
+				return 0, err
+			}
+			logical += sub
+			continue
+		}
+		logical += ent.EntSize
+		if ent.HTree.Depth == 0 {
+			s.sizes[ent.HTree.Data] = ent.EntSize
+			continue
+		}
+		err = s.node(ent.HTree.Data, ent.EntSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.dirs[hash] = logical
+	return logical, nil
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+func Stats() {
+	jsonArg := flag.Bool("json", false, "print stats as json")
+	formatArg := flag.String("format", "", "print stats using a go template, e.g. '{{.Chunks}} {{.DedupRatio}}'")
+	flag.Parse()
+
+	printer, err := common.NewPrinter(os.Stdout, *jsonArg, *formatArg)
+	if err != nil {
+		common.Die("%s\n", err.Error())
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	idxCache, err := common.GetIndexCachePath(cfg, &k)
+	if err != nil {
+		common.Die("error getting index cache: %s\n", err.Error())
+	}
+
+	indexes, err := cstore.ReadPackIndexes(c, k.CipherKey, idxCache)
+	if err != nil {
+		common.Die("error reading pack indexes: %s\n", err.Error())
+	}
+
+	info := statsInfo{
+		Packs:     len(indexes),
+		PackSizes: newSizeBuckets(),
+	}
+	seen := make(map[[32]byte]struct{})
+	for _, pack := range indexes {
+		info.PackBytes += pack.Size
+		addToBucket(info.PackSizes, pack.Size)
+		for _, ent := range pack.Idx {
+			var hash [32]byte
+			copy(hash[:], ent.Key)
+			_, ok := seen[hash]
+			if ok {
+				continue
+			}
+			seen[hash] = struct{}{}
+			info.Chunks += 1
+			info.StoredBytes += uint64(ent.Size)
+		}
+	}
+	info.AverageChunkSize = ratio(float64(info.StoredBytes), float64(info.Chunks))
+
+	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root missing\n")
+	}
+
+	s := &sizer{
+		store: store,
+		sizes: make(map[[32]byte]int64),
+		dirs:  make(map[[32]byte]int64),
+	}
+	hash := rootHash
+	for {
+		ref, err := refs.GetRef(store, hash)
+		if err != nil {
+			common.Die("error fetching ref: %s\n", err.Error())
+		}
+		err = s.node(hash, -1)
+		if err != nil {
+			common.Die("error reading ref: %s\n", err.Error())
+		}
+		logical, err := s.dir(ref.Root)
+		if err != nil {
+			common.Die("error reading drive: %s\n", err.Error())
+		}
+		info.LogicalBytes += logical
+		info.Versions += 1
+		if info.Newest == 0 {
+			info.Newest = ref.CreatedAt
+		}
+		info.Oldest = ref.CreatedAt
+		if !ref.HasPrev {
+			break
+		}
+		hash = ref.Prev
+	}
+	for _, size := range s.sizes {
+		info.UniqueBytes += size
+	}
+
+	live, err := gc.Mark(store, rootHash, gc.DefaultMarkOptions)
+	if err != nil {
+		common.Die("error marking live chunks: %s\n", err.Error())
+	}
+	usage, err := gc.Usage(indexes, live)
+	if err != nil {
+		common.Die("error reading live chunks: %s\n", err.Error())
+	}
+	live.Close()
+	gc.DefaultPolicy.Plan(usage)
+	for _, u := range usage {
+		info.LiveStoredBytes += u.LiveBytes
+		if u.Rewrite {
+			info.ReclaimableBytes += u.Reclaimable()
+		}
+	}
+	info.CompressionRatio = ratio(float64(info.UniqueBytes), float64(info.LiveStoredBytes))
+	info.DedupRatio = ratio(float64(info.LogicalBytes), float64(info.UniqueBytes))
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+
+	var plain bytes.Buffer
+	fmt.Fprintf(&plain, "packs: %d (%s)\n", info.Packs, progress.FormatBytes(int64(info.PackBytes)))
+	for _, bucket := range info.PackSizes {
+		fmt.Fprintf(&plain, "  %s: %d\n", bucket.Label, bucket.Count)
+	}
+	fmt.Fprintf(&plain, "chunks: %d (%s)\n", info.Chunks, progress.FormatBytes(int64(info.StoredBytes)))
+	fmt.Fprintf(&plain, "average chunk size: %s\n", progress.FormatBytes(int64(info.AverageChunkSize)))
+	fmt.Fprintf(&plain, "logical size: %s\n", progress.FormatBytes(info.LogicalBytes))
+	fmt.Fprintf(&plain, "unique size: %s\n", progress.FormatBytes(info.UniqueBytes))
+	fmt.Fprintf(&plain, "compression ratio: %.2f\n", info.CompressionRatio)
+	fmt.Fprintf(&plain, "dedup ratio: %.2f\n", info.DedupRatio)
+	fmt.Fprintf(&plain, "versions: %d\n", info.Versions)
+	fmt.Fprintf(&plain, "oldest: %s\n", time.Unix(info.Oldest, 0))
+	fmt.Fprintf(&plain, "newest: %s\n", time.Unix(info.Newest, 0))
+	fmt.Fprintf(&plain, "reclaimable by gc: %s", progress.FormatBytes(int64(info.ReclaimableBytes)))
+	err = printer.Print(info, plain.String())
+	if err != nil {
+		common.Die("io error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,46 @@
+package webdav
+
+import (
+	"flag"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/rootfs"
+	"github.com/buppyio/bpy/webdav"
+	"log"
+	"net/http"
+)
+
+func WebDAV() {
+	addrArg := flag.String("addr", "127.0.0.1:8080", "address to listen on")
+	flag.Parse()
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting key: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	f, err := rootfs.New(c, &k, func() (bpy.CStore, error) {
+		return common.GetCStore(cfg, &k, c)
+	})
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+	defer f.Close()
+
+	log.Printf("serving webdav on http://%s/\n", *addrArg)
+	err = http.ListenAndServe(*addrArg, webdav.NewHandler(f))
+	if err != nil {
+		common.Die("error serving webdav: %s\n", err.Error())
+	}
+}
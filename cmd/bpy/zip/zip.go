@@ -12,6 +12,7 @@ import (
 
 func Zip() {
 	srcArg := flag.String("src", "", "path to directory to ref")
+	jsonArg := flag.Bool("json", false, "write progress events to stderr as json lines")
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -56,7 +57,8 @@ func Zip() {
 		common.Die("'%s' is not a directory\n", *srcArg)
 	}
 
-	err = archive.Zip(store, dirEnt.HTree.Data, os.Stdout)
+	prog := common.StartProgress("zip", *jsonArg)
+	err = archive.Zip(store, dirEnt.HTree.Data, os.Stdout, prog)
 	if err != nil {
 		common.Die("error writing zip: %s\n", err.Error())
 	}
@@ -65,4 +67,5 @@ func Zip() {
 	if err != nil {
 		common.Die("error closing store: %s\n", err.Error())
 	}
+	prog.Finish()
 }
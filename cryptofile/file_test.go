@@ -20,6 +20,24 @@ type bufreader struct {
 
 func (b *bufreader) Close() error { return nil }
 
+// rangereader reads ranges like a remote file would.
+type rangereader struct {
+	bufreader
+}
+
+func (b *rangereader) ReadV(offsets []uint64, sizes []uint32) ([][]byte, error) {
+	bufs := make([][]byte, len(offsets))
+	for i := range offsets {
+		bufs[i] = make([]byte, sizes[i])
+		n, err := b.ReadAt(bufs[i], int64(offsets[i]))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		bufs[i] = bufs[i][:n]
+	}
+	return bufs, nil
+}
+
 type XorBlock struct {
 	BlockSz int
 }
@@ -119,6 +137,35 @@ func TestReadWrite(t *testing.T) {
 			if !reflect.DeepEqual(data, result) {
 				t.Fatalf("data differs: %v != %v", result, data)
 			}
+
+			offsets := make([]uint64, 5)
+			sizes := make([]uint32, 5)
+			for i := range offsets {
+				offsets[i] = uint64(random.Intn(len(data) + 1))
+				sizes[i] = uint32(random.Intn(len(data) + 1))
+			}
+			for _, f := range []ReadSeekCloser{
+				&bufreader{bytes.NewReader(buf.Bytes())},
+				&rangereader{bufreader{bytes.NewReader(buf.Bytes())}},
+			} {
+				rdr, err = NewReader(f, block, int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ranges, err := rdr.ReadV(offsets, sizes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range ranges {
+					end := offsets[i] + uint64(sizes[i])
+					if end > uint64(len(data)) {
+						end = uint64(len(data))
+					}
+					if !bytes.Equal(ranges[i], data[offsets[i]:end]) {
+						t.Fatalf("range %d differs: %v != %v", i, ranges[i], data[offsets[i]:end])
+					}
+				}
+			}
 		}
 	}
 
@@ -74,7 +74,6 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 	if int64(len(buf))%blocksz != 0 {
 		panic("bufsize not multiple of blocksize")
 	}
-	nblocks := int64(len(buf)) / blocksz
 
 	if idx*blocksz >= r.size {
 		return 0, io.EOF
@@ -94,6 +93,21 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 		return 0, err
 	}
 
+	buf = r.decryptBlocks(idx, buf)
+
+	if len(buf) == 0 {
+		return 0, io.EOF
+	}
+
+	return len(buf), nil
+}
+
+// decryptBlocks decrypts blocks starting at block idx in place,
+// removing the padding if they reach the end of the file.
+func (r *Reader) decryptBlocks(idx int64, buf []byte) []byte {
+	blocksz := int64(r.block.BlockSize())
+	nblocks := int64(len(buf)) / blocksz
+
 	r.ctr.Reset()
 	r.ctr.Add(uint64(idx))
 	for i := int64(0); i < nblocks; i++ {
@@ -103,7 +117,7 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 		r.ctr.Add(1)
 	}
 
-	if idx*blocksz+int64(len(buf)) == r.size {
+	if len(buf) != 0 && idx*blocksz+int64(len(buf)) == r.size {
 		for i := len(buf) - 1; ; i-- {
 			if buf[i] == 0x80 {
 				buf = buf[:i]
@@ -111,12 +125,77 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 			}
 		}
 	}
+	return buf
+}
 
-	if len(buf) == 0 {
-		return 0, io.EOF
+// RangeReader is implemented by files that can read many ranges in one request.
+type RangeReader interface {
+	ReadV(offsets []uint64, sizes []uint32) ([][]byte, error)
+}
+
+// ReadV reads and decrypts each range, in a single request if the underlying
+// file is a RangeReader. A range is short if the file ends within it.
+func (r *Reader) ReadV(offsets []uint64, sizes []uint32) ([][]byte, error) {
+	blocksz := uint64(r.block.BlockSize())
+	encOffsets := make([]uint64, len(offsets))
+	encSizes := make([]uint32, len(offsets))
+	for i := range offsets {
+		start := offsets[i] - offsets[i]%blocksz
+		end := offsets[i] + uint64(sizes[i])
+		if end%blocksz != 0 {
+			end += blocksz - end%blocksz
+		}
+		if end > uint64(r.size) {
+			end = uint64(r.size)
+		}
+		if start > end {
+			start = end
+		}
+		// The first block of the file is the IV.
+		encOffsets[i] = blocksz + start
+		encSizes[i] = uint32(end - start)
+	}
+
+	var bufs [][]byte
+	rv, ok := r.r.(RangeReader)
+	if ok {
+		var err error
+		bufs, err = rv.ReadV(encOffsets, encSizes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		bufs = make([][]byte, len(offsets))
+		for i := range encOffsets {
+			_, err := r.r.Seek(int64(encOffsets[i]), io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			bufs[i] = make([]byte, encSizes[i])
+			_, err = io.ReadFull(r.r, bufs[i])
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return len(buf), nil
+	for i, buf := range bufs {
+		if uint32(len(buf)) != encSizes[i] {
+			return nil, io.ErrUnexpectedEOF
+		}
+		idx := int64(encOffsets[i]/blocksz) - 1
+		buf = r.decryptBlocks(idx, buf)
+		shift := offsets[i] % blocksz
+		if shift > uint64(len(buf)) {
+			shift = uint64(len(buf))
+		}
+		buf = buf[shift:]
+		if uint64(len(buf)) > uint64(sizes[i]) {
+			buf = buf[:sizes[i]]
+		}
+		bufs[i] = buf
+	}
+	return bufs, nil
 }
 
 func (r *Reader) Read(buf []byte) (int, error) {
@@ -5,6 +5,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/rpc"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -84,6 +86,123 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func serveTest(l net.Listener, server *rpc.Server, secret string, accepted chan error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			err := Accept(conn, secret)
+			accepted <- err
+			if err == nil {
+				server.ServeConn(conn)
+			}
+			conn.Close()
+		}()
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cachtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewCache(filepath.Join(tempDir, "cache.db"), 0600, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	sockPath := filepath.Join(tempDir, "cache.sock")
+	err = ioutil.WriteFile(sockPath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixAddr := "unix:" + sockPath
+	l, err := Listen(unixAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	st, err := os.Stat(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Fatalf("socket has mode %s", st.Mode())
+	}
+	_, err = Listen(unixAddr)
+	if err == nil {
+		t.Fatal("expected an error listening twice")
+	}
+	server, err := NewServer(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan error, 10)
+	go serveTest(l, server, "", accepted)
+
+	conn, err := Dial(unixAddr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("hello"))
+	err = client.Put(hash, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, ok, err := client.Get(hash)
+	if err != nil || !ok || string(val) != "hello" {
+		t.Fatalf("bad get over unix socket: %q %v %v", val, ok, err)
+	}
+	conn.Close()
+	// The second Listen connected to check the socket is in use.
+	for i := 0; i < 2; i++ {
+		if err = <-accepted; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcpl, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpl.Close()
+	go serveTest(tcpl, server, "secret", accepted)
+	tcpAddr := tcpl.Addr().String()
+
+	_, err = Dial(tcpAddr, "wrong")
+	if err != ErrHandshakeFailed {
+		t.Fatalf("expected a failed handshake, got %v", err)
+	}
+	if err = <-accepted; err != ErrHandshakeFailed {
+		t.Fatalf("expected the daemon to reject the client, got %v", err)
+	}
+	conn, err = Dial(tcpAddr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, ok, err = client.Get(hash)
+	if err != nil || !ok || string(val) != "hello" {
+		t.Fatalf("bad get over tcp: %q %v %v", val, ok, err)
+	}
+}
+
 func BenchmarkCachePut(b *testing.B) {
 	r := rand.New(rand.NewSource(3453))
 	tempDir, err := ioutil.TempDir("", "cachtest")
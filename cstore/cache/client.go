@@ -6,12 +6,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/rpc"
+	"sync"
 )
 
+// Client is safe for concurrent use.
 type Client struct {
-	client   *rpc.Client
-	flatebuf bytes.Buffer
-	flatew   *flate.Writer
+	client *rpc.Client
+	lock   sync.Mutex
+	flatew *flate.Writer
 }
 
 func NewClient(rwc io.ReadWriteCloser) (*Client, error) {
@@ -33,14 +35,10 @@ func (c *Client) Get(hash [32]byte) ([]byte, bool, error) {
 	if !ok {
 		return nil, false, nil
 	}
-	rdr := flate.NewReader(bytes.NewBuffer(val))
-	c.flatebuf.Reset()
-	_, err = io.Copy(&c.flatebuf, rdr)
+	buf, err := ioutil.ReadAll(flate.NewReader(bytes.NewBuffer(val)))
 	if err != nil {
 		return nil, false, err
 	}
-	buf := make([]byte, c.flatebuf.Len(), c.flatebuf.Len())
-	copy(buf, c.flatebuf.Bytes())
 	return buf, true, nil
 }
 
@@ -51,19 +49,24 @@ func (c *Client) GetRaw(hash [32]byte) ([]byte, bool, error) {
 }
 
 func (c *Client) Put(hash [32]byte, val []byte) error {
-	c.flatebuf.Reset()
-	c.flatew.Reset(&c.flatebuf)
+	var flatebuf bytes.Buffer
+	c.lock.Lock()
+	c.flatew.Reset(&flatebuf)
 	_, err := c.flatew.Write(val)
-	if err != nil {
-		return err
+	if err == nil {
+		err = c.flatew.Close()
 	}
-	err = c.flatew.Close()
+	c.lock.Unlock()
 	if err != nil {
 		return err
 	}
-	return c.PutRaw(hash, c.flatebuf.Bytes())
+	return c.PutRaw(hash, flatebuf.Bytes())
 }
 
 func (c *Client) PutRaw(hash [32]byte, val []byte) error {
 	return c.client.Call("CacheServer.Put", TPut{Hash: hash, Val: val}, &RPut{})
 }
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
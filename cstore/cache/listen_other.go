@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package cache
+
+import (
+	"net"
+)
+
+// listenUnix relies on the permissions of the socket directory where
+// there is no umask.
+func listenUnix(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package cache
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+var umaskLock sync.Mutex
+
+// listenUnix creates the socket with the umask cleared for other users, so
+// it is never accessible to them, even before its mode is set. The umask
+// is process wide, files created meanwhile by other goroutines get it too.
+func listenUnix(address string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", address)
+}
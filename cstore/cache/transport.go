@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	nonceSize        = 32
+	handshakeTimeout = 10 * time.Second
+)
+
+var ErrHandshakeFailed = errors.New("cache handshake failed")
+
+// splitAddr returns the network and address of addr, addresses of the
+// form unix:PATH are unix sockets and anything else is a tcp address.
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", addr[len("unix:"):]
+	}
+	return "tcp", addr
+}
+
+// Listen listens on addr. Unix sockets are only accessible by the current
+// user, and a stale socket left by a daemon that exited is replaced.
+func Listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	conn, err := net.Dial(network, address)
+	if err == nil {
+		conn.Close()
+		return nil, errors.New("a cache daemon is already listening on " + address)
+	}
+	err = os.Remove(address)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := listenUnix(address)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(address, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Dial connects to the cache daemon at addr, see Accept.
+func Dial(addr, secret string) (net.Conn, error) {
+	conn, err := net.Dial(splitAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(conn, secret, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Accept authenticates a new connection to the daemon. Both ends of a unix
+// socket must belong to the same user, and if secret is not empty both
+// ends must prove they know it before any chunks are exchanged.
+func Accept(conn net.Conn, secret string) error {
+	return handshake(conn, secret, true)
+}
+
+func handshake(conn net.Conn, secret string, server bool) error {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		err := checkPeer(unixConn)
+		if err != nil {
+			return err
+		}
+	}
+	if secret == "" {
+		return nil
+	}
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+	if server {
+		err = serverHandshake(conn, []byte(secret))
+	} else {
+		err = clientHandshake(conn, []byte(secret))
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func handshakeMac(secret []byte, role string, serverNonce, clientNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(role))
+	mac.Write(serverNonce)
+	mac.Write(clientNonce)
+	return mac.Sum(nil)
+}
+
+func serverHandshake(conn net.Conn, secret []byte) error {
+	serverNonce := make([]byte, nonceSize)
+	_, err := io.ReadFull(rand.Reader, serverNonce)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(serverNonce)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, nonceSize+sha256.Size)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return ErrHandshakeFailed
+	}
+	clientNonce := buf[:nonceSize]
+	if !hmac.Equal(buf[nonceSize:], handshakeMac(secret, "client", serverNonce, clientNonce)) {
+		return ErrHandshakeFailed
+	}
+	_, err = conn.Write(handshakeMac(secret, "server", serverNonce, clientNonce))
+	return err
+}
+
+func clientHandshake(conn net.Conn, secret []byte) error {
+	serverNonce := make([]byte, nonceSize)
+	_, err := io.ReadFull(conn, serverNonce)
+	if err != nil {
+		return ErrHandshakeFailed
+	}
+	clientNonce := make([]byte, nonceSize)
+	_, err = io.ReadFull(rand.Reader, clientNonce)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(clientNonce, handshakeMac(secret, "client", serverNonce, clientNonce)...))
+	if err != nil {
+		return err
+	}
+	serverMac := make([]byte, sha256.Size)
+	_, err = io.ReadFull(conn, serverMac)
+	if err != nil || !hmac.Equal(serverMac, handshakeMac(secret, "server", serverNonce, clientNonce)) {
+		return ErrHandshakeFailed
+	}
+	return nil
+}
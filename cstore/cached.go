@@ -36,6 +36,39 @@ func (c *CachedCStore) Get(hash [32]byte) ([]byte, error) {
 	return v, nil
 }
 
+func (c *CachedCStore) GetMany(hashes [][32]byte) ([][]byte, error) {
+	vals := make([][]byte, len(hashes))
+	missing := [][32]byte{}
+	missingIdx := []int{}
+	for i, hash := range hashes {
+		v, ok, err := c.cache.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			vals[i] = v
+			continue
+		}
+		missing = append(missing, hash)
+		missingIdx = append(missingIdx, i)
+	}
+	if len(missing) == 0 {
+		return vals, nil
+	}
+	fetched, err := bpy.GetMany(c.store, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range fetched {
+		err = c.cache.Put(missing[i], v)
+		if err != nil {
+			return nil, err
+		}
+		vals[missingIdx[i]] = v
+	}
+	return vals, nil
+}
+
 func (c *CachedCStore) Put(val []byte) ([32]byte, error) {
 	hash, err := c.store.Put(val)
 	if err != nil {
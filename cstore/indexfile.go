@@ -0,0 +1,225 @@
+package cstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cryptofile"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Next to the packs directory, the indexes directory holds a standalone
+// encrypted copy of each pack index, and snapshots of all the pack indexes
+// at some point in time so a new client can learn them in a few requests.
+const (
+	PackExt      = ".ebpack"
+	IndexFileExt = ".eidx"
+	SnapshotExt  = ".esnap"
+)
+
+var ErrCorruptSnapshot = errors.New("corrupt index snapshot")
+
+// Guards against allocating huge buffers for a corrupt snapshot.
+const maxSnapshotIndexSize = 256 * 1024 * 1024
+
+// IndexFileName returns the name of the standalone index of a pack.
+func IndexFileName(packname string) string {
+	return strings.TrimSuffix(packname, PackExt) + IndexFileExt
+}
+
+func IsSnapshot(name string) bool {
+	return strings.HasSuffix(name, SnapshotExt)
+}
+
+// writeEncryptedFile uploads an encrypted file to the indexes directory,
+// nothing is stored if write fails.
+func writeEncryptedFile(store *client.Client, key [32]byte, name string, write func(w io.Writer) error) error {
+	f, err := store.NewPack(path.Join("indexes", name))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	bwc := &bpy.BufferedWriteCloser{
+		W: f,
+		B: bufio.NewWriterSize(f, 65536),
+	}
+	w, err := cryptofile.NewWriter(bwc, block)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	err = write(w)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	return w.Close()
+}
+
+func openEncryptedFile(store *client.Client, key [32]byte, name string, size uint64) (*cryptofile.Reader, error) {
+	f, err := store.Open(path.Join("indexes", name))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := cryptofile.NewReader(f, block, int64(size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// WriteIndexFile uploads the standalone index of a pack.
+func WriteIndexFile(store *client.Client, key [32]byte, packname string, idx bpack.Index) error {
+	return writeEncryptedFile(store, key, IndexFileName(packname), func(w io.Writer) error {
+		return bpack.WriteIndex(w, idx)
+	})
+}
+
+func readIndexFile(store *client.Client, key [32]byte, name string, size uint64) (bpack.Index, error) {
+	r, err := openEncryptedFile(store, key, name, size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return bpack.ReadIndex(r)
+}
+
+// WriteIndexSnapshot uploads a snapshot of the given pack indexes and returns its name.
+// Snapshot names sort by creation time.
+func WriteIndexSnapshot(store *client.Client, key [32]byte, indexes []PackIndex) (string, error) {
+	random, err := bpy.RandomFileName()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("snapshot-%016x-%s%s", time.Now().UnixNano(), random[:16], SnapshotExt)
+	err = writeEncryptedFile(store, key, name, func(w io.Writer) error {
+		return writeSnapshot(w, indexes)
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func writeSnapshot(w io.Writer, indexes []PackIndex) error {
+	var buf bytes.Buffer
+	err := binary.Write(w, binary.BigEndian, uint64(len(indexes)))
+	if err != nil {
+		return err
+	}
+	for _, pack := range indexes {
+		buf.Reset()
+		err = bpack.WriteIndex(&buf, pack.Idx)
+		if err != nil {
+			return err
+		}
+		hdr := make([]byte, 2+len(pack.Name)+16)
+		binary.BigEndian.PutUint16(hdr[0:2], uint16(len(pack.Name)))
+		copy(hdr[2:], pack.Name)
+		binary.BigEndian.PutUint64(hdr[2+len(pack.Name):], pack.Size)
+		binary.BigEndian.PutUint64(hdr[10+len(pack.Name):], uint64(buf.Len()))
+		_, err = w.Write(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshot(r io.Reader) ([]PackIndex, error) {
+	r = bufio.NewReaderSize(r, 65536)
+	var n uint64
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []PackIndex{}
+	for ; n != 0; n-- {
+		var namesz uint16
+		err = binary.Read(r, binary.BigEndian, &namesz)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, namesz)
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return nil, err
+		}
+		var sizes [2]uint64
+		err = binary.Read(r, binary.BigEndian, &sizes)
+		if err != nil {
+			return nil, err
+		}
+		if sizes[1] > maxSnapshotIndexSize {
+			return nil, ErrCorruptSnapshot
+		}
+		idxbuf := make([]byte, sizes[1])
+		_, err = io.ReadFull(r, idxbuf)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := bpack.ReadIndex(bytes.NewReader(idxbuf))
+		if err != nil {
+			return nil, ErrCorruptSnapshot
+		}
+		indexes = append(indexes, PackIndex{
+			Name: string(name),
+			Size: sizes[0],
+			Idx:  idx,
+		})
+	}
+	return indexes, nil
+}
+
+// latestSnapshot returns the newest snapshot in an index listing.
+func latestSnapshot(listing []remote.PackListing) (remote.PackListing, bool) {
+	snapshots := []remote.PackListing{}
+	for _, ent := range listing {
+		if IsSnapshot(ent.Name) {
+			snapshots = append(snapshots, ent)
+		}
+	}
+	if len(snapshots) == 0 {
+		return remote.PackListing{}, false
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots[len(snapshots)-1], true
+}
+
+func readLatestSnapshot(store *client.Client, key [32]byte, listing []remote.PackListing) ([]PackIndex, error) {
+	snapshot, ok := latestSnapshot(listing)
+	if !ok {
+		return nil, nil
+	}
+	r, err := openEncryptedFile(store, key, snapshot.Name, snapshot.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readSnapshot(r)
+}
@@ -58,37 +58,110 @@ func cleanOldIndexes(packs []remote.PackListing, cachepath string) error {
 	return nil
 }
 
-func readAndCacheMetaIndex(store *client.Client, key [32]byte, cachepath string) (metaIndex, error) {
+type PackIndex struct {
+	Name string
+	Size uint64
+	Idx  bpack.Index
+}
+
+// ReadPackIndexes returns the index of every remote pack, fetching
+// indexes missing from the local index cache at cachepath.
+//
+// When several indexes are missing the latest index snapshot is used,
+// remaining indexes are read from the standalone index files, or from
+// the pack itself for packs without one.
+func ReadPackIndexes(store *client.Client, key [32]byte, cachepath string) ([]PackIndex, error) {
 	listing, err := remote.ListPacks(store)
 	if err != nil {
 		return nil, err
 	}
+	idxListing, err := remote.ListIndexes(store)
+	if err != nil {
+		return nil, err
+	}
+
+	packs := []remote.PackListing{}
+	for _, ent := range listing {
+		if strings.HasSuffix(ent.Name, PackExt) {
+			packs = append(packs, ent)
+		}
+	}
+	idxFiles := make(map[string]remote.PackListing)
+	for _, ent := range idxListing {
+		if strings.HasSuffix(ent.Name, IndexFileExt) {
+			idxFiles[ent.Name] = ent
+		}
+	}
 
-	err = cleanOldIndexes(listing, cachepath)
+	err = cleanOldIndexes(packs, cachepath)
 	if err != nil {
 		return nil, err
 	}
 
-	midx := make(metaIndex)
-	for _, pack := range listing {
-		idx, err := getAndCacheIndex(store, key, pack.Name, pack.Size, cachepath)
+	missing := make(map[string]uint64)
+	for _, pack := range packs {
+		_, err := os.Stat(filepath.Join(cachepath, pack.Name+".index"))
+		if os.IsNotExist(err) {
+			missing[pack.Name] = pack.Size
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) > 1 {
+		// The snapshot is only a shortcut, a gc may have just removed it.
+		snapshot, err := readLatestSnapshot(store, key, idxListing)
+		if err != nil {
+			snapshot = nil
+		}
+		for _, pack := range snapshot {
+			size, ok := missing[pack.Name]
+			if !ok || size != pack.Size {
+				continue
+			}
+			err = cacheIndex(filepath.Join(cachepath, pack.Name+".index"), pack.Idx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	indexes := make([]PackIndex, 0, len(packs))
+	for _, pack := range packs {
+		idx, err := getAndCacheIndex(store, key, pack, idxFiles, cachepath)
 		if err != nil {
 			return nil, err
 		}
-		info := &packInfo{
+		indexes = append(indexes, PackIndex{
 			Name: pack.Name,
 			Size: pack.Size,
 			Idx:  idx,
+		})
+	}
+	return indexes, nil
+}
+
+func readAndCacheMetaIndex(store *client.Client, key [32]byte, cachepath string) (metaIndex, error) {
+	indexes, err := ReadPackIndexes(store, key, cachepath)
+	if err != nil {
+		return nil, err
+	}
+
+	midx := make(metaIndex)
+	for _, pack := range indexes {
+		info := &packInfo{
+			Name: pack.Name,
+			Size: pack.Size,
+			Idx:  pack.Idx,
 		}
-		for i := range idx {
-			midx[idx[i].Key] = info
+		for i := range pack.Idx {
+			midx[pack.Idx[i].Key] = info
 		}
 	}
 	return midx, nil
 }
 
-func getAndCacheIndex(store *client.Client, key [32]byte, packname string, packsize uint64, cachepath string) (bpack.Index, error) {
-	idxpath := filepath.Join(cachepath, packname+".index")
+func getAndCacheIndex(store *client.Client, key [32]byte, pack remote.PackListing, idxFiles map[string]remote.PackListing, cachepath string) (bpack.Index, error) {
+	idxpath := filepath.Join(cachepath, pack.Name+".index")
 	_, err := os.Stat(idxpath)
 	if err == nil {
 		f, err := os.Open(idxpath)
@@ -101,6 +174,24 @@ func getAndCacheIndex(store *client.Client, key [32]byte, packname string, packs
 	if !os.IsNotExist(err) {
 		return nil, err
 	}
+	var idx bpack.Index
+	idxFile, ok := idxFiles[IndexFileName(pack.Name)]
+	if ok {
+		idx, err = readIndexFile(store, key, idxFile.Name, idxFile.Size)
+	} else {
+		idx, err = readPackTrailer(store, key, pack.Name, pack.Size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = cacheIndex(idxpath, idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func readPackTrailer(store *client.Client, key [32]byte, packname string, packsize uint64) (bpack.Index, error) {
 	packPath := path.Join("packs", packname)
 	f, err := store.Open(packPath)
 	if err != nil {
@@ -115,10 +206,6 @@ func getAndCacheIndex(store *client.Client, key [32]byte, packname string, packs
 	if err != nil {
 		return nil, err
 	}
-	err = cacheIndex(idxpath, pack.Idx)
-	if err != nil {
-		return nil, err
-	}
 	return pack.Idx, nil
 }
 
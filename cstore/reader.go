@@ -9,126 +9,473 @@ import (
 	"github.com/buppyio/bpy/remote/client"
 	"io"
 	"path"
+	"sort"
 	"sync"
 )
 
-var NotFound = errors.New("hash not in cstore")
+var (
+	NotFound        = errors.New("hash not in cstore")
+	ErrReaderClosed = errors.New("cstore reader closed")
+)
+
+// ReaderOptions controls how a Reader fetches chunks from the remote.
+type ReaderOptions struct {
+	// PackReaders is the most pack files kept open at once,
+	// each concurrent Get needs one of its own.
+	PackReaders int
+	// ReadAhead is how many bytes are read when a Get continues on from
+	// the previous read of the same pack, the extra data serves the
+	// following Gets of a sequential htree traversal.
+	ReadAhead int
+	// CoalesceGap is the largest gap between chunks of a pack that
+	// GetMany reads over rather than requesting them separately.
+	CoalesceGap int
+}
+
+var DefaultReaderOptions = ReaderOptions{
+	PackReaders: 16,
+	ReadAhead:   1024 * 1024,
+	CoalesceGap: 64 * 1024,
+}
 
 type packlruent struct {
 	packname string
 	pack     *bpack.Reader
 }
 
+// packWindow is the data read ahead from a pack.
+type packWindow struct {
+	packname string
+	// end is the end of the chunk data in the pack.
+	end uint64
+	// next is the offset following the last chunk read.
+	next uint64
+	off  uint64
+	data []byte
+}
+
+// Reader is safe for concurrent use, Gets only wait for each other
+// when all pack readers are busy.
 type Reader struct {
-	lock      sync.Mutex
 	store     *client.Client
 	cachepath string
-	midx      metaIndex
-	lru       *list.List
 	key       [32]byte
-	flatebuf  bytes.Buffer
+	opts      ReaderOptions
+
+	// reloadLock is held while fetching a new meta index so concurrent
+	// misses wait for one fetch instead of each starting their own.
+	reloadLock sync.Mutex
+	midxLock   sync.RWMutex
+	midx       metaIndex
+	midxGen    uint64
+
+	poolLock sync.Mutex
+	poolCond *sync.Cond
+	idle     *list.List
+	open     int
+	closed   bool
+
+	windowLock sync.Mutex
+	windows    *list.List
 }
 
-func NewReader(store *client.Client, key [32]byte, cachepath string) (*Reader, error) {
+func NewReader(store *client.Client, key [32]byte, cachepath string, opts ReaderOptions) (*Reader, error) {
 	midx, err := readAndCacheMetaIndex(store, key, cachepath)
 	if err != nil {
 		return nil, err
 	}
-	return &Reader{
+	if opts.PackReaders < 1 {
+		opts.PackReaders = 1
+	}
+	r := &Reader{
 		midx:      midx,
-		lru:       list.New(),
+		idle:      list.New(),
+		windows:   list.New(),
 		store:     store,
 		cachepath: cachepath,
 		key:       key,
-	}, nil
+		opts:      opts,
+	}
+	r.poolCond = sync.NewCond(&r.poolLock)
+	return r, nil
 }
 
 func (r *Reader) Has(hash [32]byte) (bool, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	r.midxLock.RLock()
+	defer r.midxLock.RUnlock()
 	_, _, ok := searchMetaIndex(r.midx, hash)
 	return ok, nil
 }
 
 func (r *Reader) Get(hash [32]byte) ([]byte, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	packInfo, packidxent, err := r.lookup(hash)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := r.readChunk(packInfo, packidxent)
+	if err != nil {
+		return nil, err
+	}
+	return inflate(buf)
+}
 
-	packInfo, packidxent, ok := searchMetaIndex(r.midx, hash)
-	if !ok {
-		midx, err := readAndCacheMetaIndex(r.store, r.key, r.cachepath)
+type chunkRead struct {
+	i   int
+	ent bpack.IndexEnt
+}
+
+type offsetSortedReads []chunkRead
+
+func (reads offsetSortedReads) Len() int      { return len(reads) }
+func (reads offsetSortedReads) Swap(i, j int) { reads[i], reads[j] = reads[j], reads[i] }
+func (reads offsetSortedReads) Less(i, j int) bool {
+	return reads[i].ent.Offset < reads[j].ent.Offset
+}
+
+// GetMany fetches the chunks with one request per pack,
+// reading nearby chunks of a pack as a single range.
+func (r *Reader) GetMany(hashes [][32]byte) ([][]byte, error) {
+	vals := make([][]byte, len(hashes))
+	packs := make(map[*packInfo][]chunkRead)
+	for i, hash := range hashes {
+		packInfo, packidxent, err := r.lookup(hash)
+		if err != nil {
+			return nil, err
+		}
+		buf, ok := r.windowed(packInfo, packidxent)
+		if ok {
+			vals[i] = buf
+			continue
+		}
+		packs[packInfo] = append(packs[packInfo], chunkRead{i: i, ent: packidxent})
+	}
+	for packInfo, reads := range packs {
+		err := r.readChunks(packInfo, reads, vals)
 		if err != nil {
 			return nil, err
 		}
-		r.midx = midx
-		packInfo, packidxent, ok = searchMetaIndex(r.midx, hash)
-		if !ok {
-			return nil, NotFound
+	}
+	for i := range vals {
+		val, err := inflate(vals[i])
+		if err != nil {
+			return nil, err
 		}
+		vals[i] = val
 	}
+	return vals, nil
+}
 
-	packrdr, err := r.getPackReader(packInfo.Name, packInfo.Size, packInfo.Idx)
+// readChunks reads the compressed chunks of a pack into vals.
+func (r *Reader) readChunks(packInfo *packInfo, reads []chunkRead, vals [][]byte) error {
+	sort.Sort(offsetSortedReads(reads))
+	offsets := []uint64{}
+	sizes := []uint32{}
+	rangeOf := make([]int, len(reads))
+	for i, read := range reads {
+		end := read.ent.Offset + uint64(read.ent.Size)
+		last := len(offsets) - 1
+		if last >= 0 {
+			lastEnd := offsets[last] + uint64(sizes[last])
+			if read.ent.Offset <= lastEnd+uint64(r.opts.CoalesceGap) {
+				if end > lastEnd {
+					sizes[last] = uint32(end - offsets[last])
+				}
+				rangeOf[i] = last
+				continue
+			}
+		}
+		offsets = append(offsets, read.ent.Offset)
+		sizes = append(sizes, read.ent.Size)
+		rangeOf[i] = len(offsets) - 1
+	}
+
+	packrdr, err := r.acquire(packInfo)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	bufs, err := packrdr.GetAtV(offsets, sizes)
+	if err != nil {
+		r.discard(packrdr)
+		return err
+	}
+	r.release(packInfo.Name, packrdr)
+
+	for i, read := range reads {
+		start := read.ent.Offset - offsets[rangeOf[i]]
+		vals[read.i] = bufs[rangeOf[i]][start : start+uint64(read.ent.Size)]
+	}
+	return nil
+}
+
+// reload rereads the meta index, picking up packs written since the reader was created.
+func (r *Reader) reload() error {
+	r.midxLock.RLock()
+	gen := r.midxGen
+	r.midxLock.RUnlock()
+	return r.reloadFrom(gen, true)
+}
+
+// reloadFrom rereads the meta index unless another reload finished after
+// generation gen was read, in which case force must be set to read it again.
+// Lookups keep using the old index while the new one is fetched.
+func (r *Reader) reloadFrom(gen uint64, force bool) error {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+	r.midxLock.RLock()
+	reloaded := r.midxGen != gen
+	r.midxLock.RUnlock()
+	if reloaded && !force {
+		return nil
+	}
+	midx, err := readAndCacheMetaIndex(r.store, r.key, r.cachepath)
+	if err != nil {
+		return err
+	}
+	r.midxLock.Lock()
+	r.midx = midx
+	r.midxGen += 1
+	r.midxLock.Unlock()
+	return nil
+}
+
+func (r *Reader) lookup(hash [32]byte) (*packInfo, bpack.IndexEnt, error) {
+	r.midxLock.RLock()
+	packInfo, packidxent, ok := searchMetaIndex(r.midx, hash)
+	gen := r.midxGen
+	r.midxLock.RUnlock()
+	if ok {
+		return packInfo, packidxent, nil
+	}
+
+	// Another Get may have reloaded the index while we waited.
+	err := r.reloadFrom(gen, false)
+	if err != nil {
+		return nil, bpack.IndexEnt{}, err
+	}
+	r.midxLock.RLock()
+	packInfo, packidxent, ok = searchMetaIndex(r.midx, hash)
+	r.midxLock.RUnlock()
+	if !ok {
+		return nil, bpack.IndexEnt{}, NotFound
 	}
-	buf, err := packrdr.GetAt(packidxent.Offset, packidxent.Size)
+	return packInfo, packidxent, nil
+}
+
+var inflaters sync.Pool
+
+func inflate(buf []byte) ([]byte, error) {
+	var out bytes.Buffer
+
+	compressedr, ok := inflaters.Get().(io.ReadCloser)
+	if ok {
+		err := compressedr.(flate.Resetter).Reset(bytes.NewReader(buf), nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		compressedr = flate.NewReader(bytes.NewReader(buf))
+	}
+	out.Grow(2 * len(buf))
+	_, err := io.Copy(&out, compressedr)
 	if err != nil {
 		return nil, err
 	}
-	bufrdr := bytes.NewReader(buf)
-	compressedr := flate.NewReader(bufrdr)
+	err = compressedr.Close()
 	if err != nil {
 		return nil, err
 	}
-	r.flatebuf.Reset()
-	_, err = io.Copy(&r.flatebuf, compressedr)
+	inflaters.Put(compressedr)
+	return out.Bytes(), nil
+}
+
+func (r *Reader) readChunk(packInfo *packInfo, ent bpack.IndexEnt) ([]byte, error) {
+	buf, n := r.planRead(packInfo, ent)
+	if buf != nil {
+		return buf, nil
+	}
+	packrdr, err := r.acquire(packInfo)
 	if err != nil {
 		return nil, err
 	}
-	err = compressedr.Close()
+	buf, err = packrdr.GetAt(ent.Offset, n)
 	if err != nil {
+		r.discard(packrdr)
 		return nil, err
 	}
-	decompressed := make([]byte, r.flatebuf.Len(), r.flatebuf.Len())
-	copy(decompressed, r.flatebuf.Bytes())
-	return decompressed, nil
+	r.release(packInfo.Name, packrdr)
+	if n > ent.Size {
+		r.setWindow(packInfo, ent.Offset, buf)
+	}
+	return buf[:ent.Size], nil
 }
 
-func (r *Reader) getPackReader(packname string, packsize uint64, idx bpack.Index) (*bpack.Reader, error) {
-	for e := r.lru.Front(); e != nil; e = e.Next() {
-		ent := e.Value.(packlruent)
-		if ent.packname == packname {
-			r.lru.MoveToFront(e)
-			return ent.pack, nil
+// getWindow must be called with windowLock held.
+func (r *Reader) getWindow(packInfo *packInfo) *packWindow {
+	for e := r.windows.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*packWindow)
+		if w.packname == packInfo.Name {
+			r.windows.MoveToFront(e)
+			return w
+		}
+	}
+	w := &packWindow{packname: packInfo.Name}
+	for _, ent := range packInfo.Idx {
+		if ent.Offset+uint64(ent.Size) > w.end {
+			w.end = ent.Offset + uint64(ent.Size)
+		}
+	}
+	r.windows.PushFront(w)
+	if r.windows.Len() > r.opts.PackReaders {
+		r.windows.Remove(r.windows.Back())
+	}
+	return w
+}
+
+// inWindow must be called with windowLock held.
+func inWindow(w *packWindow, ent bpack.IndexEnt) ([]byte, bool) {
+	end := ent.Offset + uint64(ent.Size)
+	if ent.Offset >= w.off && end <= w.off+uint64(len(w.data)) {
+		start := ent.Offset - w.off
+		return w.data[start : start+uint64(ent.Size)], true
+	}
+	return nil, false
+}
+
+// windowed returns the chunk if it was read ahead.
+func (r *Reader) windowed(packInfo *packInfo, ent bpack.IndexEnt) ([]byte, bool) {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+	return inWindow(r.getWindow(packInfo), ent)
+}
+
+// planRead returns the chunk if it was read ahead, otherwise how many
+// bytes to read from the start of the chunk.
+func (r *Reader) planRead(packInfo *packInfo, ent bpack.IndexEnt) ([]byte, uint32) {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+
+	w := r.getWindow(packInfo)
+	sequential := ent.Offset == w.next
+	w.next = ent.Offset + uint64(ent.Size)
+	buf, ok := inWindow(w, ent)
+	if ok {
+		return buf, 0
+	}
+	n := uint64(ent.Size)
+	if sequential && uint64(r.opts.ReadAhead) > n {
+		n = uint64(r.opts.ReadAhead)
+		if ent.Offset+n > w.end {
+			n = w.end - ent.Offset
 		}
 	}
-	packPath := path.Join("packs", packname)
-	f, err := r.store.Open(packPath)
+	return nil, uint32(n)
+}
+
+func (r *Reader) setWindow(packInfo *packInfo, off uint64, data []byte) {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+	w := r.getWindow(packInfo)
+	w.off = off
+	w.data = data
+}
+
+// acquire takes an idle reader of the pack from the pool, or opens a
+// new one, closing the least recently used idle reader if the pool is full.
+func (r *Reader) acquire(packInfo *packInfo) (*bpack.Reader, error) {
+	var evicted *bpack.Reader
+
+	r.poolLock.Lock()
+	for {
+		if r.closed {
+			r.poolLock.Unlock()
+			return nil, ErrReaderClosed
+		}
+		for e := r.idle.Front(); e != nil; e = e.Next() {
+			ent := e.Value.(packlruent)
+			if ent.packname == packInfo.Name {
+				r.idle.Remove(e)
+				r.poolLock.Unlock()
+				return ent.pack, nil
+			}
+		}
+		if r.open < r.opts.PackReaders {
+			r.open += 1
+			break
+		}
+		if r.idle.Len() != 0 {
+			evicted = r.idle.Remove(r.idle.Back()).(packlruent).pack
+			break
+		}
+		r.poolCond.Wait()
+	}
+	r.poolLock.Unlock()
+
+	if evicted != nil {
+		evicted.Close()
+	}
+	pack, err := r.openPack(packInfo)
 	if err != nil {
+		r.poolLock.Lock()
+		r.open -= 1
+		r.poolCond.Signal()
+		r.poolLock.Unlock()
 		return nil, err
 	}
-	pack, err := bpack.NewEncryptedReader(f, r.key, int64(packsize))
+	return pack, nil
+}
+
+func (r *Reader) openPack(packInfo *packInfo) (*bpack.Reader, error) {
+	f, err := r.store.Open(path.Join("packs", packInfo.Name))
 	if err != nil {
 		return nil, err
 	}
-	pack.Idx = idx
-	r.lru.PushFront(packlruent{packname: packname, pack: pack})
-	if r.lru.Len() > 5 {
-		ent := r.lru.Remove(r.lru.Back()).(packlruent)
-		ent.pack.Close()
+	pack, err := bpack.NewEncryptedReader(f, r.key, int64(packInfo.Size))
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
+	pack.Idx = packInfo.Idx
 	return pack, nil
 }
 
+func (r *Reader) release(packname string, pack *bpack.Reader) {
+	r.poolLock.Lock()
+	if r.closed {
+		r.open -= 1
+		r.poolLock.Unlock()
+		pack.Close()
+		return
+	}
+	r.idle.PushFront(packlruent{packname: packname, pack: pack})
+	r.poolCond.Signal()
+	r.poolLock.Unlock()
+}
+
+// discard closes a reader that failed rather than returning it to the pool.
+func (r *Reader) discard(pack *bpack.Reader) {
+	r.poolLock.Lock()
+	r.open -= 1
+	r.poolCond.Signal()
+	r.poolLock.Unlock()
+	pack.Close()
+}
+
 func (r *Reader) Close() error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	for e := r.lru.Front(); e != nil; e = e.Next() {
+	r.poolLock.Lock()
+	r.closed = true
+	idle := r.idle
+	r.open -= idle.Len()
+	r.idle = list.New()
+	r.poolCond.Broadcast()
+	r.poolLock.Unlock()
+
+	var err error
+	for e := idle.Front(); e != nil; e = e.Next() {
 		ent := e.Value.(packlruent)
-		err := ent.pack.Close()
-		if err != nil {
-			return err
+		cerr := ent.pack.Close()
+		if err == nil {
+			err = cerr
 		}
 	}
-	return nil
+	return err
 }
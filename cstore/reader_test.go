@@ -0,0 +1,437 @@
+package cstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/server"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// delayConn delivers each write after a fixed latency without
+// serializing them, like a network link, and counts the writes.
+type delayConn struct {
+	net.Conn
+	latency time.Duration
+	writes  int64
+	pending chan delayedWrite
+	closed  sync.Once
+}
+
+type delayedWrite struct {
+	at  time.Time
+	buf []byte
+}
+
+func newDelayConn(conn net.Conn, latency time.Duration) *delayConn {
+	c := &delayConn{
+		Conn:    conn,
+		latency: latency,
+		pending: make(chan delayedWrite, 4096),
+	}
+	go func() {
+		for w := range c.pending {
+			time.Sleep(w.at.Sub(time.Now()))
+			_, err := c.Conn.Write(w.buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *delayConn) Write(buf []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	c.pending <- delayedWrite{at: time.Now().Add(c.latency), buf: append([]byte(nil), buf...)}
+	return len(buf), nil
+}
+
+func (c *delayConn) Close() error {
+	c.closed.Do(func() { close(c.pending) })
+	return c.Conn.Close()
+}
+
+type testStore struct {
+	tmp    string
+	k      bpy.Key
+	srv    *server.Server
+	hashes [][32]byte
+	data   map[[32]byte][]byte
+}
+
+// newTestStore writes chunks random chunks of size bytes to each of npacks packs.
+func newTestStore(tb testing.TB, npacks, chunks, size int) *testStore {
+	tmp, err := ioutil.TempDir("", "bpycstoretest")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	k, err := bpy.NewKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(tmp, "remote"), 0700)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &testStore{
+		tmp:  tmp,
+		k:    k,
+		srv:  server.NewServer(filepath.Join(tmp, "remote")),
+		data: make(map[[32]byte][]byte),
+	}
+	c, _ := s.attach(tb, 0)
+	defer c.Close()
+	rd := rand.New(rand.NewSource(1234))
+	for i := 0; i < npacks; i++ {
+		w, err := NewWriter(c, k.CipherKey, s.cachepath(tb), DefaultReaderOptions, nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for j := 0; j < chunks; j++ {
+			data := make([]byte, size)
+			_, err = io.ReadFull(rd, data)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			hash, err := w.Put(data)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			s.hashes = append(s.hashes, hash)
+			s.data[hash] = data
+		}
+		err = w.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return s
+}
+
+func (s *testStore) cachepath(tb testing.TB) string {
+	cachepath, err := ioutil.TempDir(s.tmp, "icache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cachepath
+}
+
+func (s *testStore) attach(tb testing.TB, latency time.Duration) (*client.Client, *delayConn) {
+	clientConn, serverConn := net.Pipe()
+	go s.srv.ServeConn(serverConn)
+	conn := newDelayConn(clientConn, latency)
+	c, err := client.Attach(conn, hex.EncodeToString(s.k.Id[:]))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c, conn
+}
+
+func (s *testStore) reader(tb testing.TB, c *client.Client, opts ReaderOptions) *Reader {
+	r, err := NewReader(c, s.k.CipherKey, s.cachepath(tb), opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+func (s *testStore) check(tb testing.TB, r *Reader, hash [32]byte) {
+	data, err := r.Get(hash)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(data, s.data[hash]) {
+		tb.Fatalf("chunk %x differs", hash)
+	}
+}
+
+func TestReaderParallelGet(t *testing.T) {
+	s := newTestStore(t, 6, 50, 10000)
+	defer os.RemoveAll(s.tmp)
+
+	for _, opts := range []ReaderOptions{
+		{PackReaders: 1},
+		{PackReaders: 4, ReadAhead: 32 * 1024},
+		DefaultReaderOptions,
+	} {
+		c, _ := s.attach(t, 0)
+		r := s.reader(t, c, opts)
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rd := rand.New(rand.NewSource(seed))
+				for j := 0; j < 100; j++ {
+					hash := s.hashes[rd.Intn(len(s.hashes))]
+					data, err := r.Get(hash)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(data, s.data[hash]) {
+						t.Errorf("chunk %x differs", hash)
+						return
+					}
+				}
+			}(int64(i))
+		}
+		wg.Wait()
+		err := r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Get(s.hashes[0])
+		if err != ErrReaderClosed {
+			t.Fatalf("expected closed reader, got %v", err)
+		}
+		c.Close()
+	}
+}
+
+func TestReaderLookupDuringReload(t *testing.T) {
+	s := newTestStore(t, 1, 10, 1000)
+	defer os.RemoveAll(s.tmp)
+
+	c, _ := s.attach(t, 200*time.Millisecond)
+	defer c.Close()
+	r := s.reader(t, c, DefaultReaderOptions)
+	defer r.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Get([32]byte{})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	ok, err := r.Has(s.hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("missing chunk")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("lookup waited %s for the index to reload", time.Since(start))
+	}
+	err = <-done
+	if err != NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+func TestReaderReadAhead(t *testing.T) {
+	s := newTestStore(t, 1, 100, 10000)
+	defer os.RemoveAll(s.tmp)
+
+	writes := make(map[int]int64)
+	for _, readAhead := range []int{0, 64 * 1024} {
+		c, conn := s.attach(t, 0)
+		r := s.reader(t, c, ReaderOptions{PackReaders: 1, ReadAhead: readAhead})
+		before := atomic.LoadInt64(&conn.writes)
+		for _, hash := range s.hashes {
+			s.check(t, r, hash)
+		}
+		writes[readAhead] = atomic.LoadInt64(&conn.writes) - before
+		r.Close()
+		c.Close()
+	}
+	if writes[64*1024]*4 > writes[0] {
+		t.Fatalf("read ahead did not reduce requests: %v", writes)
+	}
+}
+
+func TestReaderGetMany(t *testing.T) {
+	s := newTestStore(t, 3, 100, 10000)
+	defer os.RemoveAll(s.tmp)
+
+	rd := rand.New(rand.NewSource(99))
+	hashes := [][32]byte{}
+	for i := 0; i < 150; i++ {
+		hashes = append(hashes, s.hashes[rd.Intn(len(s.hashes))])
+	}
+	for _, gap := range []int{0, DefaultReaderOptions.CoalesceGap} {
+		c, conn := s.attach(t, 0)
+		r := s.reader(t, c, ReaderOptions{PackReaders: 2, CoalesceGap: gap})
+		before := atomic.LoadInt64(&conn.writes)
+		vals, err := r.GetMany(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Opening a pack takes three requests, then one read and
+		// maybe a close when the pool evicts it.
+		if n := atomic.LoadInt64(&conn.writes) - before; n > 3*5 {
+			t.Fatalf("gap=%d: %d requests", gap, n)
+		}
+		for i, hash := range hashes {
+			if !bytes.Equal(vals[i], s.data[hash]) {
+				t.Fatalf("gap=%d: chunk %x differs", gap, hash)
+			}
+		}
+		r.Close()
+		c.Close()
+	}
+}
+
+func benchmarkGet(b *testing.B, parallelism int) {
+	s := newTestStore(b, 4, 64, 16*1024)
+	defer os.RemoveAll(s.tmp)
+	c, _ := s.attach(b, time.Millisecond)
+	defer c.Close()
+	r := s.reader(b, c, ReaderOptions{PackReaders: parallelism})
+	defer r.Close()
+
+	b.SetBytes(16 * 1024)
+	b.ResetTimer()
+	var next int64
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rd := rand.New(rand.NewSource(seed))
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				_, err := r.Get(s.hashes[rd.Intn(len(s.hashes))])
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallel-%d", parallelism), func(b *testing.B) {
+			benchmarkGet(b, parallelism)
+		})
+	}
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	s := newTestStore(b, 1, 256, 16*1024)
+	defer os.RemoveAll(s.tmp)
+	c, _ := s.attach(b, time.Millisecond)
+	defer c.Close()
+	r := s.reader(b, c, DefaultReaderOptions)
+	defer r.Close()
+
+	b.SetBytes(16 * 1024 * 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := (i * 16) % (len(s.hashes) - 16)
+		_, err := r.GetMany(s.hashes[start : start+16])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSequentialGet(b *testing.B) {
+	s := newTestStore(b, 1, 256, 16*1024)
+	defer os.RemoveAll(s.tmp)
+	c, _ := s.attach(b, time.Millisecond)
+	defer c.Close()
+
+	for _, readAhead := range []int{0, DefaultReaderOptions.ReadAhead} {
+		b.Run(fmt.Sprintf("readahead-%d", readAhead), func(b *testing.B) {
+			cachepath := s.cachepath(b)
+			b.SetBytes(16 * 1024)
+			for i := 0; i < b.N; {
+				r, err := NewReader(c, s.k.CipherKey, cachepath, ReaderOptions{PackReaders: 1, ReadAhead: readAhead})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, hash := range s.hashes {
+					if i == b.N {
+						break
+					}
+					_, err := r.Get(hash)
+					if err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestReadPackIndexes(t *testing.T) {
+	s := newTestStore(t, 4, 20, 1000)
+	defer os.RemoveAll(s.tmp)
+
+	indexesDir := filepath.Join(s.tmp, "remote", hex.EncodeToString(s.k.Id[:]), "indexes")
+	idxFiles, err := filepath.Glob(filepath.Join(indexesDir, "*"+IndexFileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idxFiles) != 4 {
+		t.Fatalf("expected 4 index files, got %d", len(idxFiles))
+	}
+
+	bootstrap := func() int64 {
+		c, conn := s.attach(t, 0)
+		defer c.Close()
+		before := atomic.LoadInt64(&conn.writes)
+		indexes, err := ReadPackIndexes(c, s.k.CipherKey, s.cachepath(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := atomic.LoadInt64(&conn.writes) - before
+		if len(indexes) != 4 {
+			t.Fatalf("expected 4 packs, got %d", len(indexes))
+		}
+		r := s.reader(t, c, DefaultReaderOptions)
+		defer r.Close()
+		for _, hash := range s.hashes {
+			s.check(t, r, hash)
+		}
+		return n
+	}
+
+	withIdxFiles := bootstrap()
+
+	c, _ := s.attach(t, 0)
+	indexes, err := ReadPackIndexes(c, s.k.CipherKey, s.cachepath(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WriteIndexSnapshot(c, s.k.CipherKey, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	withSnapshot := bootstrap()
+	if withSnapshot >= withIdxFiles {
+		t.Fatalf("snapshot did not reduce requests: %d >= %d", withSnapshot, withIdxFiles)
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(indexesDir, "*"+SnapshotExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range append(idxFiles, snapshots...) {
+		err = os.Remove(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bootstrap()
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/progress"
 	"github.com/buppyio/bpy/remote/client"
 	"io/ioutil"
 	"path/filepath"
@@ -25,10 +26,12 @@ type Writer struct {
 	flatebuf     bytes.Buffer
 	flatew       *flate.Writer
 	rdr          *Reader
+	prog         *progress.Progress
 }
 
-func NewWriter(store *client.Client, key [32]byte, cachepath string) (*Writer, error) {
-	rdr, err := NewReader(store, key, cachepath)
+// opts configures reads of chunks not written by this writer, prog may be nil.
+func NewWriter(store *client.Client, key [32]byte, cachepath string, opts ReaderOptions, prog *progress.Progress) (*Writer, error) {
+	rdr, err := NewReader(store, key, cachepath, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +48,7 @@ func NewWriter(store *client.Client, key [32]byte, cachepath string) (*Writer, e
 		flatew:     flatew,
 		rdr:        rdr,
 		workingSet: make(map[string][]byte),
+		prog:       prog,
 	}, nil
 }
 
@@ -64,24 +68,55 @@ func (w *Writer) flushWorkingSet() error {
 		if err != nil {
 			return err
 		}
+		name := w.name
 		w.pack = nil
 		w.name = ""
 		w.workingSetSz = 0
 		w.workingSet = make(map[string][]byte)
+		return WriteIndexFile(w.store, w.key, name, idx)
 	}
 	return nil
 }
 
 func (w *Writer) Get(hash [32]byte) ([]byte, error) {
 	w.lock.Lock()
-	defer w.lock.Unlock()
 	val, ok := w.workingSet[string(hash[:])]
+	w.lock.Unlock()
 	if ok {
 		return val, nil
 	}
+	// The reader is safe for concurrent use, so reads don't wait on writes.
 	return w.rdr.Get(hash)
 }
 
+func (w *Writer) GetMany(hashes [][32]byte) ([][]byte, error) {
+	vals := make([][]byte, len(hashes))
+	missing := [][32]byte{}
+	missingIdx := []int{}
+	w.lock.Lock()
+	for i, hash := range hashes {
+		val, ok := w.workingSet[string(hash[:])]
+		if ok {
+			vals[i] = val
+			continue
+		}
+		missing = append(missing, hash)
+		missingIdx = append(missingIdx, i)
+	}
+	w.lock.Unlock()
+	if len(missing) == 0 {
+		return vals, nil
+	}
+	fetched, err := w.rdr.GetMany(missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range fetched {
+		vals[missingIdx[i]] = val
+	}
+	return vals, nil
+}
+
 func (w *Writer) Has(hash [32]byte) (bool, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -101,6 +136,7 @@ func (w *Writer) Put(data []byte) ([32]byte, error) {
 
 	_, ok := w.workingSet[string(h[:])]
 	if ok {
+		w.prog.Add(progress.DupChunks, 1)
 		return h, nil
 	}
 
@@ -109,6 +145,7 @@ func (w *Writer) Put(data []byte) ([32]byte, error) {
 		return h, err
 	}
 	if ok {
+		w.prog.Add(progress.DupChunks, 1)
 		return h, nil
 	}
 
@@ -117,7 +154,7 @@ func (w *Writer) Put(data []byte) ([32]byte, error) {
 		if err != nil {
 			return h, err
 		}
-		name = name + ".ebpack"
+		name = name + PackExt
 		f, err := w.store.NewPack("packs/" + name)
 		if err != nil {
 			return h, err
@@ -149,6 +186,8 @@ func (w *Writer) Put(data []byte) ([32]byte, error) {
 	if err != nil {
 		return h, err
 	}
+	w.prog.Add(progress.NewChunks, 1)
+	w.prog.Add(progress.BytesUploaded, int64(len(compressed)))
 	w.workingSetSz += uint64(len(compressed))
 	dataCopy := make([]byte, len(data), len(data))
 	copy(dataCopy, data)
@@ -164,18 +203,10 @@ func (w *Writer) Flush() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	err := w.flushWorkingSet()
-	if err != nil {
-		return nil
-	}
-	err = w.rdr.Close()
 	if err != nil {
 		return err
 	}
-	w.rdr, err = NewReader(w.store, w.key, w.cachepath)
-	if err != nil {
-		return err
-	}
-	return nil
+	return w.rdr.reload()
 }
 
 func (w *Writer) Close() error {
@@ -183,7 +214,7 @@ func (w *Writer) Close() error {
 	defer w.lock.Unlock()
 	err := w.flushWorkingSet()
 	if err != nil {
-		return nil
+		return err
 	}
 	err = w.rdr.Close()
 	if err != nil {
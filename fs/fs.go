@@ -188,6 +188,71 @@ func Walk(store bpy.CStore, hash [32]byte, fpath string) (DirEnt, error) {
 	return result, nil
 }
 
+// Lookup returns the entry at fpath below the directory hash, ok is
+// false if there is no such entry.
+func Lookup(store bpy.CStore, hash [32]byte, fpath string) (DirEnt, bool, error) {
+	fpath = path.Clean("/" + fpath)
+	ents, err := ReadDir(store, hash)
+	if err != nil {
+		return DirEnt{}, false, err
+	}
+	ent := ents[0]
+	if fpath == "/" {
+		return ent, true, nil
+	}
+	for _, name := range strings.Split(fpath[1:], "/") {
+		if !ent.IsDir() {
+			return DirEnt{}, false, nil
+		}
+		ents, err := ReadDir(store, ent.HTree.Data)
+		if err != nil {
+			return DirEnt{}, false, err
+		}
+		found := false
+		for _, child := range ents[1:] {
+			if child.EntName == name {
+				ent = child
+				found = true
+				break
+			}
+		}
+		if !found {
+			return DirEnt{}, false, nil
+		}
+	}
+	return ent, true, nil
+}
+
+// MkdirAll creates dirPath and any missing parents below the directory
+// root with the given mode, returning the new root.
+func MkdirAll(store bpy.CStore, root [32]byte, dirPath string, mode os.FileMode) (DirEnt, error) {
+	dirPath = path.Clean("/" + dirPath)
+	ent, ok, err := Lookup(store, root, dirPath)
+	if err != nil {
+		return DirEnt{}, err
+	}
+	if ok {
+		if !ent.IsDir() {
+			return DirEnt{}, fmt.Errorf("%s is not a directory", dirPath)
+		}
+		ents, err := ReadDir(store, root)
+		if err != nil {
+			return DirEnt{}, err
+		}
+		return ents[0], nil
+	}
+	parent, err := MkdirAll(store, root, path.Dir(dirPath), mode)
+	if err != nil {
+		return DirEnt{}, err
+	}
+	dir, err := EmptyDir(store, mode|os.ModeDir)
+	if err != nil {
+		return DirEnt{}, err
+	}
+	dir.EntModTime = time.Now().Unix()
+	return Insert(store, parent.HTree.Data, dirPath, dir)
+}
+
 type FileReader struct {
 	offset uint64
 	fsize  int64
@@ -230,9 +295,7 @@ func (r *FileReader) ReadAt(buf []byte, off int64) (int, error) {
 }
 
 func (r *FileReader) Close() error {
-	// nothing to do but having Close in the api isn't bad
-	// if we need to add it.
-	return nil
+	return r.rdr.Close()
 }
 
 func Open(store bpy.CStore, roothash [32]byte, fpath string) (*FileReader, error) {
@@ -243,10 +306,15 @@ func Open(store bpy.CStore, roothash [32]byte, fpath string) (*FileReader, error
 	if dirent.EntMode.IsDir() {
 		return nil, fmt.Errorf("%s is a directory", fpath)
 	}
+	return OpenEnt(store, dirent)
+}
+
+func OpenEnt(store bpy.CStore, dirent DirEnt) (*FileReader, error) {
 	rdr, err := htree.NewReader(store, dirent.HTree.Data)
 	if err != nil {
 		return nil, err
 	}
+	rdr.SetPrefetch(htree.DefaultPrefetch)
 	return &FileReader{
 		offset: 0,
 		fsize:  dirent.EntSize,
@@ -269,6 +337,39 @@ func Ls(store bpy.CStore, roothash [32]byte, fpath string) (DirEnts, error) {
 	return ents, nil
 }
 
+var SkipDir = errors.New("skip this directory")
+
+// WalkDir calls fn for every entry below the directory hash, depth first,
+// with paths relative to that directory. If fn returns SkipDir for a
+// directory its contents are not visited.
+func WalkDir(store bpy.CStore, hash [32]byte, fn func(entPath string, ent DirEnt) error) error {
+	return walkDir(store, hash, "", fn)
+}
+
+func walkDir(store bpy.CStore, hash [32]byte, dirPath string, fn func(entPath string, ent DirEnt) error) error {
+	ents, err := ReadDir(store, hash)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents[1:] {
+		entPath := path.Join(dirPath, ent.EntName)
+		err = fn(entPath, ent)
+		if err == SkipDir && ent.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ent.IsDir() {
+			err = walkDir(store, ent.HTree.Data, entPath, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func EmptyDir(store bpy.CStore, mode os.FileMode) (DirEnt, error) {
 	return WriteDir(store, []DirEnt{}, mode)
 }
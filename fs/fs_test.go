@@ -77,6 +77,54 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestLookup(t *testing.T) {
+	store := testhelp.NewMemStore()
+	empty, err := EmptyDir(store, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := MkdirAll(store, empty.HTree.Data, "/a/b/c", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = Insert(store, root.HTree.Data, "/a/f", DirEnt{EntSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := MkdirAll(store, root.HTree.Data, "/a/b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.HTree != root.HTree {
+		t.Fatal("creating existing dirs changed the root")
+	}
+	_, err = MkdirAll(store, root.HTree.Data, "/a/f/g", 0755)
+	if err == nil {
+		t.Fatal("expected an error creating a dir below a file")
+	}
+	for _, tc := range []struct {
+		path  string
+		ok    bool
+		isDir bool
+	}{
+		{"/", true, true},
+		{"a/b/c", true, true},
+		{"/a/b/", true, true},
+		{"/a/f", true, false},
+		{"/a/f/g", false, false},
+		{"/a/x", false, false},
+		{"/x/y", false, false},
+	} {
+		ent, ok, err := Lookup(store, root.HTree.Data, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.ok || ent.IsDir() != tc.isDir {
+			t.Fatalf("%s: expected ok=%v dir=%v got ok=%v dir=%v", tc.path, tc.ok, tc.isDir, ok, ent.IsDir())
+		}
+	}
+}
+
 func TestSeek(t *testing.T) {
 	store := testhelp.NewMemStore()
 	r := rand.New(rand.NewSource(3453))
@@ -274,3 +322,34 @@ func TestMove(t *testing.T) {
 		t.Fatal("expected empty folder")
 	}
 }
+
+func TestWalkDir(t *testing.T) {
+	store := testhelp.NewMemStore()
+	f := DirEnt{EntName: "f", EntSize: 10, EntMode: 0}
+	sub, err := WriteDir(store, DirEnts{f}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := DirEnt{EntName: "a", EntMode: os.ModeDir, HTree: sub.HTree}
+	b := DirEnt{EntName: "b", EntMode: os.ModeDir, HTree: sub.HTree}
+	root, err := WriteDir(store, DirEnts{a, b, f}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visited := []string{}
+	err = WalkDir(store, root.HTree.Data, func(entPath string, ent DirEnt) error {
+		visited = append(visited, entPath)
+		if entPath == "b" {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a", "a/f", "b", "f"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("walked %v, expected %v", visited, expected)
+	}
+}
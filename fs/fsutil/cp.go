@@ -4,13 +4,14 @@ import (
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/fs"
 	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/progress"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-func hostFileToHashTree(store bpy.CStore, path string) (htree.HTree, error) {
+func hostFileToHashTree(store bpy.CStore, path string, prog *progress.Progress) (htree.HTree, error) {
 	fin, err := os.Open(path)
 	if err != nil {
 		return htree.HTree{}, err
@@ -20,32 +21,36 @@ func hostFileToHashTree(store bpy.CStore, path string) (htree.HTree, error) {
 	if err != nil {
 		return htree.HTree{}, err
 	}
-	_, err = io.Copy(fout, fin)
+	_, err = io.Copy(fout, prog.Reader(fin, progress.BytesIn))
 	if err != nil {
 		return htree.HTree{}, err
 	}
+	prog.Add(progress.Files, 1)
 	return fout.Close()
 }
 
-func hashTreeToHostFile(store bpy.CStore, hash [32]byte, dst string, mode os.FileMode) error {
+func hashTreeToHostFile(store bpy.CStore, hash [32]byte, dst string, mode os.FileMode, prog *progress.Progress) error {
 	f, err := htree.NewReader(store, hash)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	f.SetPrefetch(htree.DefaultPrefetch)
 	fout, err := os.OpenFile(dst, os.O_EXCL|os.O_CREATE|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(fout, f)
+	_, err = io.Copy(prog.Writer(fout, progress.BytesOut), f)
 	if err != nil {
 		_ = fout.Close()
 		return err
 	}
+	prog.Add(progress.Files, 1)
 	return fout.Close()
 
 }
 
-func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
+func cpHostDirToFs(store bpy.CStore, path string, prog *progress.Progress) (fs.DirEnt, error) {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return fs.DirEnt{}, err
@@ -62,7 +67,7 @@ func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
 	for _, e := range ents {
 		switch {
 		case e.Mode().IsRegular():
-			hash, err := hostFileToHashTree(store, filepath.Join(path, e.Name()))
+			hash, err := hostFileToHashTree(store, filepath.Join(path, e.Name()), prog)
 			if err != nil {
 				return fs.DirEnt{}, err
 			}
@@ -73,7 +78,7 @@ func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
 				EntMode: e.Mode(),
 			})
 		case e.IsDir():
-			newEnt, err := cpHostDirToFs(store, filepath.Join(path, e.Name()))
+			newEnt, err := cpHostDirToFs(store, filepath.Join(path, e.Name()), prog)
 			if err != nil {
 				return fs.DirEnt{}, err
 			}
@@ -89,7 +94,7 @@ func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
 	return dirEnt, err
 }
 
-func cpFsDirToHost(store bpy.CStore, hash [32]byte, dest string) error {
+func cpFsDirToHost(store bpy.CStore, hash [32]byte, dest string, prog *progress.Progress) error {
 	ents, err := fs.ReadDir(store, hash)
 	if err != nil {
 		return err
@@ -102,12 +107,12 @@ func cpFsDirToHost(store bpy.CStore, hash [32]byte, dest string) error {
 		subp := filepath.Join(dest, e.EntName)
 		switch {
 		case e.EntMode.IsDir():
-			err = cpFsDirToHost(store, e.HTree.Data, subp)
+			err = cpFsDirToHost(store, e.HTree.Data, subp, prog)
 			if err != nil {
 				return err
 			}
 		case e.EntMode.IsRegular():
-			err = hashTreeToHostFile(store, e.HTree.Data, subp, e.EntMode)
+			err = hashTreeToHostFile(store, e.HTree.Data, subp, e.EntMode, prog)
 			if err != nil {
 				return err
 			}
@@ -116,15 +121,16 @@ func cpFsDirToHost(store bpy.CStore, hash [32]byte, dest string) error {
 	return nil
 }
 
-func CpHostToFs(store bpy.CStore, src string) (fs.DirEnt, error) {
+// prog may be nil.
+func CpHostToFs(store bpy.CStore, src string, prog *progress.Progress) (fs.DirEnt, error) {
 	st, err := os.Stat(src)
 	if err != nil {
 		return fs.DirEnt{}, err
 	}
 	if st.IsDir() {
-		return cpHostDirToFs(store, src)
+		return cpHostDirToFs(store, src, prog)
 	}
-	hash, err := hostFileToHashTree(store, src)
+	hash, err := hostFileToHashTree(store, src, prog)
 	if err != nil {
 		return fs.DirEnt{}, err
 	}
@@ -136,13 +142,14 @@ func CpHostToFs(store bpy.CStore, src string) (fs.DirEnt, error) {
 	}, nil
 }
 
-func CpFsToHost(store bpy.CStore, root [32]byte, src, dst string) error {
+// prog may be nil.
+func CpFsToHost(store bpy.CStore, root [32]byte, src, dst string, prog *progress.Progress) error {
 	ent, err := fs.Walk(store, root, src)
 	if err != nil {
 		return err
 	}
 	if ent.IsDir() {
-		return cpFsDirToHost(store, ent.HTree.Data, dst)
+		return cpFsDirToHost(store, ent.HTree.Data, dst, prog)
 	}
-	return hashTreeToHostFile(store, ent.HTree.Data, dst, ent.EntMode)
+	return hashTreeToHostFile(store, ent.HTree.Data, dst, ent.EntMode, prog)
 }
@@ -3,6 +3,7 @@
 package fsutil
 
 import (
+	"github.com/buppyio/bpy/progress"
 	"github.com/buppyio/bpy/testhelp"
 	"io/ioutil"
 	"math/rand"
@@ -40,12 +41,12 @@ func TestStoreFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	store := testhelp.NewMemStore()
-	dirEnt, err := CpHostToFs(store, randf)
+	dirEnt, err := CpHostToFs(store, randf, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = hashTreeToHostFile(store, dirEnt.HTree.Data, restored, dirEnt.EntMode)
+	err = hashTreeToHostFile(store, dirEnt.HTree.Data, restored, dirEnt.EntMode, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,14 +80,20 @@ func TestStoreDir(t *testing.T) {
 			t.Fatal(err)
 		}
 		store := testhelp.NewMemStore()
-		dirEnt, err := CpHostToFs(store, randd)
+		putProg := progress.New("put")
+		dirEnt, err := CpHostToFs(store, randd, putProg)
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = CpFsToHost(store, dirEnt.HTree.Data, "/", restored)
+		getProg := progress.New("get")
+		err = CpFsToHost(store, dirEnt.HTree.Data, "/", restored, getProg)
 		if err != nil {
 			t.Fatal(err)
 		}
+		if putProg.Get(progress.Files) != getProg.Get(progress.Files) ||
+			putProg.Get(progress.BytesIn) != getProg.Get(progress.BytesOut) {
+			t.Fatal("put and get progress differ")
+		}
 		if !testhelp.DirEqual(randd, restored) {
 			t.Fatalf("%s != %s", randd, restored)
 		}
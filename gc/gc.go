@@ -5,9 +5,9 @@ import (
 	"errors"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cstore"
 	"github.com/buppyio/bpy/cstore/cache"
-	"github.com/buppyio/bpy/fs"
-	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/progress"
 	"github.com/buppyio/bpy/remote"
 	"github.com/buppyio/bpy/remote/client"
 	// "log"
@@ -21,16 +21,38 @@ type gcState struct {
 	c       *client.Client
 	store   bpy.CStore
 	cache   *cache.Client
-	visited map[[32]byte]struct{}
+	visited Set
+	opts    MarkOptions
+	prog    *progress.Progress
 
 	// Sweeping state
 	newPackSize uint64
 	newPack     *bpack.Writer
-	moved       map[[32]byte]struct{}
-	canDelete   []string
+	newPackName string
+	moved       Set
 }
 
-func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Key) error {
+// Tests replace this to commit writes at a fixed point during a gc.
+var beforeFence = func() {}
+
+// GC repacks the packs chosen by policy, idxCache is the local pack index cache and prog may be nil.
+//
+// Other clients may keep writing while the gc marks and copies. Only packs that
+// existed when the gc started are considered, and before removing anything the
+// gc fences out writers and marks from the root again, copying any data that
+// became reachable in the meantime.
+func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Key, idxCache string, policy Policy, opts MarkOptions, prog *progress.Progress) error {
+	visited, err := opts.newSet()
+	if err != nil {
+		return err
+	}
+	defer visited.Close()
+	moved, err := opts.newSet()
+	if err != nil {
+		return err
+	}
+	defer moved.Close()
+
 	epoch, err := remote.StartGC(c)
 	if err != nil {
 		return err
@@ -45,12 +67,19 @@ func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Ke
 		k:           k,
 		c:           c,
 		store:       store,
-		visited:     make(map[[32]byte]struct{}),
-		moved:       make(map[[32]byte]struct{}),
+		visited:     visited,
+		opts:        opts,
+		moved:       moved,
 		newPack:     nil,
 		newPackSize: 0,
-		canDelete:   []string{},
+		prog:        prog,
+	}
+
+	indexes, err := cstore.ReadPackIndexes(c, k.CipherKey, idxCache)
+	if err != nil {
+		return err
 	}
+	prog.Add(progress.PacksScanned, int64(len(indexes)))
 
 	hash, _, ok, err := remote.GetRoot(gc.c, gc.k)
 	if err != nil {
@@ -60,116 +89,157 @@ func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Ke
 		return errors.New("root missing")
 	}
 
-	err = gc.markRef(hash)
+	err = mark(store, visited, hash, opts)
 	if err != nil {
 		return err
 	}
 
-	err = store.Close()
+	usage, err := Usage(indexes, visited)
 	if err != nil {
 		return err
 	}
+	policy.Plan(usage)
 
-	err = gc.sweep()
+	err = gc.sweep(indexes, usage)
 	if err != nil {
 		return err
 	}
 
-	return remote.StopGC(c)
-}
+	beforeFence()
 
-func (gc *gcState) markRef(hash [32]byte) error {
-	err := gc.markHTree(hash)
+	gc.epoch, err = remote.FenceGC(c, gc.epoch)
 	if err != nil {
 		return err
 	}
 
-	ref, err := refs.GetRef(gc.store, hash)
+	newHash, _, ok, err := remote.GetRoot(gc.c, gc.k)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return errors.New("root missing")
+	}
+	if newHash != hash {
+		err = mark(store, visited, newHash, opts)
+		if err != nil {
+			return err
+		}
+		err = gc.sweep(indexes, usage)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = gc.markFsDir(ref.Root)
+	err = store.Close()
 	if err != nil {
 		return err
 	}
 
-	if ref.HasPrev {
-		err = gc.markRef(ref.Prev)
+	for i, pack := range indexes {
+		if !usage[i].Rewrite {
+			continue
+		}
+		// log.Printf("deleting: %v", pack.Name)
+		err := remote.Remove(gc.c, path.Join("packs", pack.Name), gc.epoch)
+		if err != nil {
+			return err
+		}
+		err = remote.Remove(gc.c, path.Join("indexes", cstore.IndexFileName(pack.Name)), gc.epoch)
 		if err != nil {
 			return err
 		}
+		gc.prog.Add(progress.BytesDeleted, int64(pack.Size))
 	}
-	return nil
+
+	err = gc.snapshotIndexes(idxCache)
+	if err != nil {
+		return err
+	}
+
+	return remote.StopGC(c)
 }
 
-func (gc *gcState) markFsDir(root [32]byte) error {
-	err := gc.markHTree(root)
+// snapshotIndexes uploads a snapshot of the pack indexes left after the gc
+// and removes the older snapshots.
+func (gc *gcState) snapshotIndexes(idxCache string) error {
+	indexes, err := cstore.ReadPackIndexes(gc.c, gc.k.CipherKey, idxCache)
 	if err != nil {
 		return err
 	}
-	dirEnts, err := fs.ReadDir(gc.store, root)
+	name, err := cstore.WriteIndexSnapshot(gc.c, gc.k.CipherKey, indexes)
 	if err != nil {
 		return err
 	}
-	for _, dirEnt := range dirEnts[1:] {
-		if dirEnt.IsDir() {
-			err := gc.markFsDir(dirEnt.HTree.Data)
-			if err != nil {
-				return err
-			}
+	listing, err := remote.ListIndexes(gc.c)
+	if err != nil {
+		return err
+	}
+	for _, ent := range listing {
+		if !cstore.IsSnapshot(ent.Name) || ent.Name == name {
+			continue
 		}
-		if dirEnt.HTree.Depth == 0 {
-			gc.visited[dirEnt.HTree.Data] = struct{}{}
-		} else {
-			err := gc.markHTree(dirEnt.HTree.Data)
-			if err != nil {
-				return err
-			}
+		err = remote.Remove(gc.c, path.Join("indexes", ent.Name), gc.epoch)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (gc *gcState) markHTree(root [32]byte) error {
-	_, ok := gc.visited[root]
-	if ok {
-		return nil
+// DryRun marks the live chunks and reports how much of each pack is live,
+// idxCache is the local pack index cache. Nothing is written or deleted
+// and no gc is started on the remote.
+func DryRun(c *client.Client, store bpy.CStore, k *bpy.Key, idxCache string, policy Policy, opts MarkOptions) ([]PackUsage, error) {
+	hash, _, ok, err := remote.GetRoot(c, k)
+	if err != nil {
+		return nil, err
 	}
-
-	data, err := gc.store.Get(root)
+	if !ok {
+		return nil, errors.New("root missing")
+	}
+	live, err := Mark(store, hash, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if data[0] == 0 {
-		gc.visited[root] = struct{}{}
-		return nil
+	defer live.Close()
+	indexes, err := cstore.ReadPackIndexes(c, k.CipherKey, idxCache)
+	if err != nil {
+		return nil, err
 	}
+	usage, err := Usage(indexes, live)
+	if err != nil {
+		return nil, err
+	}
+	policy.Plan(usage)
+	return usage, nil
+}
 
-	for i := 1; i < len(data); i += 40 {
-		var hash [32]byte
-		copy(hash[:], data[i+8:i+40])
-		if data[0] == 1 {
-			gc.visited[hash] = struct{}{}
-		}
-		err := gc.markHTree(hash)
-		if err != nil {
-			return err
-		}
+// Mark returns the set of chunks reachable from the ref and its history,
+// the caller must close it.
+func Mark(store bpy.CStore, hash [32]byte, opts MarkOptions) (Set, error) {
+	visited, err := opts.newSet()
+	if err != nil {
+		return nil, err
 	}
-	gc.visited[root] = struct{}{}
-	return nil
+	err = mark(store, visited, hash, opts)
+	if err != nil {
+		visited.Close()
+		return nil, err
+	}
+	return visited, nil
 }
 
 func (gc *gcState) putValue(hash [32]byte, val []byte) error {
-	_, moved := gc.moved[hash]
+	moved, err := gc.moved.Has(hash)
+	if err != nil {
+		return err
+	}
 	if moved {
 		return nil
 	}
 
 	if gc.newPackSize+uint64(len(val))+uint64(len(hash)) > 128*1024*1024 {
-		err := gc.closeCurrentWriterAndDeleteOldPacks()
+		err := gc.closeCurrentWriter()
 		if err != nil {
 			return err
 		}
@@ -180,7 +250,8 @@ func (gc *gcState) putValue(hash [32]byte, val []byte) error {
 		if err != nil {
 			return err
 		}
-		f, err := gc.c.NewPack(path.Join("packs", name) + ".ebpack")
+		name = name + cstore.PackExt
+		f, err := gc.c.NewPack(path.Join("packs", name))
 		if err != nil {
 			return err
 		}
@@ -192,54 +263,63 @@ func (gc *gcState) putValue(hash [32]byte, val []byte) error {
 		if err != nil {
 			return err
 		}
+		gc.newPackName = name
 	}
 
-	err := gc.newPack.Add(string(hash[:]), val)
+	err = gc.newPack.Add(string(hash[:]), val)
 	if err != nil {
 		return err
 	}
 	// Only approximate, but good enough.
 	gc.newPackSize += uint64(len(hash)) + uint64(len(val))
-	gc.moved[hash] = struct{}{}
-	return nil
+	gc.prog.Add(progress.BytesMoved, int64(len(val)))
+	return gc.moved.Add(hash)
 }
 
-func (gc *gcState) closeCurrentWriterAndDeleteOldPacks() error {
+func (gc *gcState) closeCurrentWriter() error {
 	if gc.newPack != nil {
-		_, err := gc.newPack.Close()
+		idx, err := gc.newPack.Close()
 		if err != nil {
 			return err
 		}
-	}
-	gc.newPack = nil
-	gc.newPackSize = 0
-	for _, toDelete := range gc.canDelete {
-		// log.Printf("deleting: %v", toDelete)
-		err := remote.Remove(gc.c, toDelete, gc.epoch)
+		err = cstore.WriteIndexFile(gc.c, gc.k.CipherKey, gc.newPackName, idx)
 		if err != nil {
 			return err
 		}
 	}
-	gc.canDelete = []string{}
+	gc.newPack = nil
+	gc.newPackName = ""
+	gc.newPackSize = 0
 	return nil
 }
 
-func (gc *gcState) sweep() error {
-	packs, err := remote.ListPacks(gc.c)
-	if err != nil {
-		return err
+// sweep copies the live chunks out of the packs being rewritten. It can be run
+// again after marking more chunks, only chunks not yet copied are moved.
+func (gc *gcState) sweep(indexes []cstore.PackIndex, usage []PackUsage) error {
+	// Chunks in packs we keep never need to be copied.
+	for i, pack := range indexes {
+		if usage[i].Rewrite {
+			continue
+		}
+		for _, idxEnt := range pack.Idx {
+			var hash [32]byte
+			copy(hash[:], idxEnt.Key)
+			err := gc.moved.Add(hash)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	for _, pack := range packs {
-		err = gc.sweepPack(pack)
+	for i, pack := range indexes {
+		if !usage[i].Rewrite {
+			continue
+		}
+		err := gc.sweepPack(pack)
 		if err != nil {
 			return err
 		}
 	}
-	err = gc.closeCurrentWriterAndDeleteOldPacks()
-	if err != nil {
-		return err
-	}
-	return nil
+	return gc.closeCurrentWriter()
 }
 
 type offsetSortedIdx []bpack.IndexEnt
@@ -248,73 +328,92 @@ func (idx offsetSortedIdx) Len() int           { return len(idx) }
 func (idx offsetSortedIdx) Swap(i, j int)      { idx[i], idx[j] = idx[j], idx[i] }
 func (idx offsetSortedIdx) Less(i, j int) bool { return idx[i].Offset < idx[j].Offset }
 
-func (gc *gcState) sweepPack(pack remote.PackListing) error {
-	packPath := path.Join("packs/", pack.Name)
-	f, err := gc.c.Open(packPath)
-	if err != nil {
-		return err
+// needsCopy reports if the chunk is live and has not been copied yet.
+func (gc *gcState) needsCopy(hash [32]byte) (bool, error) {
+	live, err := gc.visited.Has(hash)
+	if err != nil || !live {
+		return false, err
 	}
-	packReader, err := bpack.NewEncryptedReader(f, gc.k.CipherKey, int64(pack.Size))
+	moved, err := gc.moved.Has(hash)
 	if err != nil {
-		return err
-	}
-	defer packReader.Close()
-	// XXX fetch from local cache if we have it.
-	err = packReader.ReadIndex()
-	if err != nil {
-		return err
+		return false, err
 	}
+	return !moved, nil
+}
+
+// sweepBatchSize bounds how much chunk data sweepPack reads per request.
+const sweepBatchSize = 16 * 1024 * 1024
 
-	idx := offsetSortedIdx(packReader.Idx)
+func (gc *gcState) sweepPack(pack cstore.PackIndex) error {
+	idx := make(offsetSortedIdx, len(pack.Idx))
+	copy(idx, pack.Idx)
 	sort.Sort(idx)
 
-	if pack.Size > 100*1024*1024 {
-		canSkip := true
-		for _, idxEnt := range idx {
-			var hash [32]byte
-			copy(hash[:], idxEnt.Key)
-			_, ok := gc.visited[hash]
-			if !ok {
-				// log.Printf("can't skip 1, %s", hex.EncodeToString(hash[:]))
-				canSkip = false
-				break
+	// The pack is only opened if a live chunk is missing from the cache.
+	var packReader *bpack.Reader
+	defer func() {
+		if packReader != nil {
+			packReader.Close()
+		}
+	}()
+
+	batch := []bpack.IndexEnt{}
+	batchSize := uint64(0)
+	fetchBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if packReader == nil {
+			f, err := gc.c.Open(path.Join("packs", pack.Name))
+			if err != nil {
+				return err
 			}
-			_, ok = gc.moved[hash]
-			if ok {
-				// log.Printf("can't skip 2")
-				canSkip = false
-				break
+			packReader, err = bpack.NewEncryptedReader(f, gc.k.CipherKey, int64(pack.Size))
+			if err != nil {
+				return err
 			}
 		}
-
-		// We can totally skip this pack if its full, reachable and has no duplicates.
-		if canSkip {
-			for _, idxEnt := range idx {
-				var hash [32]byte
-				copy(hash[:], idxEnt.Key)
-				gc.moved[hash] = struct{}{}
+		offsets := make([]uint64, len(batch))
+		sizes := make([]uint32, len(batch))
+		for i, idxEnt := range batch {
+			offsets[i] = idxEnt.Offset
+			sizes[i] = idxEnt.Size
+		}
+		vals, err := packReader.GetAtV(offsets, sizes)
+		if err != nil {
+			return err
+		}
+		for i, idxEnt := range batch {
+			var hash [32]byte
+			copy(hash[:], idxEnt.Key)
+			err = gc.putValue(hash, vals[i])
+			if err != nil {
+				return err
+			}
+			if gc.cache != nil {
+				err = gc.cache.PutRaw(hash, vals[i])
+				if err != nil {
+					return err
+				}
 			}
-			return nil
 		}
+		batch = batch[:0]
+		batchSize = 0
+		return nil
 	}
 
-	for i := 0; i < len(idx); i++ {
+	for _, idxEnt := range idx {
 		var hash [32]byte
-		copy(hash[:], idx[i].Key)
+		copy(hash[:], idxEnt.Key)
 
-		_, isReachable := gc.visited[hash]
-		if !isReachable {
-			continue
+		copyable, err := gc.needsCopy(hash)
+		if err != nil {
+			return err
 		}
-		_, alreadyMoved := gc.moved[hash]
-		if alreadyMoved {
+		if !copyable {
 			continue
 		}
 
-		if !isReachable {
-			break
-		}
-
 		if gc.cache != nil {
 			val, ok, err := gc.cache.GetRaw(hash)
 			if err != nil {
@@ -329,50 +428,14 @@ func (gc *gcState) sweepPack(pack remote.PackListing) error {
 			}
 		}
 
-		// Find the longest consecutive 'run' of values we must fetch
-		run := []bpack.IndexEnt{}
-		runSize := uint32(0)
-		for i < len(idx) {
-			copy(hash[:], idx[i].Key)
-			_, isReachable := gc.visited[hash]
-			if !isReachable {
-				break
-			}
-			_, ok := gc.moved[hash]
-			if ok {
-				break
-			}
-			run = append(run, idx[i])
-			runSize += idx[i].Size
-			i++
-		}
-		if len(run) == 0 {
-			continue
-		}
-		runBase := run[0].Offset
-		// log.Printf("moving run of values: base=%v, size=%v", runBase, runSize)
-		runData, err := packReader.GetAt(runBase, runSize)
-		if err != nil {
-			return err
-		}
-
-		for _, idxEnt := range run {
-			var hash [32]byte
-			copy(hash[:], idxEnt.Key)
-			val := runData[0:idxEnt.Size]
-			runData = runData[idxEnt.Size:]
-			err = gc.putValue(hash, val)
+		batch = append(batch, idxEnt)
+		batchSize += uint64(idxEnt.Size)
+		if batchSize >= sweepBatchSize {
+			err = fetchBatch()
 			if err != nil {
 				return err
 			}
-			if gc.cache != nil {
-				err = gc.cache.PutRaw(hash, val)
-				if err != nil {
-					return err
-				}
-			}
 		}
 	}
-	gc.canDelete = append(gc.canDelete, packPath)
-	return nil
+	return fetchBatch()
 }
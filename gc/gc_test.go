@@ -0,0 +1,584 @@
+package gc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/server"
+	"github.com/buppyio/bpy/testhelp"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeFile(t *testing.T, store *testhelp.MemStore, name string, size int64, seed int64) fs.DirEnt {
+	w := htree.NewWriter(store)
+	_, err := io.Copy(w, io.LimitReader(rand.New(rand.NewSource(seed)), size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.DirEnt{
+		EntName: name,
+		EntSize: size,
+		EntMode: 0644,
+		HTree:   tree,
+	}
+}
+
+func chunksOf(t *testing.T, store *testhelp.MemStore, tree htree.HTree) [][32]byte {
+	if tree.Depth == 0 {
+		return [][32]byte{tree.Data}
+	}
+	data, err := store.Get(tree.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][32]byte{tree.Data}
+	for i := 1; i < len(data); i += 40 {
+		var child [32]byte
+		copy(child[:], data[i+8:i+40])
+		chunks = append(chunks, chunksOf(t, store, htree.HTree{Depth: tree.Depth - 1, Data: child})...)
+	}
+	return chunks
+}
+
+func TestMark(t *testing.T) {
+	store := testhelp.NewMemStore()
+	a := writeFile(t, store, "a", 300*1024, 1)
+	b := writeFile(t, store, "b", 1000, 2)
+	c := writeFile(t, store, "c", 200*1024, 3)
+
+	dir1, err := fs.WriteDir(store, fs.DirEnts{a, b}, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref1, err := refs.PutRef(store, refs.Ref{Root: dir1.HTree.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir2, err := fs.WriteDir(store, fs.DirEnts{b, c}, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref2, err := refs.PutRef(store, refs.Ref{Root: dir2.HTree.Data, HasPrev: true, Prev: ref1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref3, err := refs.PutRef(store, refs.Ref{Root: dir2.HTree.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "bpymarktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, opts := range []MarkOptions{{Workers: 1}, {Workers: 8}, {Workers: 4, TempDir: tmp}} {
+		withHistory, err := Mark(store, ref2, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pruned, err := Mark(store, ref3, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		has := func(set Set, chunk [32]byte) bool {
+			ok, err := set.Has(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok
+		}
+
+		for _, ent := range []fs.DirEnt{a, b, c} {
+			for _, chunk := range chunksOf(t, store, ent.HTree) {
+				if !has(withHistory, chunk) {
+					t.Fatalf("chunk of %s not marked", ent.EntName)
+				}
+			}
+		}
+		for _, chunk := range chunksOf(t, store, a.HTree) {
+			if has(pruned, chunk) {
+				t.Fatal("pruned file marked")
+			}
+		}
+		for _, ent := range []fs.DirEnt{b, c} {
+			for _, chunk := range chunksOf(t, store, ent.HTree) {
+				if !has(pruned, chunk) {
+					t.Fatalf("chunk of %s not marked", ent.EntName)
+				}
+			}
+		}
+		for _, hash := range [][32]byte{ref1, ref2, dir1.HTree.Data, dir2.HTree.Data} {
+			if !has(withHistory, hash) {
+				t.Fatal("ref or directory not marked")
+			}
+		}
+		err = withHistory.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pruned.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ents, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Fatal("disk set not removed")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	key := func(b byte) string {
+		return string(bytes.Repeat([]byte{b}, 32))
+	}
+	live := NewMemSet()
+	for _, b := range []byte{1, 3} {
+		var hash [32]byte
+		copy(hash[:], key(b))
+		live.Add(hash)
+	}
+	indexes := []cstore.PackIndex{
+		{
+			Name: "p1",
+			Size: 1000,
+			Idx: bpack.Index{
+				{Key: key(1), Size: 100},
+				{Key: key(2), Size: 200},
+			},
+		},
+		{
+			Name: "p2",
+			Size: 500,
+			Idx: bpack.Index{
+				{Key: key(1), Size: 100},
+				{Key: key(3), Size: 300},
+			},
+		},
+		{
+			Name: "p3",
+			Size: 50,
+			Idx: bpack.Index{
+				{Key: key(4), Size: 40},
+			},
+		},
+	}
+	usage, err := Usage(indexes, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PackUsage{
+		{Name: "p1", Size: 1000, Chunks: 2, LiveChunks: 1, LiveBytes: 100, DeadBytes: 200},
+		{Name: "p2", Size: 500, Chunks: 2, LiveChunks: 1, LiveBytes: 300, DeadBytes: 100},
+		{Name: "p3", Size: 50, Chunks: 1, LiveChunks: 0, LiveBytes: 0, DeadBytes: 40},
+	}
+	if len(usage) != len(expected) {
+		t.Fatalf("bad usage length %d", len(usage))
+	}
+	for i := range expected {
+		if usage[i] != expected[i] {
+			t.Fatalf("pack %d: got %+v, expected %+v", i, usage[i], expected[i])
+		}
+	}
+	reclaimable := []uint64{900, 200, 50}
+	for i := range reclaimable {
+		if usage[i].Reclaimable() != reclaimable[i] {
+			t.Fatalf("pack %d: reclaimable %d != %d", i, usage[i].Reclaimable(), reclaimable[i])
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	const mb = 1024 * 1024
+	policy := Policy{
+		DeadThreshold: 0.2,
+		SmallPackSize: 16 * mb,
+	}
+
+	usage := []PackUsage{
+		{Name: "full", Size: 100 * mb, LiveChunks: 10, LiveBytes: 90 * mb, DeadBytes: 10 * mb},
+		{Name: "sparse", Size: 100 * mb, LiveChunks: 10, LiveBytes: 50 * mb, DeadBytes: 50 * mb},
+		{Name: "dead", Size: 100 * mb, LiveChunks: 0, DeadBytes: 100 * mb},
+		{Name: "small", Size: 1 * mb, LiveChunks: 1, LiveBytes: 1 * mb},
+	}
+	policy.Plan(usage)
+	expected := []bool{false, true, true, false}
+	for i := range expected {
+		if usage[i].Rewrite != expected[i] {
+			t.Fatalf("%s: rewrite=%v", usage[i].Name, usage[i].Rewrite)
+		}
+	}
+
+	usage = append(usage, PackUsage{Name: "small2", Size: 2 * mb, LiveChunks: 1, LiveBytes: 2 * mb})
+	policy.Plan(usage)
+	expected = []bool{false, true, true, true, true}
+	for i := range expected {
+		if usage[i].Rewrite != expected[i] {
+			t.Fatalf("%s: rewrite=%v", usage[i].Name, usage[i].Rewrite)
+		}
+	}
+}
+
+type testRepo struct {
+	t   *testing.T
+	srv *server.Server
+	k   bpy.Key
+	tmp string
+	// Used by every gc of the repository.
+	markOpts MarkOptions
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	tmp, err := ioutil.TempDir("", "bpygctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(tmp, "remote"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{
+		t:        t,
+		srv:      server.NewServer(filepath.Join(tmp, "remote")),
+		k:        k,
+		tmp:      tmp,
+		markOpts: DefaultMarkOptions,
+	}
+}
+
+func (r *testRepo) attach() *client.Client {
+	clientConn, serverConn := net.Pipe()
+	go r.srv.ServeConn(serverConn)
+	c, err := client.Attach(clientConn, hex.EncodeToString(r.k.Id[:]))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return c
+}
+
+// openStore opens a content store with its own empty index cache.
+func (r *testRepo) openStore(c *client.Client) (*cstore.Writer, error) {
+	cachepath, err := ioutil.TempDir(r.tmp, "icache")
+	if err != nil {
+		return nil, err
+	}
+	return cstore.NewWriter(c, r.k.CipherKey, cachepath, cstore.DefaultReaderOptions, nil)
+}
+
+func (r *testRepo) store(c *client.Client) *cstore.Writer {
+	store, err := r.openStore(c)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return store
+}
+
+func fileData(seed int64) []byte {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.New(rand.NewSource(seed)), 100*1024+seed))
+	return data
+}
+
+// commit replaces the drive without keeping history, adding files with
+// the contents of the given seeds and removing the named files.
+func (r *testRepo) commit(c *client.Client, store bpy.CStore, epoch string, add map[string]int64, remove []string) error {
+	rootHash, version, ok, err := remote.GetRoot(c, &r.k)
+	if err != nil {
+		return err
+	}
+	var root fs.DirEnt
+	if ok {
+		ref, err := refs.GetRef(store, rootHash)
+		if err != nil {
+			return err
+		}
+		root.HTree.Data = ref.Root
+	} else {
+		root, err = fs.EmptyDir(store, os.ModeDir|0755)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range remove {
+		root, err = fs.Remove(store, root.HTree.Data, name)
+		if err != nil {
+			return err
+		}
+	}
+	for name, seed := range add {
+		w := htree.NewWriter(store)
+		data := fileData(seed)
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		tree, err := w.Close()
+		if err != nil {
+			return err
+		}
+		root, err = fs.Insert(store, root.HTree.Data, name, fs.DirEnt{
+			EntName: name,
+			EntSize: int64(len(data)),
+			EntMode: 0644,
+			HTree:   tree,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	refHash, err := refs.PutRef(store, refs.Ref{Root: root.HTree.Data})
+	if err != nil {
+		return err
+	}
+	err = store.Flush()
+	if err != nil {
+		return err
+	}
+	ok, err = remote.CasRoot(c, &r.k, refHash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("root concurrently modified")
+	}
+	return nil
+}
+
+func (r *testRepo) gc(c *client.Client) error {
+	store := r.store(c)
+	cachepath, err := ioutil.TempDir(r.tmp, "icache")
+	if err != nil {
+		return err
+	}
+	return GC(c, store, nil, &r.k, cachepath, Policy{}, r.markOpts, nil)
+}
+
+// check reads every file in the drive with a fresh index cache.
+func (r *testRepo) check(c *client.Client, expected map[string]int64) {
+	store := r.store(c)
+	defer store.Close()
+	rootHash, _, ok, err := remote.GetRoot(c, &r.k)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if !ok {
+		r.t.Fatal("root missing")
+	}
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	ents, err := fs.Ls(store, ref.Root, "/")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if len(ents[1:]) != len(expected) {
+		r.t.Fatalf("expected %d files, got %d", len(expected), len(ents[1:]))
+	}
+	for name, seed := range expected {
+		f, err := fs.Open(store, ref.Root, name)
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			r.t.Fatalf("reading %s: %s", name, err)
+		}
+		if !bytes.Equal(data, fileData(seed)) {
+			r.t.Fatalf("%s corrupt", name)
+		}
+	}
+}
+
+// checkPackFiles checks every pack has an index file, that the gc
+// left a single index snapshot, and that only packs are listed as packs.
+func (r *testRepo) checkPackFiles(c *client.Client) {
+	packs, err := remote.ListPacks(c)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	indexes, err := remote.ListIndexes(c)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	idxNames := make(map[string]bool)
+	snapshots := 0
+	for _, ent := range indexes {
+		idxNames[ent.Name] = true
+		if cstore.IsSnapshot(ent.Name) {
+			snapshots += 1
+		}
+	}
+	if snapshots != 1 {
+		r.t.Fatalf("expected 1 index snapshot, got %d", snapshots)
+	}
+	for _, ent := range packs {
+		if !strings.HasSuffix(ent.Name, cstore.PackExt) {
+			r.t.Fatalf("unexpected file %s in packs", ent.Name)
+		}
+		if !idxNames[cstore.IndexFileName(ent.Name)] {
+			r.t.Fatalf("pack %s has no index file", ent.Name)
+		}
+		delete(idxNames, cstore.IndexFileName(ent.Name))
+	}
+	if len(idxNames) != snapshots {
+		r.t.Fatalf("index files without packs %v", idxNames)
+	}
+}
+
+func TestGCWithConcurrentCommit(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+	c := r.attach()
+	defer c.Close()
+
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := r.store(c)
+	err = r.commit(c, store, epoch, map[string]int64{"a": 1, "b": 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.commit(c, store, epoch, nil, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer starts before the gc, so it reuses the chunks of 'a'
+	// the gc marks as dead instead of uploading them again.
+	w := r.attach()
+	defer w.Close()
+	wstore := r.store(w)
+	beforeFence = func() {
+		err := r.commit(w, wstore, epoch, map[string]int64{"a": 1, "c": 3}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() { beforeFence = func() {} }()
+
+	err = r.gc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.check(c, map[string]int64{"a": 1, "b": 2, "c": 3})
+	r.checkPackFiles(c)
+
+	beforeFence = func() {}
+	err = r.gc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkPackFiles(c)
+
+	err = r.commit(w, wstore, epoch, nil, []string{"c"})
+	if err == nil {
+		t.Fatal("commit with an epoch from before the gc succeeded")
+	}
+}
+
+func TestGCConcurrentPuts(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+	r.markOpts.TempDir = r.tmp
+	c := r.attach()
+	defer c.Close()
+
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.commit(c, r.store(c), epoch, map[string]int64{"f0": 0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	expected := map[string]int64{"f0": 0}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := r.attach()
+		defer w.Close()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Contents repeat so writes deduplicate against garbage.
+			name := fmt.Sprintf("f%d", i)
+			add := map[string]int64{name: int64(i % 3)}
+			remove := []string{}
+			if i >= 2 {
+				remove = append(remove, fmt.Sprintf("f%d", i-2))
+			}
+			for {
+				epoch, err := remote.GetEpoch(w)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Packs can be removed by the gc while the store
+				// loads its index or reads the drive, then we retry.
+				store, err := r.openStore(w)
+				if err != nil {
+					continue
+				}
+				err = r.commit(w, store, epoch, add, remove)
+				store.Close()
+				if err == nil {
+					break
+				}
+			}
+			delete(expected, fmt.Sprintf("f%d", i-2))
+			expected[name] = int64(i % 3)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = r.gc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	err = r.gc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.check(c, expected)
+}
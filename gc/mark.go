@@ -0,0 +1,177 @@
+package gc
+
+import (
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+)
+
+type MarkOptions struct {
+	// The number of chunks fetched concurrently.
+	Workers int
+	// If not empty, the live set is kept in a temporary database
+	// in this directory instead of in memory.
+	TempDir string
+}
+
+var DefaultMarkOptions = MarkOptions{
+	Workers: 8,
+}
+
+func (opts MarkOptions) newSet() (Set, error) {
+	if opts.TempDir != "" {
+		return NewDiskSet(opts.TempDir)
+	}
+	return NewMemSet(), nil
+}
+
+const (
+	markRef = iota
+	markDir
+	markTree
+)
+
+type markItem struct {
+	kind int
+	hash [32]byte
+}
+
+type markResult struct {
+	item markItem
+	// Every chunk read while fetching the item.
+	chunks [][32]byte
+	ref    refs.Ref
+	ents   fs.DirEnts
+	data   []byte
+	err    error
+}
+
+type recordingStore struct {
+	bpy.CStore
+	chunks [][32]byte
+}
+
+func (s *recordingStore) Get(hash [32]byte) ([]byte, error) {
+	s.chunks = append(s.chunks, hash)
+	return s.CStore.Get(hash)
+}
+
+func fetchMarkItem(store bpy.CStore, item markItem) markResult {
+	r := markResult{item: item}
+	switch item.kind {
+	case markRef:
+		rs := &recordingStore{CStore: store}
+		r.ref, r.err = refs.GetRef(rs, item.hash)
+		r.chunks = rs.chunks
+	case markDir:
+		rs := &recordingStore{CStore: store}
+		r.ents, r.err = fs.ReadDir(rs, item.hash)
+		r.chunks = rs.chunks
+	case markTree:
+		r.data, r.err = store.Get(item.hash)
+	}
+	return r
+}
+
+// mark adds every chunk reachable from the ref and its history to visited.
+// Anything already in visited is assumed to have been marked along with
+// everything it refers to, so marking a newer root after an older one only
+// fetches what changed.
+//
+// The traversal is depth first with an explicit stack, so memory use
+// depends on the width of the tree rather than the length of the history,
+// and up to opts.Workers chunks are fetched at once.
+func mark(store bpy.CStore, visited Set, hash [32]byte, opts MarkOptions) error {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	// results has room for every outstanding job, so workers never
+	// block if we return early.
+	jobs := make(chan markItem, workers)
+	results := make(chan markResult, workers)
+	defer close(jobs)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for item := range jobs {
+				results <- fetchMarkItem(store, item)
+			}
+		}()
+	}
+
+	stack := []markItem{{kind: markRef, hash: hash}}
+	inflight := 0
+	for len(stack) != 0 || inflight != 0 {
+		for inflight < workers && len(stack) != 0 {
+			item := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			seen, err := visited.Has(item.hash)
+			if err != nil {
+				return err
+			}
+			if seen {
+				continue
+			}
+			err = visited.Add(item.hash)
+			if err != nil {
+				return err
+			}
+			jobs <- item
+			inflight += 1
+		}
+		if inflight == 0 {
+			continue
+		}
+
+		r := <-results
+		inflight -= 1
+		if r.err != nil {
+			return r.err
+		}
+		for _, chunk := range r.chunks {
+			err := visited.Add(chunk)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch r.item.kind {
+		case markRef:
+			stack = append(stack, markItem{kind: markDir, hash: r.ref.Root})
+			if r.ref.HasPrev {
+				stack = append(stack, markItem{kind: markRef, hash: r.ref.Prev})
+			}
+		case markDir:
+			for _, ent := range r.ents[1:] {
+				switch {
+				case ent.IsDir():
+					stack = append(stack, markItem{kind: markDir, hash: ent.HTree.Data})
+				case ent.HTree.Depth == 0:
+					err := visited.Add(ent.HTree.Data)
+					if err != nil {
+						return err
+					}
+				default:
+					stack = append(stack, markItem{kind: markTree, hash: ent.HTree.Data})
+				}
+			}
+		case markTree:
+			if r.data[0] == 0 {
+				break
+			}
+			for i := 1; i < len(r.data); i += 40 {
+				var child [32]byte
+				copy(child[:], r.data[i+8:i+40])
+				if r.data[0] == 1 {
+					err := visited.Add(child)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				stack = append(stack, markItem{kind: markTree, hash: child})
+			}
+		}
+	}
+	return nil
+}
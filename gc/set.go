@@ -0,0 +1,120 @@
+package gc
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Set is a set of chunk hashes.
+type Set interface {
+	Add(hash [32]byte) error
+	Has(hash [32]byte) (bool, error)
+	Close() error
+}
+
+type memSet map[[32]byte]struct{}
+
+func NewMemSet() Set {
+	return make(memSet)
+}
+
+func (s memSet) Add(hash [32]byte) error {
+	s[hash] = struct{}{}
+	return nil
+}
+
+func (s memSet) Has(hash [32]byte) (bool, error) {
+	_, ok := s[hash]
+	return ok, nil
+}
+
+func (s memSet) Close() error {
+	return nil
+}
+
+// diskSet keeps the set in a temporary database, so it can be much
+// larger than memory.
+type diskSet struct {
+	dir     string
+	db      *bolt.DB
+	pending map[[32]byte]struct{}
+}
+
+// NewDiskSet creates a set stored in a temporary directory inside dir,
+// the directory is removed when the set is closed.
+func NewDiskSet(dir string) (Set, error) {
+	tmp, err := ioutil.TempDir(dir, "bpyset")
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(tmp, "set.db"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	// The database is thrown away if we crash.
+	db.NoSync = true
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("set"))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return &diskSet{
+		dir:     tmp,
+		db:      db,
+		pending: make(map[[32]byte]struct{}),
+	}, nil
+}
+
+func (s *diskSet) Add(hash [32]byte) error {
+	s.pending[hash] = struct{}{}
+	if len(s.pending) > 100000 {
+		return s.flushPending()
+	}
+	return nil
+}
+
+func (s *diskSet) flushPending() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("set"))
+		for k := range s.pending {
+			err := b.Put(k[:], []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = make(map[[32]byte]struct{})
+	return nil
+}
+
+func (s *diskSet) Has(hash [32]byte) (bool, error) {
+	_, ok := s.pending[hash]
+	if ok {
+		return true, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket([]byte("set")).Get(hash[:]) != nil
+		return nil
+	})
+	return ok, err
+}
+
+func (s *diskSet) Close() error {
+	err := s.db.Close()
+	rmErr := os.RemoveAll(s.dir)
+	if err != nil {
+		return err
+	}
+	return rmErr
+}
@@ -0,0 +1,107 @@
+package gc
+
+import (
+	"github.com/buppyio/bpy/cstore"
+)
+
+type PackUsage struct {
+	Name       string
+	Size       uint64
+	Chunks     int64
+	LiveChunks int64
+	LiveBytes  uint64
+	DeadBytes  uint64
+	// Set by Policy.Plan when the pack should be repacked.
+	Rewrite bool
+}
+
+// DeadFraction is the fraction of chunk data in the pack that is
+// unreachable or duplicated in another pack.
+func (u PackUsage) DeadFraction() float64 {
+	if u.LiveBytes+u.DeadBytes == 0 {
+		return 0
+	}
+	return float64(u.DeadBytes) / float64(u.LiveBytes+u.DeadBytes)
+}
+
+// Reclaimable is the space freed when the live chunks of the pack are
+// copied elsewhere and the pack is removed.
+func (u PackUsage) Reclaimable() uint64 {
+	if u.LiveBytes >= u.Size {
+		return 0
+	}
+	return u.Size - u.LiveBytes
+}
+
+// Usage reports how much of each pack is live. Like a sweep, a chunk stored
+// in more than one pack is only live in the first pack holding it.
+func Usage(indexes []cstore.PackIndex, live Set) ([]PackUsage, error) {
+	counted := make(map[[32]byte]struct{})
+	usage := make([]PackUsage, 0, len(indexes))
+	for _, pack := range indexes {
+		u := PackUsage{
+			Name:   pack.Name,
+			Size:   pack.Size,
+			Chunks: int64(len(pack.Idx)),
+		}
+		for _, ent := range pack.Idx {
+			var hash [32]byte
+			copy(hash[:], ent.Key)
+			ok, err := live.Has(hash)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				u.DeadBytes += uint64(ent.Size)
+				continue
+			}
+			_, ok = counted[hash]
+			if ok {
+				u.DeadBytes += uint64(ent.Size)
+				continue
+			}
+			counted[hash] = struct{}{}
+			u.LiveChunks += 1
+			u.LiveBytes += uint64(ent.Size)
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+type Policy struct {
+	// Packs with a larger fraction of dead data are repacked.
+	DeadThreshold float64
+	// Packs smaller than this are coalesced into larger ones.
+	SmallPackSize uint64
+}
+
+var DefaultPolicy = Policy{
+	DeadThreshold: 0.2,
+	SmallPackSize: 16 * 1024 * 1024,
+}
+
+// Plan chooses the packs to rewrite. Packs without live data are removed,
+// packs over the dead threshold are repacked and small packs are coalesced
+// when there is more than one. Everything else is left in place.
+func (p Policy) Plan(usage []PackUsage) {
+	small := 0
+	for _, u := range usage {
+		if u.LiveChunks != 0 && u.Size < p.SmallPackSize {
+			small += 1
+		}
+	}
+	for i := range usage {
+		u := &usage[i]
+		switch {
+		case u.LiveChunks == 0:
+			u.Rewrite = true
+		case u.DeadFraction() > p.DeadThreshold:
+			u.Rewrite = true
+		case small > 1 && u.Size < p.SmallPackSize:
+			u.Rewrite = true
+		default:
+			u.Rewrite = false
+		}
+	}
+}
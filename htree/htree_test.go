@@ -2,13 +2,56 @@ package htree
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/buppyio/bpy/testhelp"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"sync"
 	"testing"
+	"time"
 )
 
+// slowStore delays every Get and tracks how many run at once.
+type slowStore struct {
+	*testhelp.MemStore
+	delay   time.Duration
+	lock    sync.Mutex
+	running int
+	maxRun  int
+}
+
+func (s *slowStore) Get(hash [32]byte) ([]byte, error) {
+	s.lock.Lock()
+	s.running += 1
+	if s.running > s.maxRun {
+		s.maxRun = s.running
+	}
+	s.lock.Unlock()
+	time.Sleep(s.delay)
+	s.lock.Lock()
+	s.running -= 1
+	s.lock.Unlock()
+	return s.MemStore.Get(hash)
+}
+
+func writeRandom(t testing.TB, store *testhelp.MemStore, size int64) ([]byte, HTree) {
+	data, err := ioutil.ReadAll(io.LimitReader(rand.New(rand.NewSource(size)), size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(store)
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, root
+}
+
 func TestHTree(t *testing.T) {
 	for i := 0; i < 25; i++ {
 		var randbytes bytes.Buffer
@@ -41,6 +84,7 @@ func TestHTree(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		r.SetPrefetch((i % 2) * DefaultPrefetch)
 		_, err = io.Copy(&readbytes, r)
 		if err != nil {
 			t.Fatal(err)
@@ -119,3 +163,56 @@ func BenchmarkHTree(b *testing.B) {
 		io.Copy(ioutil.Discard, r)
 	}
 }
+
+func TestPrefetch(t *testing.T) {
+	mem := testhelp.NewMemStore()
+	expected, root := writeRandom(t, mem, 3*1024*1024)
+	for _, prefetch := range []int{0, 1, DefaultPrefetch} {
+		store := &slowStore{MemStore: mem, delay: time.Millisecond}
+		r, err := NewReader(store, root.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetPrefetch(prefetch)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("prefetch=%d: read differs", prefetch)
+		}
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.maxRun > prefetch+1 {
+			t.Fatalf("prefetch=%d: %d concurrent gets", prefetch, store.maxRun)
+		}
+		if prefetch > 1 && store.maxRun < 2 {
+			t.Fatalf("prefetch=%d: gets were not concurrent", prefetch)
+		}
+	}
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	mem := testhelp.NewMemStore()
+	_, root := writeRandom(b, mem, 5*1024*1024)
+	store := &slowStore{MemStore: mem, delay: time.Millisecond}
+	for _, prefetch := range []int{0, DefaultPrefetch} {
+		b.Run(fmt.Sprintf("prefetch-%d", prefetch), func(b *testing.B) {
+			b.SetBytes(5 * 1024 * 1024)
+			for i := 0; i < b.N; i++ {
+				r, err := NewReader(store, root.Data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				r.SetPrefetch(prefetch)
+				_, err = io.Copy(ioutil.Discard, r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
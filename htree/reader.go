@@ -5,8 +5,12 @@ import (
 	"errors"
 	"github.com/buppyio/bpy"
 	"io"
+	"sync"
 )
 
+// DefaultPrefetch is how many leaves readers fetch ahead by default.
+const DefaultPrefetch = 8
+
 type Reader struct {
 	root   [32]byte
 	store  bpy.CStore
@@ -14,6 +18,18 @@ type Reader struct {
 	lvls   [nlevels][maxlen]byte
 	pos    [nlevels]int
 	length [nlevels]int
+
+	prefetch int
+	fetches  []*leafFetch
+	fetching sync.WaitGroup
+}
+
+// leafFetch is a leaf of the current level 1 node being fetched in the background.
+type leafFetch struct {
+	pos  int
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 func NewReader(store bpy.CStore, root [32]byte) (*Reader, error) {
@@ -37,6 +53,89 @@ func (r *Reader) GetHeight() int {
 	return r.height
 }
 
+// SetPrefetch makes the reader fetch up to n of the leaves following the
+// one being read concurrently, 0 disables prefetching.
+func (r *Reader) SetPrefetch(n int) {
+	r.dropFetches()
+	r.prefetch = n
+}
+
+// dropFetches forgets fetches for a level 1 node that is no longer
+// current, they finish in the background.
+func (r *Reader) dropFetches() {
+	r.fetches = r.fetches[:0]
+}
+
+// startFetches fetches the leaves at the positions of the current
+// level 1 node in the background, as one batch if the store supports it.
+func (r *Reader) startFetches(positions []int) {
+	fetches := make([]*leafFetch, len(positions))
+	hashes := make([][32]byte, len(positions))
+	for i, pos := range positions {
+		copy(hashes[i][:], r.lvls[1][pos+8:pos+40])
+		fetches[i] = &leafFetch{
+			pos:  pos,
+			done: make(chan struct{}),
+		}
+	}
+	r.fetches = append(r.fetches, fetches...)
+	r.fetching.Add(1)
+	go func() {
+		defer r.fetching.Done()
+		vals, err := bpy.GetMany(r.store, hashes)
+		for i, f := range fetches {
+			if err != nil {
+				f.err = err
+			} else {
+				f.data = vals[i]
+			}
+			close(f.done)
+		}
+	}()
+}
+
+// getLeaf returns the leaf at pos in the current level 1 node, keeping
+// a window of the leaves after it in flight.
+func (r *Reader) getLeaf(pos int) ([]byte, error) {
+	if r.prefetch <= 0 {
+		var hash [32]byte
+		copy(hash[:], r.lvls[1][pos+8:pos+40])
+		return r.store.Get(hash)
+	}
+	for len(r.fetches) != 0 && r.fetches[0].pos < pos {
+		r.fetches = r.fetches[1:]
+	}
+	if len(r.fetches) != 0 && r.fetches[0].pos != pos {
+		r.dropFetches()
+	}
+	// The window is refilled once half of it has been read, so the
+	// store sees batches of leaves rather than one at a time.
+	if len(r.fetches) <= r.prefetch/2 {
+		next := pos
+		if len(r.fetches) != 0 {
+			next = r.fetches[len(r.fetches)-1].pos + 40
+		}
+		positions := []int{}
+		for ; next < r.length[1] && len(r.fetches)+len(positions) <= r.prefetch; next += 40 {
+			positions = append(positions, next)
+		}
+		if len(positions) != 0 {
+			r.startFetches(positions)
+		}
+	}
+	f := r.fetches[0]
+	r.fetches = r.fetches[1:]
+	<-f.done
+	return f.data, f.err
+}
+
+// Close waits for any prefetches still running.
+func (r *Reader) Close() error {
+	r.dropFetches()
+	r.fetching.Wait()
+	return nil
+}
+
 func (r *Reader) Seek(absoff uint64) (uint64, error) {
 	buf, err := r.store.Get(r.root)
 	if err != nil {
@@ -47,6 +146,7 @@ func (r *Reader) Seek(absoff uint64) (uint64, error) {
 	r.pos[lvl] = 1
 	r.height = lvl
 	copy(r.lvls[lvl][:], buf)
+	r.dropFetches()
 	curoff := uint64(0)
 	for lvl != 0 {
 		for {
@@ -118,11 +218,20 @@ func (r *Reader) next(lvl int) (bool, error) {
 			return true, nil
 		}
 	}
-	copy(hash[:], r.lvls[lvl+1][r.pos[lvl+1]+8:maxlen])
-	buf, err := r.store.Get(hash)
+	var buf []byte
+	var err error
+	if lvl == 0 {
+		buf, err = r.getLeaf(r.pos[1])
+	} else {
+		copy(hash[:], r.lvls[lvl+1][r.pos[lvl+1]+8:maxlen])
+		buf, err = r.store.Get(hash)
+	}
 	if err != nil {
 		return false, err
 	}
+	if lvl == 1 {
+		r.dropFetches()
+	}
 	copy(r.lvls[lvl][0:len(buf)], buf)
 	r.pos[lvl+1] += 40
 	r.length[lvl] = len(buf)
@@ -0,0 +1,310 @@
+package progress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrBadSize = errors.New("bad size, expected bytes with an optional K, M or G suffix")
+
+type Counter int
+
+const (
+	// Files stored, fetched or archived.
+	Files Counter = iota
+	// Bytes read from the source of a copy.
+	BytesIn
+	// Bytes written to the destination of a copy.
+	BytesOut
+	// Chunks added to a pack, and chunks the store already had.
+	NewChunks
+	DupChunks
+	// Compressed chunk data written to packs.
+	BytesUploaded
+	PacksScanned
+	BytesMoved
+	BytesDeleted
+	numCounters
+)
+
+var counterNames = [numCounters]string{
+	"files",
+	"bytes_in",
+	"bytes_out",
+	"new_chunks",
+	"dup_chunks",
+	"bytes_uploaded",
+	"packs_scanned",
+	"bytes_moved",
+	"bytes_deleted",
+}
+
+var counterLabels = [numCounters]string{
+	"files",
+	"in",
+	"out",
+	"new chunks",
+	"dup chunks",
+	"uploaded",
+	"packs scanned",
+	"moved",
+	"deleted",
+}
+
+func (c Counter) String() string {
+	return counterNames[c]
+}
+
+func (c Counter) isBytes() bool {
+	switch c {
+	case BytesIn, BytesOut, BytesUploaded, BytesMoved, BytesDeleted:
+		return true
+	}
+	return false
+}
+
+type Mode int
+
+const (
+	// Summary only writes a line when the operation finishes.
+	Summary Mode = iota
+	// Live rewrites a single terminal line while the operation runs.
+	Live
+	// JSON writes a progress event per interval and a summary event, one per line.
+	JSON
+)
+
+// Progress collects counters from the packages doing the work. All methods
+// may be called on a nil *Progress, which discards the counts.
+type Progress struct {
+	Op       string
+	start    time.Time
+	counters [numCounters]int64
+
+	lock     sync.Mutex
+	out      io.Writer
+	mode     Mode
+	stop     chan struct{}
+	stopped  chan struct{}
+	finished bool
+	lastLen  int
+}
+
+func New(op string) *Progress {
+	return &Progress{
+		Op:    op,
+		start: time.Now(),
+	}
+}
+
+func (p *Progress) Add(c Counter, n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.counters[c], n)
+}
+
+func (p *Progress) Get(c Counter) int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.counters[c])
+}
+
+// Reader counts the bytes read through r as c.
+func (p *Progress) Reader(r io.Reader, c Counter) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReader{r: r, p: p, c: c}
+}
+
+// Writer counts the bytes written through w as c.
+func (p *Progress) Writer(w io.Writer, c Counter) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &countingWriter{w: w, p: p, c: c}
+}
+
+type countingReader struct {
+	r io.Reader
+	p *Progress
+	c Counter
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.p.Add(r.c, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	p *Progress
+	c Counter
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.p.Add(w.c, int64(n))
+	return n, err
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseBytes parses a size such as 512K or 2M, suffixes are powers of 1024.
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, ErrBadSize
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1024
+	case "M":
+		mult = 1024 * 1024
+	case "G":
+		mult = 1024 * 1024 * 1024
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, ErrBadSize
+	}
+	return v * mult, nil
+}
+
+// String renders the non zero counters on a single line.
+func (p *Progress) String() string {
+	elapsed := time.Since(p.start)
+	parts := []string{p.Op}
+	for c := Counter(0); c < numCounters; c++ {
+		v := p.Get(c)
+		if v == 0 {
+			continue
+		}
+		if c.isBytes() {
+			parts = append(parts, fmt.Sprintf("%s %s", counterLabels[c], FormatBytes(v)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s %d", counterLabels[c], v))
+		}
+	}
+	transferred := p.Get(BytesUploaded) + p.Get(BytesOut) + p.Get(BytesMoved)
+	if transferred == 0 {
+		transferred = p.Get(BytesIn)
+	}
+	if elapsed > 0 && transferred > 0 {
+		parts = append(parts, FormatBytes(int64(float64(transferred)/elapsed.Seconds()))+"/s")
+	}
+	parts = append(parts, elapsed.Truncate(time.Second).String())
+	return strings.Join(parts, ", ")
+}
+
+// Event returns the counters as a JSON object with the given event type.
+func (p *Progress) Event(typ string) map[string]interface{} {
+	ev := map[string]interface{}{
+		"type":    typ,
+		"op":      p.Op,
+		"elapsed": time.Since(p.start).Seconds(),
+	}
+	for c := Counter(0); c < numCounters; c++ {
+		ev[counterNames[c]] = p.Get(c)
+	}
+	return ev
+}
+
+func (p *Progress) write(typ string) {
+	switch p.mode {
+	case JSON:
+		buf, err := json.Marshal(p.Event(typ))
+		if err != nil {
+			return
+		}
+		p.out.Write(append(buf, '\n'))
+	case Live:
+		line := p.String()
+		pad := ""
+		if len(line) < p.lastLen {
+			pad = strings.Repeat(" ", p.lastLen-len(line))
+		}
+		p.lastLen = len(line)
+		end := ""
+		if typ == "summary" {
+			end = "\n"
+		}
+		fmt.Fprintf(p.out, "\r%s%s%s", line, pad, end)
+	case Summary:
+		if typ == "summary" {
+			fmt.Fprintf(p.out, "%s\n", p.String())
+		}
+	}
+}
+
+// Report writes progress to out every interval until Finish is called.
+func (p *Progress) Report(out io.Writer, mode Mode, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.out = out
+	p.mode = mode
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.lock.Lock()
+				p.write("progress")
+				p.lock.Unlock()
+			}
+		}
+	}()
+}
+
+// Finish stops reporting and writes the final summary.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	if p.finished || p.out == nil {
+		p.lock.Unlock()
+		return
+	}
+	p.finished = true
+	close(p.stop)
+	p.lock.Unlock()
+	<-p.stopped
+	p.lock.Lock()
+	p.write("summary")
+	p.lock.Unlock()
+}
@@ -0,0 +1,108 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	p := New("put")
+	_, err := ioutil.ReadAll(p.Reader(strings.NewReader("hello"), BytesIn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Writer(ioutil.Discard, BytesOut).Write([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Add(Files, 2)
+	if p.Get(BytesIn) != 5 || p.Get(BytesOut) != 3 || p.Get(Files) != 2 {
+		t.Fatal("bad counts")
+	}
+	line := p.String()
+	if !strings.HasPrefix(line, "put, files 2, in 5 B, out 3 B") {
+		t.Fatalf("bad line %q", line)
+	}
+
+	var nilp *Progress
+	nilp.Add(Files, 1)
+	nilp.Report(ioutil.Discard, Live, time.Millisecond)
+	nilp.Finish()
+	if nilp.Get(Files) != 0 {
+		t.Fatal("nil progress counted")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:                  "0 B",
+		1023:               "1023 B",
+		1024:               "1.0 KiB",
+		1536:               "1.5 KiB",
+		5 * 1024 * 1024:    "5.0 MiB",
+		1024 * 1024 * 1024: "1.0 GiB",
+	} {
+		if FormatBytes(n) != expected {
+			t.Fatalf("%d: got %s expected %s", n, FormatBytes(n), expected)
+		}
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	var out bytes.Buffer
+	p := New("gc")
+	p.Report(&out, JSON, time.Millisecond)
+	p.Add(PacksScanned, 3)
+	time.Sleep(20 * time.Millisecond)
+	p.Add(BytesDeleted, 100)
+	p.Finish()
+	p.Finish()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected progress and summary events, got %q", out.String())
+	}
+	var ev map[string]interface{}
+	err := json.Unmarshal([]byte(lines[len(lines)-1]), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev["type"] != "summary" || ev["op"] != "gc" || ev["packs_scanned"] != 3.0 || ev["bytes_deleted"] != 100.0 {
+		t.Fatalf("bad summary event %v", ev)
+	}
+	err = json.Unmarshal([]byte(lines[0]), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev["type"] != "progress" {
+		t.Fatalf("bad progress event %v", ev)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"0":    0,
+		"100":  100,
+		"512K": 512 * 1024,
+		"2m":   2 * 1024 * 1024,
+		"1G":   1024 * 1024 * 1024,
+	} {
+		v, err := ParseBytes(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("%s: got %d expected %d", s, v, expected)
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "1.5M", "big"} {
+		_, err := ParseBytes(s)
+		if err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
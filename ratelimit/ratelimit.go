@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy/progress"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadRate     = errors.New("bad rate, expected bytes per second with an optional K, M or G suffix")
+	ErrBadSchedule = errors.New("bad schedule, expected comma separated HH:MM-HH:MM ranges")
+)
+
+// ParseRate parses a rate in bytes per second such as 512K or 2M,
+// suffixes are powers of 1024. An empty string or 0 means no limit.
+func ParseRate(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	v, err := progress.ParseBytes(s)
+	if err != nil {
+		return 0, ErrBadRate
+	}
+	return v, nil
+}
+
+type Range struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// A Schedule is a set of daily local time ranges, a range whose end is before
+// its start wraps past midnight. An empty schedule covers the whole day.
+type Schedule []Range
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, ErrBadSchedule
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	if strings.TrimSpace(s) == "" {
+		return sched, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		times := strings.Split(r, "-")
+		if len(times) != 2 {
+			return nil, ErrBadSchedule
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		sched = append(sched, Range{Start: start, End: end})
+	}
+	return sched, nil
+}
+
+func (s Schedule) Active(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, r := range s {
+		if r.Start <= r.End {
+			if tod >= r.Start && tod < r.End {
+				return true
+			}
+		} else if tod >= r.Start || tod < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schedule) String() string {
+	var ranges []string
+	for _, r := range s {
+		ranges = append(ranges, fmt.Sprintf("%02d:%02d-%02d:%02d",
+			int(r.Start.Hours()), int(r.Start.Minutes())%60, int(r.End.Hours()), int(r.End.Minutes())%60))
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Limiter is a token bucket allowing one second of burst, it only
+// limits while its schedule is active. A nil Limiter never waits.
+type Limiter struct {
+	lock     sync.Mutex
+	rate     float64
+	schedule Schedule
+	tokens   float64
+	last     time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewLimiter returns nil if rate is 0.
+func NewLimiter(rate int64, schedule Schedule) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:     float64(rate),
+		schedule: schedule,
+		tokens:   float64(rate),
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Wait takes n bytes worth of tokens, sleeping until the bucket
+// has refilled if that puts it into debt.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := l.now()
+	if !l.schedule.Active(now) {
+		l.tokens = l.rate
+		l.last = now
+		l.lock.Unlock()
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if d > 0 {
+		l.sleep(d)
+	}
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"":     0,
+		"0":    0,
+		"100":  100,
+		"512K": 512 * 1024,
+		"2m":   2 * 1024 * 1024,
+		"1G":   1024 * 1024 * 1024,
+	} {
+		v, err := ParseRate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("%s: got %d expected %d", s, v, expected)
+		}
+	}
+	for _, s := range []string{"K", "-1", "1.5M", "fast"} {
+		_, err := ParseRate(s)
+		if err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	sched, err := ParseSchedule("08:00-18:00,22:30-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sched.String() != "08:00-18:00,22:30-06:00" {
+		t.Fatalf("bad schedule string %s", sched.String())
+	}
+	for hm, active := range map[string]bool{
+		"07:59": false,
+		"08:00": true,
+		"17:59": true,
+		"18:00": false,
+		"22:29": false,
+		"23:00": true,
+		"00:00": true,
+		"05:59": true,
+		"06:00": false,
+	} {
+		tm, err := time.Parse("15:04", hm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sched.Active(tm) != active {
+			t.Fatalf("%s: expected active=%v", hm, active)
+		}
+	}
+
+	for _, s := range []string{"08:00", "8-18", "08:00-25:00"} {
+		_, err := ParseSchedule(s)
+		if err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.Local)
+	slept := time.Duration(0)
+	l := NewLimiter(1000, nil)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	l.last = now
+
+	// The first second of data is a burst.
+	l.Wait(1000)
+	if slept != 0 {
+		t.Fatalf("unexpected sleep %s", slept)
+	}
+	for i := 0; i < 10; i++ {
+		l.Wait(500)
+	}
+	if slept != 5*time.Second {
+		t.Fatalf("expected 5s of sleep, got %s", slept)
+	}
+
+	night, err := ParseSchedule("00:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.schedule = night
+	slept = 0
+	for i := 0; i < 10; i++ {
+		l.Wait(1000)
+	}
+	if slept != 0 {
+		t.Fatal("limiter waited outside of its schedule")
+	}
+
+	var nilLimiter *Limiter
+	nilLimiter.Wait(1000)
+	if NewLimiter(0, nil) != nil {
+		t.Fatal("expected no limiter for rate 0")
+	}
+}
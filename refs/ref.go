@@ -79,20 +79,28 @@ func PutRef(store bpy.CStore, ref Ref) ([32]byte, error) {
 }
 
 func GetAtTime(store bpy.CStore, ref Ref, at time.Time) (Ref, bool, error) {
+	_, ref, ok, err := GetHashAtTime(store, [32]byte{}, ref, at)
+	return ref, ok, err
+}
+
+// GetHashAtTime is GetAtTime for the ref stored at hash, also returning
+// the hash of the ref it finds.
+func GetHashAtTime(store bpy.CStore, hash [32]byte, ref Ref, at time.Time) ([32]byte, Ref, bool, error) {
 	atUnix := at.Unix()
 	for {
 		if atUnix >= ref.CreatedAt {
-			return ref, true, nil
+			return hash, ref, true, nil
 		}
 
 		if ref.HasPrev == false {
-			return Ref{}, false, nil
+			return [32]byte{}, Ref{}, false, nil
 		}
 
 		prevRef, err := GetRef(store, ref.Prev)
 		if err != nil {
-			return Ref{}, false, err
+			return [32]byte{}, Ref{}, false, err
 		}
+		hash = ref.Prev
 		ref = prevRef
 	}
 }
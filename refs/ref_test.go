@@ -107,6 +107,27 @@ func TestGetAt(t *testing.T) {
 		t.Fatal("incorrect root value", got.Root[0])
 	}
 
+	gotHash, got, ok, err := GetHashAtTime(store, hash, ref, time.Unix(5, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected ok")
+	}
+	atHash, err := GetRef(store, gotHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(atHash, got) || got.Root[0] != 5 {
+		t.Fatal("hash does not match the ref found")
+	}
+	gotHash, _, _, err = GetHashAtTime(store, hash, ref, time.Unix(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotHash != hash {
+		t.Fatal("expected the hash of the latest ref")
+	}
 }
 
 func TestGetNVersionsAgo(t *testing.T) {
@@ -2,9 +2,11 @@ package client
 
 import (
 	"errors"
+	"github.com/buppyio/bpy/ratelimit"
 	"github.com/buppyio/bpy/remote/proto"
 	"io"
 	"sync"
+	"time"
 )
 
 type ReadWriteCloser interface {
@@ -13,30 +15,53 @@ type ReadWriteCloser interface {
 	io.Closer
 }
 
+type DialFunc func() (ReadWriteCloser, error)
+
 var (
-	ErrClientClosed = errors.New("client closed")
-	ErrTooManyCalls = errors.New("too many calls in progress")
-	ErrTooManyFiles = errors.New("too many open files")
-	ErrTooManyPacks = errors.New("too many open pack uploads")
-	ErrBadResponse  = errors.New("server sent bad response")
-	ErrDisconnected = errors.New("connection disconnected")
-	ErrNoSuchPid    = errors.New("no such pack id")
+	ErrClientClosed  = errors.New("client closed")
+	ErrTooManyCalls  = errors.New("too many calls in progress")
+	ErrTooManyFiles  = errors.New("too many open files")
+	ErrTooManyPacks  = errors.New("too many open pack uploads")
+	ErrBadResponse   = errors.New("server sent bad response")
+	ErrDisconnected  = errors.New("connection disconnected")
+	ErrNoSuchPid     = errors.New("no such pack id")
+	ErrResumeFailed  = errors.New("server lost acknowledged pack data")
+	ErrPackCommitted = errors.New("pack already committed")
+)
+
+const (
+	DefaultMaxRetries = 5
+	DefaultRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 30 * time.Second
 )
 
 type Client struct {
-	conn ReadWriteCloser
+	dial  DialFunc
+	keyId string
+
+	// Only used when the client was created with Dial.
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// Throttle pack uploads and file reads, nil means unlimited.
+	UploadLimit   *ratelimit.Limiter
+	DownloadLimit *ratelimit.Limiter
 
 	maxMessageSizeLock sync.RWMutex
 	maxMessageSize     uint32
 
 	wLock sync.Mutex
 	wBuf  []byte
-	rBuf  []byte
 
-	midLock  sync.Mutex
-	mIdCount uint16
-	closed   bool
-	calls    map[uint16]chan proto.Message
+	midLock   sync.Mutex
+	mIdCount  uint16
+	closed    bool
+	connected bool
+	conn      ReadWriteCloser
+	gen       uint64
+	calls     map[uint16]chan proto.Message
+
+	reconnectLock sync.Mutex
 
 	fidLock  sync.Mutex
 	fidCount uint32
@@ -44,7 +69,19 @@ type Client struct {
 
 	pidLock  sync.Mutex
 	pidCount uint32
-	pids     map[uint32]error
+	pids     map[uint32]*packState
+}
+
+// packState tracks the write window the server granted an upload
+// on the connection generation gen.
+type packState struct {
+	err          error
+	gen          uint64
+	disconnected bool
+	window       uint64
+	sent         uint64
+	acked        uint64
+	cond         *sync.Cond
 }
 
 func (c *Client) getMaxMessageSize() uint32 {
@@ -59,14 +96,13 @@ func (c *Client) setMaxMessageSize(sz uint32) {
 	c.wLock.Lock()
 	c.maxMessageSize = sz
 	c.wBuf = make([]byte, sz, sz)
-	c.rBuf = make([]byte, sz, sz)
 	c.wLock.Unlock()
 	c.maxMessageSizeLock.Unlock()
 }
 
-func readMessages(c *Client) {
+func readMessages(c *Client, conn ReadWriteCloser, gen uint64, rBuf []byte) {
 	for {
-		m, err := proto.ReadMessage(c.conn, c.rBuf)
+		m, err := proto.ReadMessage(conn, rBuf)
 		if err != nil {
 			break
 		}
@@ -75,70 +111,208 @@ func readMessages(c *Client) {
 			switch m := m.(type) {
 			case *proto.RPackError:
 				c.setPidError(m.Pid, errors.New(m.Message))
+			case *proto.RPackAck:
+				c.packAcked(m.Pid, gen, m.Size)
 			default:
 				continue
 			}
 		}
 		c.midLock.Lock()
-		ch, ok := c.calls[mid]
-		if ok {
-			ch <- m
+		if c.gen == gen {
+			ch, ok := c.calls[mid]
+			if ok {
+				ch <- m
+			}
 		}
 		c.midLock.Unlock()
 	}
-	c.Close()
+	c.disconnect(gen)
 }
 
+func newClient(keyId string) *Client {
+	return &Client{
+		keyId:      keyId,
+		MaxRetries: DefaultMaxRetries,
+		RetryDelay: DefaultRetryDelay,
+		calls:      make(map[uint16]chan proto.Message),
+		fids:       make(map[uint32]struct{}),
+		pids:       make(map[uint32]*packState),
+	}
+}
+
+// Attach creates a client on an existing connection, the client
+// is closed when the connection fails.
 func Attach(conn ReadWriteCloser, keyId string) (*Client, error) {
-	maxsz := uint32(1024 * 1024)
-	c := &Client{
-		conn:  conn,
-		calls: make(map[uint16]chan proto.Message),
-		fids:  make(map[uint32]struct{}),
-		pids:  make(map[uint32]error),
+	c := newClient(keyId)
+	err := c.attach(conn)
+	if err != nil {
+		return nil, err
 	}
+	return c, nil
+}
+
+// Dial creates a client that redials and reattaches with bounded retries
+// when the connection fails. Open files are reopened and pack uploads are
+// resumed from the last offset the server acknowledged.
+func Dial(dial DialFunc, keyId string) (*Client, error) {
+	c := newClient(keyId)
+	c.dial = dial
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	err = c.attach(conn)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) attach(conn ReadWriteCloser) error {
+	maxsz := uint32(1024 * 1024)
+	rBuf := make([]byte, maxsz, maxsz)
 	c.setMaxMessageSize(maxsz)
-	err := c.WriteMessage(&proto.TAttach{
+	c.wLock.Lock()
+	err := proto.WriteMessage(conn, &proto.TAttach{
 		Mid:            1,
 		MaxMessageSize: maxsz,
-		Version:        "buppy1",
-		KeyId:          keyId,
-	})
+		Version:        proto.Version,
+		KeyId:          c.keyId,
+	}, c.wBuf)
+	c.wLock.Unlock()
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return err
 	}
-	resp, err := proto.ReadMessage(c.conn, c.rBuf)
+	resp, err := proto.ReadMessage(conn, rBuf)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return err
 	}
 	mid := proto.GetMessageId(resp)
 	if mid != 1 {
 		conn.Close()
-		return nil, ErrBadResponse
+		return ErrBadResponse
 	}
 	switch resp := resp.(type) {
 	case *proto.RAttach:
 		if resp.MaxMessageSize > maxsz || resp.Mid != 1 {
-			return nil, ErrBadResponse
+			conn.Close()
+			return ErrBadResponse
 		}
 		c.setMaxMessageSize(resp.MaxMessageSize)
-		go readMessages(c)
-		return c, nil
+		c.midLock.Lock()
+		if c.closed {
+			c.midLock.Unlock()
+			conn.Close()
+			return ErrClientClosed
+		}
+		c.gen += 1
+		c.conn = conn
+		c.connected = true
+		go readMessages(c, conn, c.gen, rBuf[:resp.MaxMessageSize])
+		c.midLock.Unlock()
+		return nil
 	case *proto.RError:
 		conn.Close()
-		return nil, errors.New(resp.Message)
+		return errors.New(resp.Message)
 	default:
 		conn.Close()
-		return nil, ErrBadResponse
+		return ErrBadResponse
 	}
 }
 
-func (c *Client) Close() error {
+func (c *Client) disconnect(gen uint64) {
+	c.midLock.Lock()
+	if c.gen != gen || !c.connected {
+		c.midLock.Unlock()
+		return
+	}
+	for mid, ch := range c.calls {
+		close(ch)
+		delete(c.calls, mid)
+	}
+	c.connected = false
+	c.conn.Close()
+	if c.dial == nil {
+		c.closed = true
+	}
+	c.midLock.Unlock()
+	c.packsDisconnected(gen)
+}
+
+func (c *Client) isConnected(gen uint64) bool {
 	c.midLock.Lock()
 	defer c.midLock.Unlock()
+	return c.connected && c.gen == gen
+}
+
+func (c *Client) generation() uint64 {
+	c.midLock.Lock()
+	defer c.midLock.Unlock()
+	return c.gen
+}
+
+// reconnect redials unless another caller already replaced
+// the connection that failed at generation gen.
+func (c *Client) reconnect(gen uint64) error {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+
+	c.midLock.Lock()
+	closed := c.closed
+	current := c.gen
+	c.midLock.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if current != gen {
+		return nil
+	}
+	c.disconnect(gen)
+
+	var err error
+	delay := c.RetryDelay
+	for i := 0; i < c.MaxRetries; i++ {
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		var conn ReadWriteCloser
+		conn, err = c.dial()
+		if err != nil {
+			continue
+		}
+		err = c.attach(conn)
+		if err == nil || err == ErrClientClosed {
+			return err
+		}
+	}
+	return err
+}
+
+// withRetry runs f, redialing and running it again if the connection fails.
+// f is passed the connection generation so it can restore any per
+// connection server state such as open files.
+func (c *Client) withRetry(f func(gen uint64) error) error {
+	for attempt := 0; ; attempt++ {
+		gen := c.generation()
+		err := f(gen)
+		if err != ErrDisconnected || c.dial == nil || attempt >= c.MaxRetries {
+			return err
+		}
+		err = c.reconnect(gen)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	c.midLock.Lock()
 	if c.closed {
+		c.midLock.Unlock()
 		return nil
 	}
 
@@ -146,7 +320,13 @@ func (c *Client) Close() error {
 		close(ch)
 	}
 	c.closed = true
-	c.conn.Close()
+	gen := c.gen
+	if c.connected {
+		c.connected = false
+		c.conn.Close()
+	}
+	c.midLock.Unlock()
+	c.packsDisconnected(gen)
 	return nil
 }
 
@@ -154,7 +334,7 @@ func (c *Client) newCall() (chan proto.Message, uint16, error) {
 	c.midLock.Lock()
 	defer c.midLock.Unlock()
 
-	if c.closed {
+	if c.closed || !c.connected {
 		return nil, 0, ErrDisconnected
 	}
 
@@ -198,6 +378,24 @@ func (c *Client) Call(m proto.Message, ch chan proto.Message, mid uint16) (proto
 	}
 }
 
+func (c *Client) call(mkMessage func(mid uint16) proto.Message) (proto.Message, error) {
+	ch, mid, err := c.newCall()
+	if err != nil {
+		return nil, err
+	}
+	return c.Call(mkMessage(mid), ch, mid)
+}
+
+func (c *Client) retryCall(mkMessage func(mid uint16) proto.Message) (proto.Message, error) {
+	var resp proto.Message
+	err := c.withRetry(func(gen uint64) error {
+		var err error
+		resp, err = c.call(mkMessage)
+		return err
+	})
+	return resp, err
+}
+
 func (c *Client) nextFid() (uint32, error) {
 	c.fidLock.Lock()
 	defer c.fidLock.Unlock()
@@ -225,23 +423,49 @@ func (c *Client) freeFid(fid uint32) {
 }
 
 func (c *Client) WriteMessage(m proto.Message) error {
+	c.midLock.Lock()
+	conn := c.conn
+	gen := c.gen
+	connected := c.connected
+	c.midLock.Unlock()
+	if !connected {
+		return ErrDisconnected
+	}
 	c.wLock.Lock()
-	defer c.wLock.Unlock()
-	return proto.WriteMessage(c.conn, m, c.wBuf)
+	err := proto.WriteMessage(conn, m, c.wBuf)
+	c.wLock.Unlock()
+	if err != nil {
+		switch err {
+		case proto.ErrMsgTooLarge, proto.ErrStrTooLarge:
+			return err
+		}
+		c.disconnect(gen)
+		return ErrDisconnected
+	}
+	return nil
 }
 
+// TCasRoot is not resent when the connection fails, the swap may have
+// succeeded with only the reply lost. The root is read again after
+// reconnecting instead, and the swap failed unless it holds the new value,
+// so callers retry as they do after another client changed the root first.
 func (c *Client) TCasRoot(newValue, newVersion, signature, epoch string) (*proto.RCasRoot, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TCasRoot{
+			Mid:       mid,
+			Value:     newValue,
+			Version:   newVersion,
+			Signature: signature,
+			Epoch:     epoch,
+		}
+	})
+	if err == ErrDisconnected && c.dial != nil {
+		root, err := c.TGetRoot()
+		if err != nil {
+			return nil, err
+		}
+		return &proto.RCasRoot{Ok: root.Ok && root.Value == newValue && root.Version == newVersion}, nil
 	}
-	resp, err := c.Call(&proto.TCasRoot{
-		Mid:       mid,
-		Value:     newValue,
-		Version:   newVersion,
-		Signature: signature,
-		Epoch:     epoch,
-	}, ch, mid)
 	if err != nil {
 		return nil, err
 	}
@@ -254,13 +478,11 @@ func (c *Client) TCasRoot(newValue, newVersion, signature, epoch string) (*proto
 }
 
 func (c *Client) TGetRoot() (*proto.RGetRoot, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TGetRoot{
-		Mid: mid,
-	}, ch, mid)
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TGetRoot{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -273,15 +495,13 @@ func (c *Client) TGetRoot() (*proto.RGetRoot, error) {
 }
 
 func (c *Client) TRemove(path, epoch string) (*proto.RRemove, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TRemove{
-		Mid:   mid,
-		Path:  path,
-		Epoch: epoch,
-	}, ch, mid)
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TRemove{
+			Mid:   mid,
+			Path:  path,
+			Epoch: epoch,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -294,15 +514,13 @@ func (c *Client) TRemove(path, epoch string) (*proto.RRemove, error) {
 }
 
 func (c *Client) TOpen(fid uint32, name string) (*proto.ROpen, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TOpen{
-		Mid:  mid,
-		Fid:  fid,
-		Name: name,
-	}, ch, mid)
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TOpen{
+			Mid:  mid,
+			Fid:  fid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -315,16 +533,14 @@ func (c *Client) TOpen(fid uint32, name string) (*proto.ROpen, error) {
 }
 
 func (c *Client) TReadAt(fid uint32, offset uint64, size uint32) (*proto.RReadAt, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TReadAt{
-		Mid:    mid,
-		Fid:    fid,
-		Offset: offset,
-		Size:   size,
-	}, ch, mid)
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TReadAt{
+			Mid:    mid,
+			Fid:    fid,
+			Offset: offset,
+			Size:   size,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -336,15 +552,59 @@ func (c *Client) TReadAt(fid uint32, offset uint64, size uint32) (*proto.RReadAt
 	}
 }
 
-func (c *Client) TClose(fid uint32) (*proto.RClose, error) {
+// TReadV reads the ranges in one request, f is called with the data of
+// each range in order as it arrives, possibly over several calls.
+func (c *Client) TReadV(ranges []proto.ReadRange, f func(idx int, data []byte)) error {
 	ch, mid, err := c.newCall()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	resp, err := c.Call(&proto.TClose{
-		Mid: mid,
-		Fid: fid,
-	}, ch, mid)
+	defer func() {
+		c.midLock.Lock()
+		delete(c.calls, mid)
+		c.midLock.Unlock()
+	}()
+	err = c.WriteMessage(&proto.TReadV{
+		Mid:    mid,
+		Ranges: proto.PackReadRanges(ranges),
+	})
+	if err != nil {
+		return err
+	}
+	// Responses must be drained until the last one, even after an error.
+	var respErr error
+	for {
+		resp, ok := <-ch
+		if !ok {
+			return ErrDisconnected
+		}
+		switch resp := resp.(type) {
+		case *proto.RError:
+			return errors.New(resp.Message)
+		case *proto.RReadV:
+			if resp.Done {
+				return respErr
+			}
+			if int(resp.Index) >= len(ranges) {
+				respErr = ErrBadResponse
+				continue
+			}
+			if respErr == nil {
+				f(int(resp.Index), resp.Data)
+			}
+		default:
+			respErr = ErrBadResponse
+		}
+	}
+}
+
+func (c *Client) TClose(fid uint32) (*proto.RClose, error) {
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TClose{
+			Mid: mid,
+			Fid: fid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -356,15 +616,14 @@ func (c *Client) TClose(fid uint32) (*proto.RClose, error) {
 	}
 }
 
-func (c *Client) TNewPack(pid uint32) (*proto.RNewPack, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TNewPack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+func (c *Client) TNewPack(pid uint32, name string) (*proto.RNewPack, error) {
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TNewPack{
+			Mid:  mid,
+			Pid:  pid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -384,14 +643,12 @@ func (c *Client) TWritePack(pid uint32, data []byte) error {
 }
 
 func (c *Client) TClosePack(pid uint32) (*proto.RClosePack, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TClosePack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TClosePack{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -404,33 +661,69 @@ func (c *Client) TClosePack(pid uint32) (*proto.RClosePack, error) {
 }
 
 func (c *Client) TCancelPack(pid uint32) (*proto.RCancelPack, error) {
-	ch, mid, err := c.newCall()
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TCancelPack{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TCancelPack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RCancelPack:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TPackSize(pid uint32) (*proto.RPackSize, error) {
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TPackSize{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
 	switch resp := resp.(type) {
-	case *proto.RCancelPack:
+	case *proto.RPackSize:
 		return resp, nil
 	default:
 		return nil, ErrBadResponse
 	}
 }
 
-func (c *Client) TGetEpoch() (*proto.RGetEpoch, error) {
-	ch, mid, err := c.newCall()
+func (c *Client) TResumePack(pid uint32, name string) (*proto.RResumePack, error) {
+	resp, err := c.call(func(mid uint16) proto.Message {
+		return &proto.TResumePack{
+			Mid:  mid,
+			Pid:  pid,
+			Name: name,
+		}
+	})
+	if err != nil && err.Error() == proto.ErrPackBusy.Error() {
+		return nil, proto.ErrPackBusy
+	}
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TGetEpoch{
-		Mid: mid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RResumePack:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TGetEpoch() (*proto.RGetEpoch, error) {
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TGetEpoch{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -443,13 +736,11 @@ func (c *Client) TGetEpoch() (*proto.RGetEpoch, error) {
 }
 
 func (c *Client) TStartGC() (*proto.RStartGC, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TStartGC{
-		Mid: mid,
-	}, ch, mid)
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TStartGC{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -461,14 +752,30 @@ func (c *Client) TStartGC() (*proto.RStartGC, error) {
 	}
 }
 
-func (c *Client) TStopGC() (*proto.RStopGC, error) {
-	ch, mid, err := c.newCall()
+func (c *Client) TFenceGC(epoch string) (*proto.RFenceGC, error) {
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TFenceGC{
+			Mid:   mid,
+			Epoch: epoch,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TStopGC{
-		Mid: mid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RFenceGC:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TStopGC() (*proto.RStopGC, error) {
+	resp, err := c.retryCall(func(mid uint16) proto.Message {
+		return &proto.TStopGC{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -490,7 +797,7 @@ func (c *Client) nextPid() (uint32, error) {
 		}
 		_, ok := c.pids[pid]
 		if !ok {
-			c.pids[pid] = nil
+			c.pids[pid] = &packState{cond: sync.NewCond(&c.pidLock)}
 			return pid, nil
 		}
 		pid += 1
@@ -500,21 +807,84 @@ func (c *Client) nextPid() (uint32, error) {
 func (c *Client) checkPidError(pid uint32) error {
 	c.pidLock.Lock()
 	defer c.pidLock.Unlock()
-	err, ok := c.pids[pid]
+	st, ok := c.pids[pid]
 	if !ok {
 		return ErrNoSuchPid
 	}
-	return err
+	return st.err
 }
 
 func (c *Client) setPidError(pid uint32, err error) {
 	c.pidLock.Lock()
 	defer c.pidLock.Unlock()
-	err, ok := c.pids[pid]
+	st, ok := c.pids[pid]
+	if !ok {
+		return
+	}
+	st.err = err
+	st.cond.Broadcast()
+}
+
+// resetPackWindow starts a new write window after the server
+// opened or resumed the pack on connection generation gen.
+func (c *Client) resetPackWindow(pid uint32, gen uint64, size uint64, window uint32) {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	st, ok := c.pids[pid]
 	if !ok {
 		return
 	}
-	c.pids[pid] = err
+	st.gen = gen
+	st.disconnected = !c.isConnected(gen)
+	st.window = uint64(window)
+	st.sent = size
+	st.acked = size
+	st.cond.Broadcast()
+}
+
+func (c *Client) packAcked(pid uint32, gen uint64, size uint64) {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	st, ok := c.pids[pid]
+	if !ok || st.gen != gen || size <= st.acked || size > st.sent {
+		return
+	}
+	st.acked = size
+	st.cond.Broadcast()
+}
+
+func (c *Client) packsDisconnected(gen uint64) {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	for _, st := range c.pids {
+		if st.gen == gen {
+			st.disconnected = true
+			st.cond.Broadcast()
+		}
+	}
+}
+
+// waitPackWindow blocks until n more bytes fit in the write window and
+// reserves them, it returns the size the server has acknowledged so far.
+func (c *Client) waitPackWindow(pid uint32, n uint64) (uint64, error) {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	st, ok := c.pids[pid]
+	if !ok {
+		return 0, ErrNoSuchPid
+	}
+	// A single write larger than the window is allowed once nothing is in flight.
+	for st.err == nil && !st.disconnected && st.sent != st.acked && st.sent+n-st.acked > st.window {
+		st.cond.Wait()
+	}
+	if st.err != nil {
+		return 0, st.err
+	}
+	if st.disconnected {
+		return 0, ErrDisconnected
+	}
+	st.sent += n
+	return st.acked, nil
 }
 
 func (c *Client) freePid(pid uint32) {
@@ -531,29 +901,26 @@ func (c *Client) NewPack(name string) (*Pack, error) {
 	if err != nil {
 		return nil, err
 	}
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TNewPack{
-		Mid:  mid,
-		Pid:  pid,
-		Name: name,
-	}, ch, mid)
+	var gen uint64
+	err = c.withRetry(func(g uint64) error {
+		gen = g
+		resp, err := c.TNewPack(pid, name)
+		if err != nil {
+			return err
+		}
+		c.resetPackWindow(pid, gen, 0, resp.Window)
+		return nil
+	})
 	if err != nil {
 		c.freePid(pid)
 		return nil, err
 	}
-	switch resp.(type) {
-	case *proto.RNewPack:
-		return &Pack{
-			c:   c,
-			pid: pid,
-		}, nil
-	default:
-		c.freePid(pid)
-		return nil, ErrBadResponse
-	}
+	return &Pack{
+		c:    c,
+		pid:  pid,
+		name: name,
+		gen:  gen,
+	}, nil
 }
 
 func (c *Client) Open(name string) (*File, error) {
@@ -561,13 +928,20 @@ func (c *Client) Open(name string) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = c.TOpen(fid, name)
+	var gen uint64
+	err = c.withRetry(func(g uint64) error {
+		gen = g
+		_, err := c.TOpen(fid, name)
+		return err
+	})
 	if err != nil {
 		c.freeFid(fid)
 		return nil, err
 	}
 	return &File{
-		c:   c,
-		fid: fid,
+		c:    c,
+		fid:  fid,
+		name: name,
+		gen:  gen,
 	}, nil
 }
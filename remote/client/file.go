@@ -9,27 +9,89 @@ import (
 type File struct {
 	c      *Client
 	fid    uint32
+	name   string
+	gen    uint64
 	offset uint64
 }
 
+// reopen restores the server side fid after the client has reconnected.
+func (f *File) reopen(gen uint64) error {
+	if f.gen == gen {
+		return nil
+	}
+	_, err := f.c.TOpen(f.fid, f.name)
+	if err != nil {
+		return err
+	}
+	f.gen = gen
+	return nil
+}
+
 func (f *File) Read(buf []byte) (int, error) {
 	maxn := f.c.getMaxMessageSize() - proto.READOVERHEAD
 	n := uint32(len(buf))
 	if n > maxn {
 		n = maxn
 	}
-	resp, err := f.c.TReadAt(f.fid, f.offset, n)
+	var resp *proto.RReadAt
+	err := f.c.withRetry(func(gen uint64) error {
+		err := f.reopen(gen)
+		if err != nil {
+			return err
+		}
+		resp, err = f.c.TReadAt(f.fid, f.offset, n)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
 	if len(resp.Data) == 0 {
 		return 0, io.EOF
 	}
+	f.c.DownloadLimit.Wait(len(resp.Data))
 	ncopied := copy(buf, resp.Data)
 	f.offset += uint64(ncopied)
 	return ncopied, nil
 }
 
+// ReadV reads each range of the file with as few requests as possible,
+// a range is short if the file ends within it.
+func (f *File) ReadV(offsets []uint64, sizes []uint32) ([][]byte, error) {
+	bufs := make([][]byte, len(offsets))
+	maxRanges := int(f.c.getMaxMessageSize()-proto.READOVERHEAD) / proto.READRANGESIZE
+	for start := 0; start < len(offsets); start += maxRanges {
+		end := start + maxRanges
+		if end > len(offsets) {
+			end = len(offsets)
+		}
+		err := f.c.withRetry(func(gen uint64) error {
+			err := f.reopen(gen)
+			if err != nil {
+				return err
+			}
+			ranges := make([]proto.ReadRange, 0, end-start)
+			for i := start; i < end; i++ {
+				bufs[i] = make([]byte, 0, sizes[i])
+				ranges = append(ranges, proto.ReadRange{
+					Fid:    f.fid,
+					Offset: offsets[i],
+					Size:   sizes[i],
+				})
+			}
+			return f.c.TReadV(ranges, func(idx int, data []byte) {
+				bufs[start+idx] = append(bufs[start+idx], data...)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := start; i < end; i++ {
+			f.c.DownloadLimit.Wait(len(bufs[i]))
+		}
+	}
+	return bufs, nil
+}
+
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
@@ -42,6 +104,13 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 
 func (f *File) Close() error {
 	f.c.freeFid(f.fid)
+	if f.gen != f.c.generation() {
+		// The server forgot the fid when the connection dropped.
+		return nil
+	}
 	_, err := f.c.TClose(f.fid)
+	if err == ErrDisconnected {
+		return nil
+	}
 	return err
 }
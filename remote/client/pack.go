@@ -2,43 +2,148 @@ package client
 
 import (
 	"github.com/buppyio/bpy/remote/proto"
+	"time"
 )
 
+// Data written since the last acknowledged offset is kept in buf from
+// start so an upload can be resumed after a reconnect, the server's write
+// window bounds the memory this uses.
 type Pack struct {
-	c   *Client
-	pid uint32
+	c     *Client
+	pid   uint32
+	name  string
+	gen   uint64
+	acked uint64
+	buf   []byte
+	start int
 }
 
-func (p *Pack) Write(buf []byte) (int, error) {
-	err := p.c.checkPidError(p.pid)
-	if err != nil {
-		return 0, err
+func (p *Pack) unacked() []byte {
+	return p.buf[p.start:]
+}
+
+func (p *Pack) ack(size uint64) error {
+	if size < p.acked || size-p.acked > uint64(len(p.unacked())) {
+		return ErrResumeFailed
+	}
+	p.start += int(size - p.acked)
+	p.acked = size
+	// Compacting only once most of buf is acknowledged copies each byte a
+	// bounded number of times. The data is moved to a new buffer as a
+	// resend may still be reading the old one.
+	if p.start > len(p.buf)/2 {
+		p.buf = append([]byte(nil), p.unacked()...)
+		p.start = 0
 	}
+	return nil
+}
+
+func (p *Pack) send(buf []byte) error {
 	maxn := p.c.getMaxMessageSize() - proto.WRITEOVERHEAD
-	nsent := 0
 	for len(buf) != 0 {
 		n := maxn
 		if uint32(len(buf)) < n {
 			n = uint32(len(buf))
 		}
-		err := p.c.TWritePack(p.pid, buf[:n])
+		acked, err := p.c.waitPackWindow(p.pid, uint64(n))
 		if err != nil {
-			return nsent, err
+			return err
+		}
+		if acked > p.acked {
+			err = p.ack(acked)
+			if err != nil {
+				return err
+			}
+		}
+		p.c.UploadLimit.Wait(int(n))
+		err = p.c.TWritePack(p.pid, buf[:n])
+		if err != nil {
+			return err
 		}
-		nsent += int(n)
 		buf = buf[n:]
 	}
-	return nsent, nil
+	return nil
+}
+
+// resume reattaches the pending upload after the client has reconnected and
+// resends whatever the server did not receive.
+func (p *Pack) resume(gen uint64) error {
+	if p.gen == gen {
+		return nil
+	}
+	resp, err := p.c.TResumePack(p.pid, p.name)
+	// The server has not noticed the old connection is gone yet.
+	for i := 0; err == proto.ErrPackBusy && i < p.c.MaxRetries; i++ {
+		time.Sleep(p.c.RetryDelay)
+		resp, err = p.c.TResumePack(p.pid, p.name)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Committed {
+		return ErrPackCommitted
+	}
+	err = p.ack(resp.Size)
+	if err != nil {
+		return err
+	}
+	p.gen = gen
+	p.c.resetPackWindow(p.pid, gen, resp.Size, resp.Window)
+	return p.send(p.unacked())
+}
+
+func (p *Pack) Write(buf []byte) (int, error) {
+	err := p.c.checkPidError(p.pid)
+	if err != nil {
+		return 0, err
+	}
+	p.buf = append(p.buf, buf...)
+	err = p.c.withRetry(func(gen uint64) error {
+		if p.gen != gen {
+			// resume also sends buf.
+			return p.resume(gen)
+		}
+		return p.send(buf)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
 }
 
 func (p *Pack) Close() error {
-	p.c.freePid(p.pid)
-	_, err := p.c.TClosePack(p.pid)
-	return err
+	defer p.c.freePid(p.pid)
+	closeAttempted := false
+	return p.c.withRetry(func(gen uint64) error {
+		err := p.resume(gen)
+		if err == ErrPackCommitted && closeAttempted {
+			// The close succeeded but the reply was lost.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = p.c.checkPidError(p.pid)
+		if err != nil {
+			return err
+		}
+		closeAttempted = true
+		_, err = p.c.TClosePack(p.pid)
+		return err
+	})
 }
 
 func (p *Pack) Cancel() error {
-	p.c.freePid(p.pid)
-	_, err := p.c.TCancelPack(p.pid)
-	return err
+	defer p.c.freePid(p.pid)
+	return p.c.withRetry(func(gen uint64) error {
+		if p.gen != gen {
+			_, err := p.c.TResumePack(p.pid, p.name)
+			if err != nil {
+				return err
+			}
+			p.gen = gen
+		}
+		_, err := p.c.TCancelPack(p.pid)
+		return err
+	})
 }
@@ -8,6 +8,11 @@ import (
 	"reflect"
 )
 
+// Version is exchanged on attach and changes whenever the messages do, so
+// mismatched clients and servers fail to attach instead of misreading each
+// other. buppy2 added pack flow control, resumable uploads and gc fences.
+const Version = "buppy2"
+
 const (
 	RERROR = iota
 	TATTACH
@@ -40,6 +45,15 @@ const (
 	RSTOPGC
 	TGETEPOCH
 	RGETEPOCH
+	TPACKSIZE
+	RPACKSIZE
+	TRESUMEPACK
+	RRESUMEPACK
+	RPACKACK
+	TFENCEGC
+	RFENCEGC
+	TREADV
+	RREADV
 )
 
 const (
@@ -49,12 +63,18 @@ const (
 const (
 	READOVERHEAD  = 4 + 1 + 2 + 4
 	WRITEOVERHEAD = 4 + 1 + 4 + 4
+	READVOVERHEAD = 4 + 1 + 2 + 4 + 4 + 1
+	// TReadV has the same overhead as RReadAt plus the packed ranges.
+	READRANGESIZE = 4 + 8 + 4
 )
 
 var (
 	ErrMsgTooLarge = errors.New("message too large")
 	ErrStrTooLarge = errors.New("string too large")
 	ErrMsgCorrupt  = errors.New("message corrupt")
+	// ErrPackBusy is sent while another connection still holds a pending
+	// pack, the client may try again once that connection is gone.
+	ErrPackBusy = errors.New("pack in use by another connection")
 )
 
 type Message interface {
@@ -124,6 +144,54 @@ type RReadAt struct {
 	Data []byte
 }
 
+// TReadV reads many ranges in one request. The server replies with an
+// RReadV for each piece of each range in order, then one with Done set.
+type TReadV struct {
+	Mid    uint16
+	Ranges []byte
+}
+
+type RReadV struct {
+	Mid   uint16
+	Index uint32
+	Data  []byte
+	Done  bool
+}
+
+// ReadRange is a range of an open file, TReadV ranges are packed with PackReadRanges.
+type ReadRange struct {
+	Fid    uint32
+	Offset uint64
+	Size   uint32
+}
+
+func PackReadRanges(ranges []ReadRange) []byte {
+	buf := make([]byte, len(ranges)*READRANGESIZE)
+	for i, r := range ranges {
+		b := buf[i*READRANGESIZE:]
+		binary.BigEndian.PutUint32(b[0:4], r.Fid)
+		binary.BigEndian.PutUint64(b[4:12], r.Offset)
+		binary.BigEndian.PutUint32(b[12:16], r.Size)
+	}
+	return buf
+}
+
+func UnpackReadRanges(buf []byte) ([]ReadRange, error) {
+	if len(buf)%READRANGESIZE != 0 {
+		return nil, ErrMsgCorrupt
+	}
+	ranges := make([]ReadRange, len(buf)/READRANGESIZE)
+	for i := range ranges {
+		b := buf[i*READRANGESIZE:]
+		ranges[i] = ReadRange{
+			Fid:    binary.BigEndian.Uint32(b[0:4]),
+			Offset: binary.BigEndian.Uint64(b[4:12]),
+			Size:   binary.BigEndian.Uint32(b[12:16]),
+		}
+	}
+	return ranges, nil
+}
+
 type TClose struct {
 	Mid uint16
 	Fid uint32
@@ -140,7 +208,8 @@ type TNewPack struct {
 }
 
 type RNewPack struct {
-	Mid uint16
+	Mid    uint16
+	Window uint32
 }
 
 type TWritePack struct {
@@ -153,6 +222,13 @@ type RPackError struct {
 	Message string
 }
 
+// RPackAck is sent as the server writes pack data, Size is the total
+// bytes written, a client may have at most Window bytes beyond that in flight.
+type RPackAck struct {
+	Pid  uint32
+	Size uint64
+}
+
 type TClosePack struct {
 	Mid uint16
 	Pid uint32
@@ -207,6 +283,39 @@ type RGetEpoch struct {
 	Epoch string
 }
 
+type TFenceGC struct {
+	Mid   uint16
+	Epoch string
+}
+
+type RFenceGC struct {
+	Mid   uint16
+	Epoch string
+}
+
+type TPackSize struct {
+	Mid uint16
+	Pid uint32
+}
+
+type RPackSize struct {
+	Mid  uint16
+	Size uint64
+}
+
+type TResumePack struct {
+	Mid  uint16
+	Pid  uint32
+	Name string
+}
+
+type RResumePack struct {
+	Mid       uint16
+	Size      uint64
+	Window    uint32
+	Committed bool
+}
+
 func ReadMessage(r io.Reader, buf []byte) (Message, error) {
 	_, err := io.ReadFull(r, buf[:4])
 	if err != nil {
@@ -230,7 +339,7 @@ func ReadMessage(r io.Reader, buf []byte) (Message, error) {
 func WriteMessage(w io.Writer, m Message, buf []byte) error {
 	n, err := PackMessage(m, buf)
 	if err != nil {
-		return nil
+		return err
 	}
 	_, err = w.Write(buf[:n])
 	return err
@@ -254,6 +363,10 @@ func UnpackMessage(buf []byte) (Message, error) {
 		m = &TReadAt{}
 	case RREADAT:
 		m = &RReadAt{}
+	case TREADV:
+		m = &TReadV{}
+	case RREADV:
+		m = &RReadV{}
 	case TCLOSE:
 		m = &TClose{}
 	case RCLOSE:
@@ -298,6 +411,20 @@ func UnpackMessage(buf []byte) (Message, error) {
 		m = &TGetEpoch{}
 	case RGETEPOCH:
 		m = &RGetEpoch{}
+	case TPACKSIZE:
+		m = &TPackSize{}
+	case RPACKSIZE:
+		m = &RPackSize{}
+	case TRESUMEPACK:
+		m = &TResumePack{}
+	case RRESUMEPACK:
+		m = &RResumePack{}
+	case RPACKACK:
+		m = &RPackAck{}
+	case TFENCEGC:
+		m = &TFenceGC{}
+	case RFENCEGC:
+		m = &RFenceGC{}
 	default:
 		return nil, ErrMsgCorrupt
 	}
@@ -320,6 +447,10 @@ func GetMessageType(m Message) byte {
 		return TREADAT
 	case *RReadAt:
 		return RREADAT
+	case *TReadV:
+		return TREADV
+	case *RReadV:
+		return RREADV
 	case *TClose:
 		return TCLOSE
 	case *RClose:
@@ -364,6 +495,20 @@ func GetMessageType(m Message) byte {
 		return TGETEPOCH
 	case *RGetEpoch:
 		return RGETEPOCH
+	case *TPackSize:
+		return TPACKSIZE
+	case *RPackSize:
+		return RPACKSIZE
+	case *TResumePack:
+		return TRESUMEPACK
+	case *RResumePack:
+		return RRESUMEPACK
+	case *RPackAck:
+		return RPACKACK
+	case *TFenceGC:
+		return TFENCEGC
+	case *RFenceGC:
+		return RFENCEGC
 	}
 	panic(fmt.Sprintf("GetMessageType: internal error (%s)", m))
 }
@@ -384,6 +529,10 @@ func GetMessageId(m Message) uint16 {
 		return m.Mid
 	case *RReadAt:
 		return m.Mid
+	case *TReadV:
+		return m.Mid
+	case *RReadV:
+		return m.Mid
 	case *TClose:
 		return m.Mid
 	case *RClose:
@@ -428,6 +577,20 @@ func GetMessageId(m Message) uint16 {
 		return m.Mid
 	case *RGetEpoch:
 		return m.Mid
+	case *TPackSize:
+		return m.Mid
+	case *RPackSize:
+		return m.Mid
+	case *TResumePack:
+		return m.Mid
+	case *RResumePack:
+		return m.Mid
+	case *RPackAck:
+		return NOMID
+	case *TFenceGC:
+		return m.Mid
+	case *RFenceGC:
+		return m.Mid
 	}
 	panic(fmt.Sprintf("GetMessageId: internal error (%s)", m))
 }
@@ -481,7 +644,9 @@ func unpackFields(m Message, buf []byte) error {
 			if len(buf) < sz {
 				return ErrMsgCorrupt
 			}
-			v.SetBytes(buf[0:sz])
+			// Copied because the read buffer is reused for the next
+			// message while concurrent callers still hold this one.
+			v.SetBytes(append([]byte(nil), buf[0:sz]...))
 			buf = buf[sz:]
 		default:
 			panic("unpackFields: internal error")
@@ -32,6 +32,51 @@ func TestEncDec(t *testing.T) {
 			Mid:  6,
 			Data: []byte{1, 2, 3},
 		},
+		&TPackSize{
+			Mid: 7,
+			Pid: 8,
+		},
+		&RPackSize{
+			Mid:  9,
+			Size: 0xffffffffffffffff,
+		},
+		&TResumePack{
+			Mid:  10,
+			Pid:  11,
+			Name: "packs/foo.ebpack",
+		},
+		&RResumePack{
+			Mid:       12,
+			Size:      13,
+			Window:    14,
+			Committed: true,
+		},
+		&RNewPack{
+			Mid:    15,
+			Window: 16,
+		},
+		&RPackAck{
+			Pid:  17,
+			Size: 18,
+		},
+		&TFenceGC{
+			Mid:   19,
+			Epoch: "abc",
+		},
+		&RFenceGC{
+			Mid:   20,
+			Epoch: "def",
+		},
+		&TReadV{
+			Mid:    21,
+			Ranges: PackReadRanges([]ReadRange{{Fid: 22, Offset: 23, Size: 24}}),
+		},
+		&RReadV{
+			Mid:   25,
+			Index: 26,
+			Data:  []byte{27},
+			Done:  true,
+		},
 	}
 
 	for _, mIn := range messages {
@@ -67,4 +112,38 @@ func TestOverheadConstants(t *testing.T) {
 	if n != WRITEOVERHEAD {
 		t.Fatalf("%d != WRITEOVERHEAD(%d)", n, WRITEOVERHEAD)
 	}
+	rReadV := &RReadV{}
+	n, err = PackMessage(rReadV, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != READVOVERHEAD {
+		t.Fatalf("%d != READVOVERHEAD(%d)", n, READVOVERHEAD)
+	}
+	tReadV := &TReadV{Ranges: PackReadRanges(make([]ReadRange, 2))}
+	n, err = PackMessage(tReadV, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != READOVERHEAD+2*READRANGESIZE {
+		t.Fatalf("%d != READOVERHEAD+2*READRANGESIZE", n)
+	}
+}
+
+func TestReadRanges(t *testing.T) {
+	ranges := []ReadRange{
+		{Fid: 1, Offset: 0xffffffffffffffff, Size: 3},
+		{Fid: 4, Offset: 5, Size: 0xffffffff},
+	}
+	out, err := UnpackReadRanges(PackReadRanges(ranges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ranges, out) {
+		t.Fatalf("%v != %v", ranges, out)
+	}
+	_, err = UnpackReadRanges(make([]byte, READRANGESIZE+1))
+	if err != ErrMsgCorrupt {
+		t.Fatal("expected corrupt ranges")
+	}
 }
@@ -4,10 +4,14 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote/client"
 	"github.com/buppyio/bpy/sig"
 	"io/ioutil"
+	"time"
 )
 
 var (
@@ -16,6 +20,7 @@ var (
 	ErrCorruptPackListing  = errors.New("corrupt pack listing")
 	ErrCorruptRefListing   = errors.New("corrupt ref listing")
 	ErrRootSignatureFailed = errors.New("root signature failed! corruption or tampering detected!")
+	ErrRootMissing         = errors.New("root missing")
 )
 
 type PackListing struct {
@@ -24,7 +29,16 @@ type PackListing struct {
 }
 
 func ListPacks(c *client.Client) ([]PackListing, error) {
-	f, err := c.Open("packs")
+	return listDir(c, "packs")
+}
+
+// ListIndexes lists the standalone pack indexes and index snapshots.
+func ListIndexes(c *client.Client) ([]PackListing, error) {
+	return listDir(c, "indexes")
+}
+
+func listDir(c *client.Client, name string) ([]PackListing, error) {
+	f, err := c.Open(name)
 	if err != nil {
 		return nil, err
 	}
@@ -86,6 +100,55 @@ func CasRoot(c *client.Client, k *bpy.Key, newHash [32]byte, newVersion, epoch s
 	return r.Ok, nil
 }
 
+// UpdateRoot commits the directory returned by fn as the new root, calling
+// fn again with the latest root whenever another client changed it first.
+// Nothing is committed if fn returns the root unchanged.
+//
+// epoch must be read before writing any data fn inserts, so the commit
+// fails if a gc removed that data in the meantime.
+func UpdateRoot(c *client.Client, k *bpy.Key, store bpy.CStore, epoch string, fn func(root [32]byte) (fs.DirEnt, error)) error {
+	for {
+		rootHash, rootVersion, ok, err := GetRoot(c, k)
+		if err != nil {
+			return fmt.Errorf("error fetching root hash: %s", err.Error())
+		}
+		if !ok {
+			return ErrRootMissing
+		}
+		ref, err := refs.GetRef(store, rootHash)
+		if err != nil {
+			return fmt.Errorf("error fetching ref: %s", err.Error())
+		}
+		newRoot, err := fn(ref.Root)
+		if err != nil {
+			return err
+		}
+		if newRoot.HTree.Data == ref.Root {
+			return nil
+		}
+		newRefHash, err := refs.PutRef(store, refs.Ref{
+			CreatedAt: time.Now().Unix(),
+			Root:      newRoot.HTree.Data,
+			HasPrev:   true,
+			Prev:      rootHash,
+		})
+		if err != nil {
+			return fmt.Errorf("error writing ref: %s", err.Error())
+		}
+		err = store.Flush()
+		if err != nil {
+			return fmt.Errorf("error flushing store: %s", err.Error())
+		}
+		ok, err = CasRoot(c, k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		if err != nil {
+			return fmt.Errorf("error swapping root: %s", err.Error())
+		}
+		if ok {
+			return nil
+		}
+	}
+}
+
 func Remove(c *client.Client, path, epoch string) error {
 	_, err := c.TRemove(path, epoch)
 	return err
@@ -107,6 +170,16 @@ func StartGC(c *client.Client) (string, error) {
 	return r.Epoch, nil
 }
 
+// FenceGC blocks root updates until the gc stops and invalidates the current
+// epoch. It returns the new epoch, which is needed to remove packs.
+func FenceGC(c *client.Client, epoch string) (string, error) {
+	r, err := c.TFenceGC(epoch)
+	if err != nil {
+		return "", err
+	}
+	return r.Epoch, nil
+}
+
 func StopGC(c *client.Client) error {
 	_, err := c.TStopGC()
 	return err
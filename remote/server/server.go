@@ -0,0 +1,882 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/remote/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxMessageSize = 1024 * 1024
+	ProtoVersion   = proto.Version
+
+	// PackWindow is how many unacknowledged bytes of pack data a client may
+	// have in flight, it bounds the data buffered between client and server.
+	PackWindow = 8 * 1024 * 1024
+
+	StalePendingAge = 24 * time.Hour
+
+	// PendingLockTimeout is how long a client resuming an upload waits for
+	// the connection it lost to release the pack.
+	PendingLockTimeout = 30 * time.Second
+)
+
+var (
+	ErrBadAttach    = errors.New("expected attach message")
+	ErrBadVersion   = errors.New("unsupported protocol version, the server speaks " + proto.Version)
+	ErrBadKeyId     = errors.New("bad key id")
+	ErrBadPath      = errors.New("bad path")
+	ErrNoSuchFid    = errors.New("no such fid")
+	ErrFidInUse     = errors.New("fid in use")
+	ErrNoSuchPid    = errors.New("no such pid")
+	ErrPidInUse     = errors.New("pid in use")
+	ErrStaleEpoch   = errors.New("epoch changed, gc has run or is running")
+	ErrGCNotRunning = errors.New("gc not running")
+	ErrGCRunning    = errors.New("gc in progress")
+	ErrGCNotFenced  = errors.New("gc has not fenced writers")
+)
+
+type Server struct {
+	root string
+
+	lock           sync.Mutex
+	pending        map[string]*pendingLock
+	pendingTimeout time.Duration
+}
+
+// A pending pack is owned by one connection at a time, a client resuming
+// an upload waits for the connection it lost to finish with the pack.
+type pendingLock struct {
+	held chan struct{}
+	refs int
+}
+
+func NewServer(root string) *Server {
+	return &Server{
+		root:           root,
+		pending:        make(map[string]*pendingLock),
+		pendingTimeout: PendingLockTimeout,
+	}
+}
+
+// lockPending fails with proto.ErrPackBusy if the pack is not released in
+// time, a connection that died without closing may hold it for a long time.
+func (s *Server) lockPending(path string) error {
+	s.lock.Lock()
+	l, ok := s.pending[path]
+	if !ok {
+		l = &pendingLock{held: make(chan struct{}, 1)}
+		s.pending[path] = l
+	}
+	l.refs += 1
+	s.lock.Unlock()
+	timer := time.NewTimer(s.pendingTimeout)
+	defer timer.Stop()
+	select {
+	case l.held <- struct{}{}:
+		return nil
+	case <-timer.C:
+		s.lock.Lock()
+		s.putPending(path, l)
+		s.lock.Unlock()
+		return proto.ErrPackBusy
+	}
+}
+
+func (s *Server) unlockPending(path string) {
+	s.lock.Lock()
+	l := s.pending[path]
+	s.putPending(path, l)
+	s.lock.Unlock()
+	<-l.held
+}
+
+// putPending must be called with lock held.
+func (s *Server) putPending(path string, l *pendingLock) {
+	l.refs -= 1
+	if l.refs == 0 {
+		delete(s.pending, path)
+	}
+}
+
+type file interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type listingFile struct {
+	*bytes.Reader
+}
+
+func (l *listingFile) Close() error {
+	return nil
+}
+
+type pack struct {
+	name    string
+	tmpPath string
+	f       *os.File
+	size    uint64
+	err     error
+}
+
+type conn struct {
+	srv  *Server
+	rwc  io.ReadWriteCloser
+	dir  string
+	rBuf []byte
+	wBuf []byte
+	fids map[uint32]file
+	pids map[uint32]*pack
+}
+
+type rootState struct {
+	Value     string
+	Version   string
+	Signature string
+	Ok        bool
+}
+
+// Writers may update the root while a gc is marking and copying, the gc
+// re-checks the root once it has fenced them out. Fencing changes the epoch
+// and blocks root updates until the gc stops, so writers that may have
+// deduplicated against packs the gc is removing can never commit.
+type gcState struct {
+	Epoch   string
+	Running bool
+	Fenced  bool
+}
+
+// unfence lets writers back in after a fenced gc, with a new epoch so
+// writers that started while packs were being removed are rejected.
+func (gc *gcState) unfence() error {
+	if gc.Fenced {
+		epoch, err := bpy.RandomFileName()
+		if err != nil {
+			return err
+		}
+		gc.Epoch = epoch
+	}
+	gc.Fenced = false
+	return nil
+}
+
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	return s.serveConn(rwc, nil)
+}
+
+func (s *Server) serveConn(rwc io.ReadWriteCloser, authorize func(keyId string) error) error {
+	defer rwc.Close()
+
+	c := &conn{
+		srv:  s,
+		rwc:  rwc,
+		rBuf: make([]byte, MaxMessageSize, MaxMessageSize),
+		fids: make(map[uint32]file),
+		pids: make(map[uint32]*pack),
+	}
+	defer c.cleanup()
+
+	m, err := proto.ReadMessage(rwc, c.rBuf)
+	if err != nil {
+		return err
+	}
+	attach, ok := m.(*proto.TAttach)
+	if !ok {
+		return ErrBadAttach
+	}
+	err = c.attach(attach, authorize)
+	if err != nil {
+		c.wBuf = make([]byte, MaxMessageSize, MaxMessageSize)
+		c.sendError(attach.Mid, err)
+		return err
+	}
+
+	for {
+		m, err := proto.ReadMessage(rwc, c.rBuf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		err = c.handleMessage(m)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) attach(m *proto.TAttach, authorize func(keyId string) error) error {
+	if m.Version != ProtoVersion {
+		return ErrBadVersion
+	}
+	_, err := bpy.ParseHash(m.KeyId)
+	if err != nil {
+		return ErrBadKeyId
+	}
+	if authorize != nil {
+		err = authorize(m.KeyId)
+		if err != nil {
+			return err
+		}
+	}
+	c.dir = filepath.Join(c.srv.root, m.KeyId)
+	for _, d := range []string{"packs", "indexes", "tmp"} {
+		err = os.MkdirAll(filepath.Join(c.dir, d), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	sz := uint32(MaxMessageSize)
+	if m.MaxMessageSize < sz {
+		sz = m.MaxMessageSize
+	}
+	c.rBuf = make([]byte, sz, sz)
+	c.wBuf = make([]byte, sz, sz)
+	return c.send(&proto.RAttach{
+		Mid:            m.Mid,
+		MaxMessageSize: sz,
+	})
+}
+
+func (c *conn) cleanup() {
+	for _, f := range c.fids {
+		f.Close()
+	}
+	// Pending packs are kept so clients can resume them after reconnecting.
+	for _, p := range c.pids {
+		c.releasePack(p)
+	}
+}
+
+func (c *conn) send(m proto.Message) error {
+	return proto.WriteMessage(c.rwc, m, c.wBuf)
+}
+
+func (c *conn) sendError(mid uint16, err error) error {
+	return c.send(&proto.RError{
+		Mid:     mid,
+		Message: err.Error(),
+	})
+}
+
+func (c *conn) handleMessage(m proto.Message) error {
+	var resp proto.Message
+	var err error
+
+	mid := proto.GetMessageId(m)
+
+	switch m := m.(type) {
+	case *proto.TOpen:
+		resp, err = c.handleOpen(m)
+	case *proto.TReadAt:
+		resp, err = c.handleReadAt(m)
+	case *proto.TReadV:
+		return c.handleReadV(m)
+	case *proto.TClose:
+		resp, err = c.handleClose(m)
+	case *proto.TNewPack:
+		resp, err = c.handleNewPack(m)
+	case *proto.TWritePack:
+		return c.handleWritePack(m)
+	case *proto.TClosePack:
+		resp, err = c.handleClosePack(m)
+	case *proto.TCancelPack:
+		resp, err = c.handleCancelPack(m)
+	case *proto.TPackSize:
+		resp, err = c.handlePackSize(m)
+	case *proto.TResumePack:
+		resp, err = c.handleResumePack(m)
+	case *proto.TRemove:
+		resp, err = c.handleRemove(m)
+	case *proto.TGetRoot:
+		resp, err = c.handleGetRoot(m)
+	case *proto.TCasRoot:
+		resp, err = c.handleCasRoot(m)
+	case *proto.TGetEpoch:
+		resp, err = c.handleGetEpoch(m)
+	case *proto.TStartGC:
+		resp, err = c.handleStartGC(m)
+	case *proto.TFenceGC:
+		resp, err = c.handleFenceGC(m)
+	case *proto.TStopGC:
+		resp, err = c.handleStopGC(m)
+	default:
+		err = fmt.Errorf("unexpected message type %d", proto.GetMessageType(m))
+	}
+	if err != nil {
+		return c.sendError(mid, err)
+	}
+	return c.send(resp)
+}
+
+// Pack files live in packs, their standalone indexes in indexes so
+// clients that list packs never see them.
+var fileDirs = []string{"packs", "indexes"}
+
+func packPath(name string) (string, error) {
+	for _, d := range fileDirs {
+		if !strings.HasPrefix(name, d+"/") {
+			continue
+		}
+		base := name[len(d)+1:]
+		if base == "" || base == "." || base == ".." || strings.ContainsAny(base, "/\\") {
+			return "", ErrBadPath
+		}
+		return path.Join(d, base), nil
+	}
+	return "", ErrBadPath
+}
+
+func isFileDir(name string) bool {
+	for _, d := range fileDirs {
+		if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) listDir(name string) ([]byte, error) {
+	ents, err := ioutil.ReadDir(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, ent := range ents {
+		if !ent.Mode().IsRegular() {
+			continue
+		}
+		var sz [8]byte
+		binary.BigEndian.PutUint16(sz[0:2], uint16(len(ent.Name())))
+		buf.Write(sz[0:2])
+		buf.WriteString(ent.Name())
+		binary.BigEndian.PutUint64(sz[:], uint64(ent.Size()))
+		buf.Write(sz[:])
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *conn) handleOpen(m *proto.TOpen) (proto.Message, error) {
+	_, ok := c.fids[m.Fid]
+	if ok {
+		return nil, ErrFidInUse
+	}
+	if isFileDir(m.Name) {
+		listing, err := c.listDir(m.Name)
+		if err != nil {
+			return nil, err
+		}
+		c.fids[m.Fid] = &listingFile{bytes.NewReader(listing)}
+		return &proto.ROpen{Mid: m.Mid}, nil
+	}
+	p, err := packPath(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(c.dir, filepath.FromSlash(p)))
+	if err != nil {
+		return nil, err
+	}
+	c.fids[m.Fid] = f
+	return &proto.ROpen{Mid: m.Mid}, nil
+}
+
+func (c *conn) handleReadAt(m *proto.TReadAt) (proto.Message, error) {
+	f, ok := c.fids[m.Fid]
+	if !ok {
+		return nil, ErrNoSuchFid
+	}
+	sz := m.Size
+	if sz > uint32(len(c.wBuf))-proto.READOVERHEAD {
+		sz = uint32(len(c.wBuf)) - proto.READOVERHEAD
+	}
+	buf := make([]byte, sz, sz)
+	n, err := f.ReadAt(buf, int64(m.Offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &proto.RReadAt{Mid: m.Mid, Data: buf[:n]}, nil
+}
+
+// handleReadV streams each range in pieces that fit in a message,
+// a range is cut short at the end of its file.
+func (c *conn) handleReadV(m *proto.TReadV) error {
+	ranges, err := proto.UnpackReadRanges(m.Ranges)
+	if err != nil {
+		return c.sendError(m.Mid, err)
+	}
+	maxsz := uint32(len(c.wBuf)) - proto.READVOVERHEAD
+	for idx, r := range ranges {
+		f, ok := c.fids[r.Fid]
+		if !ok {
+			return c.sendError(m.Mid, ErrNoSuchFid)
+		}
+		offset := r.Offset
+		remaining := r.Size
+		for remaining != 0 {
+			sz := remaining
+			if sz > maxsz {
+				sz = maxsz
+			}
+			buf := make([]byte, sz, sz)
+			n, err := f.ReadAt(buf, int64(offset))
+			if err != nil && err != io.EOF {
+				return c.sendError(m.Mid, err)
+			}
+			if n == 0 {
+				break
+			}
+			err = c.send(&proto.RReadV{Mid: m.Mid, Index: uint32(idx), Data: buf[:n]})
+			if err != nil {
+				return err
+			}
+			offset += uint64(n)
+			remaining -= uint32(n)
+		}
+	}
+	return c.send(&proto.RReadV{Mid: m.Mid, Index: uint32(len(ranges)), Done: true})
+}
+
+func (c *conn) handleClose(m *proto.TClose) (proto.Message, error) {
+	f, ok := c.fids[m.Fid]
+	if !ok {
+		return nil, ErrNoSuchFid
+	}
+	delete(c.fids, m.Fid)
+	err := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RClose{Mid: m.Mid}, nil
+}
+
+func (c *conn) pendingPath(name string) string {
+	return filepath.Join(c.dir, "tmp", path.Base(name)+".pending")
+}
+
+func (c *conn) handleNewPack(m *proto.TNewPack) (proto.Message, error) {
+	_, ok := c.pids[m.Pid]
+	if ok {
+		return nil, ErrPidInUse
+	}
+	name, err := packPath(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := c.pendingPath(name)
+	err = c.srv.lockPending(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		c.srv.unlockPending(tmpPath)
+		return nil, err
+	}
+	c.pids[m.Pid] = &pack{
+		name:    name,
+		tmpPath: tmpPath,
+		f:       f,
+	}
+	return &proto.RNewPack{Mid: m.Mid, Window: PackWindow}, nil
+}
+
+func (c *conn) handlePackSize(m *proto.TPackSize) (proto.Message, error) {
+	p, ok := c.pids[m.Pid]
+	if !ok {
+		return nil, ErrNoSuchPid
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	st, err := p.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RPackSize{Mid: m.Mid, Size: uint64(st.Size())}, nil
+}
+
+func (c *conn) handleResumePack(m *proto.TResumePack) (proto.Message, error) {
+	_, ok := c.pids[m.Pid]
+	if ok {
+		return nil, ErrPidInUse
+	}
+	name, err := packPath(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := c.pendingPath(name)
+	err = c.srv.lockPending(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		c.srv.unlockPending(tmpPath)
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		st, err := os.Stat(filepath.Join(c.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		return &proto.RResumePack{Mid: m.Mid, Size: uint64(st.Size()), Committed: true}, nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		c.srv.unlockPending(tmpPath)
+		return nil, err
+	}
+	c.pids[m.Pid] = &pack{
+		name:    name,
+		tmpPath: tmpPath,
+		f:       f,
+		size:    uint64(st.Size()),
+	}
+	return &proto.RResumePack{Mid: m.Mid, Size: uint64(st.Size()), Window: PackWindow}, nil
+}
+
+func (c *conn) handleWritePack(m *proto.TWritePack) error {
+	p, ok := c.pids[m.Pid]
+	if !ok {
+		return c.send(&proto.RPackError{Pid: m.Pid, Message: ErrNoSuchPid.Error()})
+	}
+	if p.err != nil {
+		return nil
+	}
+	n, err := p.f.Write(m.Data)
+	p.size += uint64(n)
+	if err != nil {
+		p.err = err
+		return c.send(&proto.RPackError{Pid: m.Pid, Message: err.Error()})
+	}
+	return c.send(&proto.RPackAck{Pid: m.Pid, Size: p.size})
+}
+
+func (c *conn) releasePack(p *pack) error {
+	err := p.f.Close()
+	c.srv.unlockPending(p.tmpPath)
+	return err
+}
+
+func (c *conn) handleClosePack(m *proto.TClosePack) (proto.Message, error) {
+	p, ok := c.pids[m.Pid]
+	if !ok {
+		return nil, ErrNoSuchPid
+	}
+	delete(c.pids, m.Pid)
+	defer c.srv.unlockPending(p.tmpPath)
+	if p.err != nil {
+		p.f.Close()
+		os.Remove(p.tmpPath)
+		return nil, p.err
+	}
+	err := p.f.Sync()
+	if err != nil {
+		p.f.Close()
+		os.Remove(p.tmpPath)
+		return nil, err
+	}
+	err = p.f.Close()
+	if err != nil {
+		os.Remove(p.tmpPath)
+		return nil, err
+	}
+	err = os.Rename(p.tmpPath, filepath.Join(c.dir, filepath.FromSlash(p.name)))
+	if err != nil {
+		os.Remove(p.tmpPath)
+		return nil, err
+	}
+	return &proto.RClosePack{Mid: m.Mid}, nil
+}
+
+func (c *conn) handleCancelPack(m *proto.TCancelPack) (proto.Message, error) {
+	p, ok := c.pids[m.Pid]
+	if !ok {
+		return nil, ErrNoSuchPid
+	}
+	delete(c.pids, m.Pid)
+	c.releasePack(p)
+	err := os.Remove(p.tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RCancelPack{Mid: m.Mid}, nil
+}
+
+func (c *conn) handleRemove(m *proto.TRemove) (proto.Message, error) {
+	p, err := packPath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	if !gc.Running {
+		return nil, ErrGCNotRunning
+	}
+	if !gc.Fenced {
+		return nil, ErrGCNotFenced
+	}
+	if gc.Epoch != m.Epoch {
+		return nil, ErrStaleEpoch
+	}
+	// Removing twice is not an error so clients can retry after a disconnect.
+	err = os.Remove(filepath.Join(c.dir, filepath.FromSlash(p)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &proto.RRemove{Mid: m.Mid}, nil
+}
+
+func (c *conn) handleGetRoot(m *proto.TGetRoot) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	root, err := c.getRootState()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RGetRoot{
+		Mid:       m.Mid,
+		Value:     root.Value,
+		Version:   root.Version,
+		Signature: root.Signature,
+		Ok:        root.Ok,
+	}, nil
+}
+
+func (c *conn) handleCasRoot(m *proto.TCasRoot) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	if gc.Running && gc.Fenced {
+		return nil, ErrGCRunning
+	}
+	if gc.Epoch != m.Epoch {
+		return nil, ErrStaleEpoch
+	}
+	root, err := c.getRootState()
+	if err != nil {
+		return nil, err
+	}
+	if m.Version != bpy.NextRootVersion(root.Version) {
+		return &proto.RCasRoot{Mid: m.Mid, Ok: false}, nil
+	}
+	err = c.putState("root", &rootState{
+		Value:     m.Value,
+		Version:   m.Version,
+		Signature: m.Signature,
+		Ok:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RCasRoot{Mid: m.Mid, Ok: true}, nil
+}
+
+func (c *conn) handleGetEpoch(m *proto.TGetEpoch) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RGetEpoch{Mid: m.Mid, Epoch: gc.Epoch}, nil
+}
+
+func (c *conn) handleStartGC(m *proto.TStartGC) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	// Starting a gc stops any running one.
+	err = gc.unfence()
+	if err != nil {
+		return nil, err
+	}
+	gc.Running = true
+	err = c.putState("gc", &gc)
+	if err != nil {
+		return nil, err
+	}
+	err = c.removeStalePending()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RStartGC{Mid: m.Mid, Epoch: gc.Epoch}, nil
+}
+
+func (c *conn) handleFenceGC(m *proto.TFenceGC) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	if !gc.Running {
+		return nil, ErrGCNotRunning
+	}
+	if gc.Fenced || gc.Epoch != m.Epoch {
+		return nil, ErrStaleEpoch
+	}
+	gc.Epoch, err = bpy.RandomFileName()
+	if err != nil {
+		return nil, err
+	}
+	gc.Fenced = true
+	err = c.putState("gc", &gc)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RFenceGC{Mid: m.Mid, Epoch: gc.Epoch}, nil
+}
+
+// removeStalePending deletes uploads abandoned by clients that never reconnected.
+func (c *conn) removeStalePending() error {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	ents, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".pending") {
+			continue
+		}
+		if time.Since(ent.ModTime()) < StalePendingAge {
+			continue
+		}
+		err = os.Remove(filepath.Join(tmpDir, ent.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) handleStopGC(m *proto.TStopGC) (proto.Message, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	gc, err := c.getGCState()
+	if err != nil {
+		return nil, err
+	}
+	err = gc.unfence()
+	if err != nil {
+		return nil, err
+	}
+	gc.Running = false
+	err = c.putState("gc", &gc)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.RStopGC{Mid: m.Mid}, nil
+}
+
+// getRootState and getGCState must be called with the server lock held,
+// they lazily create the initial state of a new repository.
+func (c *conn) getRootState() (rootState, error) {
+	var root rootState
+	ok, err := c.getState("root", &root)
+	if err != nil {
+		return root, err
+	}
+	if !ok {
+		root.Version, err = bpy.NewRootVersion()
+		if err != nil {
+			return root, err
+		}
+		err = c.putState("root", &root)
+	}
+	return root, err
+}
+
+func (c *conn) getGCState() (gcState, error) {
+	var gc gcState
+	ok, err := c.getState("gc", &gc)
+	if err != nil {
+		return gc, err
+	}
+	if !ok {
+		gc.Epoch, err = bpy.RandomFileName()
+		if err != nil {
+			return gc, err
+		}
+		err = c.putState("gc", &gc)
+	}
+	return gc, err
+}
+
+func (c *conn) getState(name string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *conn) putState(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmpName, err := bpy.RandomFileName()
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(c.dir, "tmp", tmpName)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, filepath.Join(c.dir, name))
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,770 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func attachPipe(t *testing.T, srv *Server, k *bpy.Key) *client.Client {
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(serverConn)
+	c, err := client.Attach(clientConn, hex.EncodeToString(k.Id[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testRoundTrip(t *testing.T, c *client.Client, k *bpy.Key) {
+	_, version, ok, err := remote.GetRoot(c, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected empty root")
+	}
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := [32]byte{1, 2, 3}
+	ok, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("cas failed")
+	}
+	ok, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("cas with stale version succeeded")
+	}
+	gotHash, _, ok, err := remote.GetRoot(c, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || gotHash != hash {
+		t.Fatal("bad root")
+	}
+
+	data := make([]byte, 3*1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	p, err := c.NewPack("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packs, err := remote.ListPacks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 1 || packs[0].Name != "test.ebpack" || packs[0].Size != uint64(len(data)) {
+		t.Fatalf("bad pack listing %v", packs)
+	}
+	p, err = c.NewPack("indexes/test.eidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes, err := remote.ListIndexes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].Name != "test.eidx" {
+		t.Fatalf("bad index listing %v", indexes)
+	}
+	packs, err = remote.ListPacks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 1 {
+		t.Fatalf("index listed as a pack %v", packs)
+	}
+	for _, name := range []string{"tmp/x", "indexes/../packs", "indexes/"} {
+		_, err = c.NewPack(name)
+		if err == nil {
+			t.Fatalf("created pack with bad path %s", name)
+		}
+	}
+	f, err := c.Open("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("pack data differs")
+	}
+	offsets := []uint64{10, 2 * 1024 * 1024, 0, uint64(len(data)) - 5}
+	sizes := []uint32{5, 1024*1024 + 7, 0, 100}
+	ranges, err := f.ReadV(offsets, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ranges {
+		end := offsets[i] + uint64(sizes[i])
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		if !bytes.Equal(ranges[i], data[offsets[i]:end]) {
+			t.Fatalf("range %d differs", i)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = remote.Remove(c, "packs/test.ebpack", epoch)
+	if err == nil {
+		t.Fatal("remove outside of gc succeeded")
+	}
+	gcEpoch, err := remote.StartGC(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcEpoch != epoch {
+		t.Fatal("starting gc changed the epoch")
+	}
+	version = bpy.NextRootVersion(version)
+	ok, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), epoch)
+	if err != nil || !ok {
+		t.Fatalf("cas before gc fence failed: %v", err)
+	}
+	version = bpy.NextRootVersion(version)
+	err = remote.Remove(c, "packs/test.ebpack", gcEpoch)
+	if err == nil {
+		t.Fatal("remove before gc fence succeeded")
+	}
+	fencedEpoch, err := remote.FenceGC(c, gcEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = remote.FenceGC(c, gcEpoch)
+	if err == nil {
+		t.Fatal("second fence succeeded")
+	}
+	for _, e := range []string{epoch, fencedEpoch} {
+		_, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), e)
+		if err == nil {
+			t.Fatal("cas during fenced gc succeeded")
+		}
+	}
+	err = remote.Remove(c, "packs/test.ebpack", epoch)
+	if err == nil {
+		t.Fatal("remove with stale epoch succeeded")
+	}
+	err = remote.Remove(c, "packs/test.ebpack", fencedEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.StopGC(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEpoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newEpoch == epoch || newEpoch == fencedEpoch {
+		t.Fatal("epoch not changed after fenced gc")
+	}
+	_, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), fencedEpoch)
+	if err == nil {
+		t.Fatal("cas with epoch from fenced gc succeeded")
+	}
+	packs, err = remote.ListPacks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 0 {
+		t.Fatal("pack not removed")
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	c := attachPipe(t, srv, &k)
+	defer c.Close()
+	testRoundTrip(t, c, &k)
+
+	_, err = c.NewPack("packs/../root")
+	if err == nil {
+		t.Fatal("expected bad path error")
+	}
+}
+
+// trackingListener remembers accepted connections so a test can drop them.
+type trackingListener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.lock.Lock()
+		l.conns = append(l.conns, conn)
+		l.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) closeConns() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestServeTLS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cert, err := LoadOrCreateCertificate(filepath.Join(tmp, "server.crt"), filepath.Join(tmp, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := CertificateFingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tl := &trackingListener{Listener: l}
+	srv := NewServer(tmp)
+	go srv.ServeTLS(tl, cert, true)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := remote.DialTLS(l.Addr().String(), &k, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, c, &k)
+	c.Close()
+
+	_, err = remote.DialTLS(l.Addr().String(), &k, hex.EncodeToString(make([]byte, 32)))
+	if err == nil {
+		t.Fatal("expected server fingerprint mismatch")
+	}
+
+	// A different key claiming the same key id must not match the pin.
+	imposter, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imposter.Id = k.Id
+	_, err = remote.DialTLS(l.Addr().String(), &imposter, fingerprint)
+	if err == nil {
+		t.Fatal("expected pinned key mismatch")
+	}
+
+	c, err = remote.DialTLS(l.Addr().String(), &k, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.RetryDelay = time.Millisecond
+	tl.closeConns()
+	_, _, _, err = remote.GetRoot(c, &k)
+	if err != nil {
+		t.Fatalf("tls client did not reconnect: %s", err)
+	}
+}
+
+func TestAttachVersion(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go NewServer(tmp).ServeConn(serverConn)
+	buf := make([]byte, MaxMessageSize)
+	err = proto.WriteMessage(clientConn, &proto.TAttach{
+		Mid:            1,
+		MaxMessageSize: MaxMessageSize,
+		Version:        "buppy1",
+		KeyId:          hex.EncodeToString(make([]byte, 32)),
+	}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := proto.ReadMessage(clientConn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rerr, ok := resp.(*proto.RError)
+	if !ok || rerr.Message != ErrBadVersion.Error() {
+		t.Fatalf("expected a version error, got %#v", resp)
+	}
+}
+
+// flakyConn fails after a fixed number of bytes have been written,
+// simulating a link dropping in the middle of an upload.
+type flakyConn struct {
+	net.Conn
+	remaining int
+}
+
+func (f *flakyConn) Write(buf []byte) (int, error) {
+	if len(buf) > f.remaining {
+		f.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	f.remaining -= len(buf)
+	return f.Conn.Write(buf)
+}
+
+func TestReconnect(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	ndials := 0
+	dial := func() (client.ReadWriteCloser, error) {
+		ndials += 1
+		clientConn, serverConn := net.Pipe()
+		go srv.ServeConn(serverConn)
+		return &flakyConn{Conn: clientConn, remaining: 5 * 1024 * 1024}, nil
+	}
+	c, err := client.Dial(dial, hex.EncodeToString(k.Id[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.RetryDelay = time.Millisecond
+
+	rand := rand.New(rand.NewSource(1234))
+	data := make([]byte, 24*1024*1024)
+	_, err = io.ReadFull(rand, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.NewPack("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for towrite := data; len(towrite) != 0; {
+		n := 65536
+		if len(towrite) < n {
+			n = len(towrite)
+		}
+		_, err = p.Write(towrite[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		towrite = towrite[n:]
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ndials < 4 {
+		t.Fatalf("expected upload to reconnect, dialed %d times", ndials)
+	}
+
+	f, err := c.Open("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed pack data differs")
+	}
+}
+
+func TestResumeBusyPack(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	srv.pendingTimeout = 10 * time.Millisecond
+	c1 := attachPipe(t, srv, &k)
+	defer c1.Close()
+	c2 := attachPipe(t, srv, &k)
+	defer c2.Close()
+
+	p, err := c1.NewPack("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first connection still holds the pack, the resume must not hang.
+	_, err = c2.TResumePack(1, "packs/test.ebpack")
+	if err != proto.ErrPackBusy {
+		t.Fatalf("expected %v, got %v", proto.ErrPackBusy, err)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c2.TResumePack(1, "packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Committed {
+		t.Fatal("closed pack not reported as committed")
+	}
+}
+
+// dropCasReplyConn closes the connection instead of sending the reply
+// to the first root swap.
+type dropCasReplyConn struct {
+	net.Conn
+	dropped *bool
+}
+
+func (d *dropCasReplyConn) Write(buf []byte) (int, error) {
+	if !*d.dropped && len(buf) > 4 && buf[4] == proto.RCASROOT {
+		*d.dropped = true
+		d.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	return d.Conn.Write(buf)
+}
+
+func TestCasRootReplyLost(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	dropped := false
+	dial := func() (client.ReadWriteCloser, error) {
+		clientConn, serverConn := net.Pipe()
+		go srv.ServeConn(&dropCasReplyConn{Conn: serverConn, dropped: &dropped})
+		return clientConn, nil
+	}
+	c, err := client.Dial(dial, hex.EncodeToString(k.Id[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.RetryDelay = time.Millisecond
+
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, _, err := remote.GetRoot(c, &k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := [32]byte{1, 2, 3}
+	ok, err := remote.CasRoot(c, &k, hash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dropped {
+		t.Fatal("reply was not dropped")
+	}
+	if !ok {
+		t.Fatal("swap that succeeded reported as failed")
+	}
+	root, newVersion, ok, err := remote.GetRoot(c, &k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || root != hash || newVersion != bpy.NextRootVersion(version) {
+		t.Fatal("root not swapped exactly once")
+	}
+
+	ok, err = remote.CasRoot(c, &k, [32]byte{4}, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("swap with a stale version succeeded")
+	}
+}
+
+// latencyPipe is an unbounded in memory pipe that delivers each write after
+// a fixed delay, so only flow control limits how much data is in flight.
+type latencyPipe struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	delay       time.Duration
+	chunks      []latencyChunk
+	buffered    int
+	maxBuffered int
+	closed      bool
+}
+
+type latencyChunk struct {
+	at   time.Time
+	data []byte
+}
+
+func newLatencyPipe(delay time.Duration) *latencyPipe {
+	p := &latencyPipe{delay: delay}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+func (p *latencyPipe) write(buf []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	p.chunks = append(p.chunks, latencyChunk{at: time.Now().Add(p.delay), data: data})
+	p.buffered += len(data)
+	if p.buffered > p.maxBuffered {
+		p.maxBuffered = p.buffered
+	}
+	p.cond.Broadcast()
+	return len(buf), nil
+}
+
+func (p *latencyPipe) read(buf []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.chunks) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.chunks) == 0 {
+		return 0, io.EOF
+	}
+	wait := p.chunks[0].at.Sub(time.Now())
+	if wait > 0 {
+		p.lock.Unlock()
+		time.Sleep(wait)
+		p.lock.Lock()
+	}
+	n := copy(buf, p.chunks[0].data)
+	p.chunks[0].data = p.chunks[0].data[n:]
+	if len(p.chunks[0].data) == 0 {
+		p.chunks = p.chunks[1:]
+	}
+	p.buffered -= n
+	return n, nil
+}
+
+func (p *latencyPipe) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+type pipeConn struct {
+	r *latencyPipe
+	w *latencyPipe
+}
+
+func (c *pipeConn) Read(buf []byte) (int, error) {
+	return c.r.read(buf)
+}
+
+func (c *pipeConn) Write(buf []byte) (int, error) {
+	return c.w.write(buf)
+}
+
+func (c *pipeConn) Close() error {
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+// attachLatencyPipe returns a client and the pipe carrying its messages to the server.
+func attachLatencyPipe(t testing.TB, srv *Server, k *bpy.Key, delay time.Duration) (*client.Client, *latencyPipe) {
+	up := newLatencyPipe(delay)
+	down := newLatencyPipe(delay)
+	go srv.ServeConn(&pipeConn{r: up, w: down})
+	c, err := client.Attach(&pipeConn{r: down, w: up}, hex.EncodeToString(k.Id[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, up
+}
+
+func TestPackWindow(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	delay := 10 * time.Millisecond
+	c, up := attachLatencyPipe(t, srv, &k, delay)
+	defer c.Close()
+
+	rand := rand.New(rand.NewSource(1234))
+	data := make([]byte, 32*1024*1024)
+	_, err = io.ReadFull(rand, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.NewPack("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	nwrites := 0
+	for towrite := data; len(towrite) != 0; nwrites++ {
+		n := 65536
+		if len(towrite) < n {
+			n = len(towrite)
+		}
+		_, err = p.Write(towrite[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		towrite = towrite[n:]
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	up.lock.Lock()
+	maxBuffered := up.maxBuffered
+	up.lock.Unlock()
+	if maxBuffered > PackWindow+MaxMessageSize {
+		t.Fatalf("client had %d bytes in flight, window is %d", maxBuffered, PackWindow)
+	}
+	// Waiting for each write to be acknowledged would take a round trip per write.
+	if elapsed > time.Duration(nwrites)*2*delay/4 {
+		t.Fatalf("upload of %d writes took %s, writes are not pipelined", nwrites, elapsed)
+	}
+
+	f, err := c.Open("packs/test.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("pack data differs")
+	}
+}
+
+func BenchmarkPackWrite(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "bpyservertest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	k, err := bpy.NewKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := NewServer(tmp)
+	c, _ := attachLatencyPipe(b, srv, &k, 0)
+	defer c.Close()
+
+	buf := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	p, err := c.NewPack("packs/bench.ebpack")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		_, err = p.Write(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = p.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/buppyio/bpy/remote"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoClientCert   = errors.New("no client certificate")
+	ErrKeyIdMismatch  = errors.New("client certificate does not match key id")
+	ErrUnknownKey     = errors.New("client certificate not authorized for key id")
+	ErrBadCertificate = errors.New("bad certificate file")
+)
+
+func LoadOrCreateCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, nil
+	}
+	if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bpy remote"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	privDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDer}), 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func CertificateFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", ErrBadCertificate
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return remote.PublicKeyFingerprint(x509Cert)
+}
+
+func ServerTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// Client certificates are self signed and derived from the bpy key,
+		// they are pinned per key id when the client attaches.
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+}
+
+// ServeTLS accepts connections on l until it fails. If allowNewKeys is set, the first
+// client certificate seen for a key id is pinned, otherwise only key ids with an
+// existing pin may attach.
+func (s *Server) ServeTLS(l net.Listener, cert tls.Certificate, allowNewKeys bool) error {
+	tlsListener := tls.NewListener(l, ServerTLSConfig(cert))
+	for {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := s.serveTLSConn(conn.(*tls.Conn), allowNewKeys)
+			if err != nil {
+				log.Printf("%s: %s", conn.RemoteAddr(), err.Error())
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTLSConn(conn *tls.Conn, allowNewKeys bool) error {
+	err := conn.Handshake()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		conn.Close()
+		return ErrNoClientCert
+	}
+	clientCert := peerCerts[0]
+	fingerprint, err := remote.PublicKeyFingerprint(clientCert)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return s.serveConn(conn, func(keyId string) error {
+		if clientCert.Subject.CommonName != keyId {
+			return ErrKeyIdMismatch
+		}
+		return s.checkPin(keyId, fingerprint, allowNewKeys)
+	})
+}
+
+func (s *Server) checkPin(keyId, fingerprint string, allowNewKeys bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pinPath := filepath.Join(s.root, keyId, "client.pub")
+	pinned, err := ioutil.ReadFile(pinPath)
+	if err == nil {
+		if strings.TrimSpace(string(pinned)) != fingerprint {
+			return ErrUnknownKey
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if !allowNewKeys {
+		return ErrUnknownKey
+	}
+	err = os.MkdirAll(filepath.Join(s.root, keyId), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pinPath, []byte(fingerprint+"\n"), 0600)
+}
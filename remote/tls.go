@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/remote/client"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrNoServerFingerprint = errors.New("remote server fingerprint not configured")
+	ErrBadServerCert       = errors.New("remote server certificate does not match fingerprint")
+)
+
+// The client certificate is derived from the bpy key so every machine sharing a key
+// presents the same identity, and the server can pin it to the key id.
+func KeyCertificate(k *bpy.Key) (tls.Certificate, error) {
+	mac := hmac.New(sha256.New, k.HmacKey[:])
+	mac.Write([]byte("bpy tls client key"))
+	priv := ed25519.NewKeyFromSeed(mac.Sum(nil))
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hex.EncodeToString(k.Id[:])},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
+
+func PublicKeyFingerprint(cert *x509.Certificate) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func ClientTLSConfig(k *bpy.Key, serverFingerprint string) (*tls.Config, error) {
+	if serverFingerprint == "" {
+		return nil, ErrNoServerFingerprint
+	}
+	cert, err := KeyCertificate(k)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// Server certificates are self signed, they are checked against
+		// the pinned fingerprint instead of a certificate authority.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrBadServerCert
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			fingerprint, err := PublicKeyFingerprint(cert)
+			if err != nil {
+				return err
+			}
+			if fingerprint != serverFingerprint {
+				return ErrBadServerCert
+			}
+			return nil
+		},
+	}, nil
+}
+
+// TLSDialer returns a DialFunc connecting to the server at addr, for use
+// with client.Dial so the connection is redialed when it fails.
+func TLSDialer(addr string, k *bpy.Key, serverFingerprint string) (client.DialFunc, error) {
+	cfg, err := ClientTLSConfig(k, serverFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return func() (client.ReadWriteCloser, error) {
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error dialing %s: %s", addr, err.Error())
+		}
+		return conn, nil
+	}, nil
+}
+
+func DialTLS(addr string, k *bpy.Key, serverFingerprint string) (*client.Client, error) {
+	dial, err := TLSDialer(addr, k, serverFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial(dial, hex.EncodeToString(k.Id[:]))
+}
@@ -0,0 +1,233 @@
+package rootfs
+
+import (
+	"errors"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"sync"
+)
+
+var (
+	ErrRootMissing   = remote.ErrRootMissing
+	ErrStoreReplaced = errors.New("a gc ran while writing, try again")
+)
+
+// FS is the drive filesystem at the current root, for long running
+// servers that read and change it alongside other clients.
+type FS struct {
+	c         *client.Client
+	k         *bpy.Key
+	openStore func() (bpy.CStore, error)
+
+	// Serializes updates from this client.
+	updateLock sync.Mutex
+	// Serializes reopening the store.
+	resetLock sync.Mutex
+
+	lock  sync.Mutex
+	store *Store
+}
+
+// Store is a content store of the FS. It stays open until every user has
+// released it, even after the FS switched to a new store.
+type Store struct {
+	bpy.CStore
+	f     *FS
+	epoch string
+	refs  int
+}
+
+// Release gives up the store, it is closed when it was replaced and this
+// was the last user.
+func (s *Store) Release() error {
+	return s.f.release(s)
+}
+
+// New returns the filesystem of the remote, openStore is called to get
+// a content store with a fresh index after a gc.
+func New(c *client.Client, k *bpy.Key, openStore func() (bpy.CStore, error)) (*FS, error) {
+	f := &FS{
+		c:         c,
+		k:         k,
+		openStore: openStore,
+	}
+	err := f.reset()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// refresh reopens the store if a gc ran since it was opened, its index
+// may point to removed packs.
+func (f *FS) refresh() error {
+	f.resetLock.Lock()
+	defer f.resetLock.Unlock()
+	epoch, err := remote.GetEpoch(f.c)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	current := f.store.epoch
+	f.lock.Unlock()
+	if epoch == current {
+		return nil
+	}
+	return f.swap(epoch)
+}
+
+func (f *FS) reset() error {
+	f.resetLock.Lock()
+	defer f.resetLock.Unlock()
+	epoch, err := remote.GetEpoch(f.c)
+	if err != nil {
+		return err
+	}
+	return f.swap(epoch)
+}
+
+// swap must be called with resetLock held.
+func (f *FS) swap(epoch string) error {
+	cstore, err := f.openStore()
+	if err != nil {
+		return err
+	}
+	store := &Store{CStore: cstore, f: f, epoch: epoch, refs: 1}
+	f.lock.Lock()
+	old := f.store
+	f.store = store
+	f.lock.Unlock()
+	if old != nil {
+		return old.Release()
+	}
+	return nil
+}
+
+func (f *FS) acquire() *Store {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.store.refs += 1
+	return f.store
+}
+
+func (f *FS) release(s *Store) error {
+	f.lock.Lock()
+	s.refs -= 1
+	refs := s.refs
+	f.lock.Unlock()
+	if refs == 0 {
+		return s.CStore.Close()
+	}
+	return nil
+}
+
+// Store returns the content store, new data for an update is written to it.
+// The caller must release it.
+func (f *FS) Store() *Store {
+	return f.acquire()
+}
+
+// Head returns the store, the hash of the current ref and the ref itself.
+// The caller must release the store.
+func (f *FS) Head() (*Store, [32]byte, refs.Ref, error) {
+	err := f.refresh()
+	if err != nil {
+		return nil, [32]byte{}, refs.Ref{}, err
+	}
+	store := f.acquire()
+	rootHash, _, ok, err := remote.GetRoot(f.c, f.k)
+	if err != nil {
+		store.Release()
+		return nil, [32]byte{}, refs.Ref{}, err
+	}
+	if !ok {
+		store.Release()
+		return nil, [32]byte{}, refs.Ref{}, ErrRootMissing
+	}
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		store.Release()
+		return nil, [32]byte{}, refs.Ref{}, err
+	}
+	return store, rootHash, ref, nil
+}
+
+// Root returns the store and the hash of the current root directory.
+// The caller must release the store.
+func (f *FS) Root() (*Store, [32]byte, error) {
+	store, _, ref, err := f.Head()
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	return store, ref.Root, nil
+}
+
+// Update commits the directory returned by fn as the new root, calling fn
+// again with the latest root whenever another client changed it first.
+// Nothing is committed if fn returns the root unchanged.
+//
+// If a gc runs during the update it fails, and the store is reopened so
+// later updates succeed.
+func (f *FS) Update(fn func(store bpy.CStore, root [32]byte) (fs.DirEnt, error)) error {
+	err := f.refresh()
+	if err != nil {
+		return err
+	}
+	store := f.Store()
+	defer store.Release()
+	return f.UpdateWith(store, fn)
+}
+
+// UpdateWith is Update for data already written to store, which is flushed
+// and committed with the epoch it was opened at. It fails with
+// ErrStoreReplaced if a gc ran since then, the data may then refer to
+// removed packs and must be written again to a new store.
+func (f *FS) UpdateWith(store *Store, fn func(store bpy.CStore, root [32]byte) (fs.DirEnt, error)) error {
+	f.updateLock.Lock()
+	defer f.updateLock.Unlock()
+	epoch, err := remote.GetEpoch(f.c)
+	if err != nil {
+		return err
+	}
+	if epoch != store.epoch {
+		return f.casFailed(store, ErrStoreReplaced)
+	}
+	var fnErr error
+	err = remote.UpdateRoot(f.c, f.k, store, store.epoch, func(root [32]byte) (fs.DirEnt, error) {
+		ent, err := fn(store, root)
+		fnErr = err
+		return ent, err
+	})
+	if err != nil && err != fnErr && err != ErrRootMissing {
+		return f.casFailed(store, err)
+	}
+	return err
+}
+
+// casFailed reopens the store after a failed commit, so later updates use
+// the index left by a gc, and reports whether the data must be rewritten.
+func (f *FS) casFailed(store *Store, err error) error {
+	resetErr := f.refresh()
+	if resetErr != nil {
+		return resetErr
+	}
+	f.lock.Lock()
+	replaced := f.store.epoch != store.epoch
+	f.lock.Unlock()
+	if replaced {
+		return ErrStoreReplaced
+	}
+	return err
+}
+
+// Close releases the store of the FS, it is closed once every user has
+// released it.
+func (f *FS) Close() error {
+	f.lock.Lock()
+	store := f.store
+	f.lock.Unlock()
+	return store.Release()
+}
@@ -0,0 +1,329 @@
+package rootfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/gc"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/server"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type testRepo struct {
+	t   *testing.T
+	tmp string
+	k   bpy.Key
+	srv *server.Server
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	tmp, err := ioutil.TempDir("", "bpyrootfstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(tmp, "remote"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepo{
+		t:   t,
+		tmp: tmp,
+		k:   k,
+		srv: server.NewServer(filepath.Join(tmp, "remote")),
+	}
+	c := r.attach()
+	defer c.Close()
+	_, version, _, err := remote.GetRoot(c, &k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := r.openStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.EmptyDir(store, os.ModeDir|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refHash, err := refs.PutRef(store, refs.Ref{Root: root.HTree.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = remote.CasRoot(c, &k, refHash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (r *testRepo) attach() *client.Client {
+	clientConn, serverConn := net.Pipe()
+	go r.srv.ServeConn(serverConn)
+	c, err := client.Attach(clientConn, hex.EncodeToString(r.k.Id[:]))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return c
+}
+
+func (r *testRepo) openStore(c *client.Client) (bpy.CStore, error) {
+	cachepath, err := ioutil.TempDir(r.tmp, "icache")
+	if err != nil {
+		return nil, err
+	}
+	return cstore.NewWriter(c, r.k.CipherKey, cachepath, cstore.DefaultReaderOptions, nil)
+}
+
+func (r *testRepo) open(c *client.Client) *FS {
+	f, err := New(c, &r.k, func() (bpy.CStore, error) { return r.openStore(c) })
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return f
+}
+
+func insertDir(f *FS, name string) error {
+	return f.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		ent, err := fs.EmptyDir(store, os.ModeDir|0755)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		return fs.Insert(store, root, "/"+name, ent)
+	})
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		c := r.attach()
+		defer c.Close()
+		f := r.open(c)
+		defer f.Close()
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				err := insertDir(f, name)
+				if err != nil {
+					t.Error(err)
+				}
+			}(fmt.Sprintf("%d-%d", i, j))
+		}
+	}
+	wg.Wait()
+
+	c := r.attach()
+	defer c.Close()
+	f := r.open(c)
+	defer f.Close()
+	r.checkEntries(f, 15)
+}
+
+func (r *testRepo) gc() {
+	c := r.attach()
+	defer c.Close()
+	store, err := r.openStore(c)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	cachepath, err := ioutil.TempDir(r.tmp, "icache")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	err = gc.GC(c, store, nil, &r.k, cachepath, gc.Policy{}, gc.DefaultMarkOptions, nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) checkEntries(f *FS, n int) {
+	store, root, err := f.Root()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	defer store.Release()
+	ents, err := fs.ReadDir(store, root)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if len(ents[1:]) != n {
+		r.t.Fatalf("expected %d entries, got %d", n, len(ents[1:]))
+	}
+}
+
+func TestUpdateAfterGC(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+	c := r.attach()
+	defer c.Close()
+	f := r.open(c)
+	defer f.Close()
+
+	err := insertDir(f, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.gc()
+	r.checkEntries(f, 1)
+	err = insertDir(f, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A gc in the middle of an update fails it, the next one must work.
+	err = f.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		r.gc()
+		ent, err := fs.EmptyDir(store, os.ModeDir|0755)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		return fs.Insert(store, root, "/c", ent)
+	})
+	if err == nil {
+		t.Fatal("update during a gc succeeded")
+	}
+	err = insertDir(f, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkEntries(f, 3)
+}
+
+// countingStore counts the stores opened and closed.
+type countingStore struct {
+	bpy.CStore
+	closed *int32
+}
+
+func (s *countingStore) Close() error {
+	atomic.AddInt32(s.closed, 1)
+	return s.CStore.Close()
+}
+
+func TestStoreRelease(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+	c := r.attach()
+	defer c.Close()
+
+	var opened, closed int32
+	f, err := New(c, &r.k, func() (bpy.CStore, error) {
+		store, err := r.openStore(c)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt32(&opened, 1)
+		return &countingStore{CStore: store, closed: &closed}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.gc()
+
+	// Every reader sees the gc, only one of them reopens the store.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, _, err := f.Root()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			store.Release()
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&opened) != 2 {
+		t.Fatalf("expected 2 stores opened, got %d", opened)
+	}
+	if atomic.LoadInt32(&closed) != 0 {
+		t.Fatal("replaced store closed while in use")
+	}
+	err = store.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Fatal("replaced store not closed after release")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&closed) != 2 {
+		t.Fatal("store not closed with the filesystem")
+	}
+}
+
+func TestUpdateWithAfterGC(t *testing.T) {
+	r := newTestRepo(t)
+	defer os.RemoveAll(r.tmp)
+	c := r.attach()
+	defer c.Close()
+	f := r.open(c)
+	defer f.Close()
+
+	insert := func(store *Store, ent fs.DirEnt) error {
+		return f.UpdateWith(store, func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+			return fs.Insert(store, root, "/a", ent)
+		})
+	}
+
+	// Data written before a gc may be gone, it must not be committed.
+	store := f.Store()
+	defer store.Release()
+	ent, err := fs.EmptyDir(store, os.ModeDir|0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.gc()
+	err = insert(store, ent)
+	if err != ErrStoreReplaced {
+		t.Fatalf("expected %v, got %v", ErrStoreReplaced, err)
+	}
+	r.checkEntries(f, 0)
+
+	store = f.Store()
+	defer store.Release()
+	ent, err = fs.EmptyDir(store, os.ModeDir|0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = insert(store, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkEntries(f, 1)
+}
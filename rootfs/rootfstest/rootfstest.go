@@ -0,0 +1,89 @@
+// Package rootfstest provides a drive served from a temporary directory for tests.
+package rootfstest
+
+import (
+	"encoding/hex"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/server"
+	"github.com/buppyio/bpy/rootfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// New returns the filesystem of a new drive with an empty root, the
+// returned function closes it and removes the drive.
+func New(tb testing.TB) (*rootfs.FS, func()) {
+	tmp, err := ioutil.TempDir("", "bpyrootfstest")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	k, err := bpy.NewKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(tmp, "remote"), 0700)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := server.NewServer(filepath.Join(tmp, "remote"))
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(serverConn)
+	c, err := client.Attach(clientConn, hex.EncodeToString(k.Id[:]))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	openStore := func() (bpy.CStore, error) {
+		cachepath, err := ioutil.TempDir(tmp, "icache")
+		if err != nil {
+			return nil, err
+		}
+		return cstore.NewWriter(c, k.CipherKey, cachepath, cstore.DefaultReaderOptions, nil)
+	}
+
+	_, version, _, err := remote.GetRoot(c, &k)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	store, err := openStore()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	root, err := fs.EmptyDir(store, os.ModeDir|0755)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	refHash, err := refs.PutRef(store, refs.Ref{Root: root.HTree.Data})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = store.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	epoch, err := remote.GetEpoch(c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = remote.CasRoot(c, &k, refHash, bpy.NextRootVersion(version), epoch)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	f, err := rootfs.New(c, &k, openStore)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return f, func() {
+		f.Close()
+		c.Close()
+		os.RemoveAll(tmp)
+	}
+}
@@ -0,0 +1,658 @@
+package s3gateway
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/rootfs"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Bucket exposes the directory at Path as an S3 bucket.
+type Bucket struct {
+	Name string
+	Path string
+}
+
+// ParseBucket parses a NAME=PATH bucket definition.
+func ParseBucket(s string) (Bucket, error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return Bucket{}, fmt.Errorf("bad bucket '%s', expected NAME=PATH", s)
+	}
+	return Bucket{Name: s[:idx], Path: path.Clean("/" + s[idx+1:])}, nil
+}
+
+// Handler serves buckets of the drive with the S3 REST API, using path
+// style addressing. Requests are not authenticated, and every change is
+// committed as a new ref.
+type Handler struct {
+	fs      *rootfs.FS
+	buckets map[string]Bucket
+	names   []string
+}
+
+func NewHandler(f *rootfs.FS, buckets []Bucket) *Handler {
+	h := &Handler{
+		fs:      f,
+		buckets: make(map[string]Bucket),
+	}
+	for _, b := range buckets {
+		h.buckets[b.Name] = b
+		h.names = append(h.names, b.Name)
+	}
+	sort.Strings(h.names)
+	return h
+}
+
+type s3Error struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string { return e.Message }
+
+var (
+	errNoSuchBucket     = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errNoSuchKey        = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNotImplemented   = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported."}
+	errBadDigest        = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received."}
+	errInvalidDigest    = &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid."}
+	errInvalidKey       = &s3Error{http.StatusBadRequest, "InvalidArgument", "Object keys must be valid paths."}
+	errInvalidArgument  = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errKeyConflict      = &s3Error{http.StatusConflict, "InvalidRequest", "The key conflicts with an existing directory or file."}
+	errMethodNotAllowed = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errSlowDown         = &s3Error{http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."}
+)
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	err := xml.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.serve(w, r)
+	if err == nil {
+		return
+	}
+	s3err, ok := err.(*s3Error)
+	if !ok {
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		s3err = &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(s3err.status)
+		return
+	}
+	writeXML(w, s3err.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{
+		Code:     s3err.Code,
+		Message:  s3err.Message,
+		Resource: r.URL.Path,
+	})
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p == "" {
+		if r.Method != "GET" {
+			return errMethodNotAllowed
+		}
+		return h.listBuckets(w, r)
+	}
+	name, key := p, ""
+	idx := strings.Index(p, "/")
+	if idx >= 0 {
+		name, key = p[:idx], p[idx+1:]
+	}
+	b, ok := h.buckets[name]
+	if !ok {
+		return errNoSuchBucket
+	}
+	if key == "" {
+		switch r.Method {
+		case "GET":
+			_, ok := r.URL.Query()["location"]
+			if ok {
+				writeXML(w, http.StatusOK, struct {
+					XMLName xml.Name `xml:"LocationConstraint"`
+					Xmlns   string   `xml:"xmlns,attr"`
+				}{Xmlns: s3Namespace})
+				return nil
+			}
+			return h.listObjects(w, r, b)
+		case "HEAD", "PUT":
+			// The bucket always exists, creating it again is fine.
+			return nil
+		default:
+			return errNotImplemented
+		}
+	}
+	objPath, err := objectPath(b, key)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		return h.getObject(w, r, objPath)
+	case "PUT":
+		return h.putObject(w, r, objPath, strings.HasSuffix(key, "/"))
+	case "DELETE":
+		return h.deleteObject(w, r, objPath, strings.HasSuffix(key, "/"))
+	default:
+		return errNotImplemented
+	}
+}
+
+// objectPath returns the drive path of key, keys must not need cleaning.
+func objectPath(b Bucket, key string) (string, error) {
+	for _, elem := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return "", errInvalidKey
+		}
+	}
+	return path.Join(b.Path, key), nil
+}
+
+func etag(ent fs.DirEnt) string {
+	return `"` + hex.EncodeToString(ent.HTree.Data[:]) + `"`
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (h *Handler) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+	result.Owner.ID = "bpy"
+	result.Owner.DisplayName = "bpy"
+	for _, name := range h.names {
+		result.Buckets = append(result.Buckets, bucket{Name: name, CreationDate: formatTime(time.Unix(0, 0))})
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+type object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listing struct {
+	objects  []object
+	prefixes map[string]struct{}
+}
+
+// walk lists the files below dir with keys starting with prefix, grouping
+// keys containing delimiter after the prefix. Directories that can not hold
+// matching keys are skipped.
+func (l *listing) walk(store bpy.CStore, dir [32]byte, keyPrefix, prefix, delimiter string) error {
+	ents, err := fs.ReadDir(store, dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents[1:] {
+		key := keyPrefix + ent.EntName
+		if ent.IsDir() {
+			key += "/"
+		}
+		if !strings.HasPrefix(key, prefix) && !(ent.IsDir() && strings.HasPrefix(prefix, key)) {
+			continue
+		}
+		if delimiter != "" && strings.HasPrefix(key, prefix) {
+			idx := strings.Index(key[len(prefix):], delimiter)
+			if idx >= 0 {
+				l.prefixes[key[:len(prefix)+idx+len(delimiter)]] = struct{}{}
+				continue
+			}
+		}
+		if ent.IsDir() {
+			err = l.walk(store, ent.HTree.Data, key, prefix, delimiter)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		l.objects = append(l.objects, object{
+			Key:          key,
+			LastModified: formatTime(ent.ModTime()),
+			ETag:         etag(ent),
+			Size:         ent.EntSize,
+			StorageClass: "STANDARD",
+		})
+	}
+	return nil
+}
+
+func (h *Handler) listObjects(w http.ResponseWriter, r *http.Request, b Bucket) error {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	maxKeys := 1000
+	if q.Get("max-keys") != "" {
+		n, err := strconv.Atoi(q.Get("max-keys"))
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if q.Get("continuation-token") != "" {
+			token, err := base64.URLEncoding.DecodeString(q.Get("continuation-token"))
+			if err != nil {
+				return errInvalidArgument
+			}
+			after = string(token)
+		}
+	}
+
+	store, root, err := h.fs.Root()
+	if err != nil {
+		return err
+	}
+	defer store.Release()
+	l := &listing{prefixes: make(map[string]struct{})}
+	ent, ok, err := fs.Lookup(store, root, b.Path)
+	if err != nil {
+		return err
+	}
+	if ok && ent.IsDir() {
+		err = l.walk(store, ent.HTree.Data, "", prefix, delimiter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Objects and common prefixes are paged together in key order.
+	type item struct {
+		key string
+		obj *object
+	}
+	items := []item{}
+	for i := range l.objects {
+		items = append(items, item{key: l.objects[i].Key, obj: &l.objects[i]})
+	}
+	for p := range l.prefixes {
+		items = append(items, item{key: p})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	start := sort.Search(len(items), func(i int) bool { return items[i].key > after })
+	items = items[start:]
+	truncated := len(items) > maxKeys
+	if truncated {
+		items = items[:maxKeys]
+	}
+
+	encode := func(s string) string { return s }
+	encodingType := ""
+	if q.Get("encoding-type") == "url" {
+		encodingType = "url"
+		encode = url.QueryEscape
+	}
+	contents := []object{}
+	prefixes := []commonPrefix{}
+	for _, it := range items {
+		if it.obj == nil {
+			prefixes = append(prefixes, commonPrefix{Prefix: encode(it.key)})
+			continue
+		}
+		obj := *it.obj
+		obj.Key = encode(obj.Key)
+		contents = append(contents, obj)
+	}
+	next := ""
+	if truncated {
+		next = items[len(items)-1].key
+	}
+
+	if v2 {
+		result := struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Xmlns                 string   `xml:"xmlns,attr"`
+			Name                  string
+			Prefix                string
+			Delimiter             string `xml:",omitempty"`
+			EncodingType          string `xml:",omitempty"`
+			MaxKeys               int
+			KeyCount              int
+			IsTruncated           bool
+			ContinuationToken     string `xml:",omitempty"`
+			NextContinuationToken string `xml:",omitempty"`
+			StartAfter            string `xml:",omitempty"`
+			Contents              []object
+			CommonPrefixes        []commonPrefix
+		}{
+			Xmlns:             s3Namespace,
+			Name:              b.Name,
+			Prefix:            encode(prefix),
+			Delimiter:         encode(delimiter),
+			EncodingType:      encodingType,
+			MaxKeys:           maxKeys,
+			KeyCount:          len(items),
+			IsTruncated:       truncated,
+			ContinuationToken: q.Get("continuation-token"),
+			StartAfter:        encode(q.Get("start-after")),
+			Contents:          contents,
+			CommonPrefixes:    prefixes,
+		}
+		if truncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(next))
+		}
+		writeXML(w, http.StatusOK, result)
+		return nil
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		Name           string
+		Prefix         string
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		Delimiter      string `xml:",omitempty"`
+		EncodingType   string `xml:",omitempty"`
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}{
+		Xmlns:          s3Namespace,
+		Name:           b.Name,
+		Prefix:         encode(prefix),
+		Marker:         encode(q.Get("marker")),
+		NextMarker:     encode(next),
+		Delimiter:      encode(delimiter),
+		EncodingType:   encodingType,
+		MaxKeys:        maxKeys,
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+	return nil
+}
+
+func (h *Handler) getObject(w http.ResponseWriter, r *http.Request, objPath string) error {
+	store, root, err := h.fs.Root()
+	if err != nil {
+		return err
+	}
+	defer store.Release()
+	ent, ok, err := fs.Lookup(store, root, objPath)
+	if err != nil {
+		return err
+	}
+	if !ok || ent.IsDir() {
+		return errNoSuchKey
+	}
+	f, err := fs.OpenEnt(store, ent)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("ETag", etag(ent))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, ent.EntName, ent.ModTime(), f)
+	return nil
+}
+
+// chunkedReader decodes a body sent with aws-chunked content encoding,
+// chunk signatures and trailing checksums are ignored.
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+var errBadChunk = errors.New("bad aws-chunked body")
+
+func (c *chunkedReader) Read(buf []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, errBadChunk
+		}
+		line = strings.TrimSpace(line)
+		idx := strings.Index(line, ";")
+		if idx >= 0 {
+			line = line[:idx]
+		}
+		size, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || size < 0 {
+			return 0, errBadChunk
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+	if int64(len(buf)) > c.left {
+		buf = buf[:c.left]
+	}
+	n, err := c.r.Read(buf)
+	c.left -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if c.left == 0 {
+		var crlf [2]byte
+		_, err = io.ReadFull(c.r, crlf[:])
+		if err != nil || string(crlf[:]) != "\r\n" {
+			return n, errBadChunk
+		}
+	}
+	return n, nil
+}
+
+func objectBody(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return &chunkedReader{r: bufio.NewReader(r.Body)}
+	}
+	return r.Body
+}
+
+func (h *Handler) putObject(w http.ResponseWriter, r *http.Request, objPath string, isDir bool) error {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return errNotImplemented
+	}
+	var expectedMD5 []byte
+	if r.Header.Get("Content-MD5") != "" {
+		var err error
+		expectedMD5, err = base64.StdEncoding.DecodeString(r.Header.Get("Content-MD5"))
+		if err != nil || len(expectedMD5) != md5.Size {
+			return errInvalidDigest
+		}
+	}
+
+	sum := md5.New()
+	store := h.fs.Store()
+	defer store.Release()
+	tw := htree.NewWriter(store)
+	size, err := io.Copy(io.MultiWriter(tw, sum), objectBody(r))
+	if err != nil {
+		return err
+	}
+	tree, err := tw.Close()
+	if err != nil {
+		return err
+	}
+	if expectedMD5 != nil && string(sum.Sum(nil)) != string(expectedMD5) {
+		return errBadDigest
+	}
+	if isDir {
+		if size != 0 {
+			return errInvalidKey
+		}
+		err = h.fs.UpdateWith(store, func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+			ent, ok, err := fs.Lookup(store, root, objPath)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			if ok && !ent.IsDir() {
+				return fs.DirEnt{}, errKeyConflict
+			}
+			err = checkParents(store, root, objPath)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			return fs.MkdirAll(store, root, objPath, 0755)
+		})
+		if err == rootfs.ErrStoreReplaced {
+			return errSlowDown
+		}
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+		return nil
+	}
+
+	ent := fs.DirEnt{
+		EntSize:    size,
+		EntMode:    0644,
+		EntModTime: time.Now().Unix(),
+		HTree:      tree,
+	}
+	err = h.fs.UpdateWith(store, func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		err := checkParents(store, root, objPath)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		newRoot, err := fs.MkdirAll(store, root, path.Dir(objPath), 0755)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		root = newRoot.HTree.Data
+		existing, ok, err := fs.Lookup(store, root, objPath)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok {
+			if existing.IsDir() {
+				return fs.DirEnt{}, errKeyConflict
+			}
+			newRoot, err := fs.Remove(store, root, objPath)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			root = newRoot.HTree.Data
+		}
+		return fs.Insert(store, root, objPath, ent)
+	})
+	if err == rootfs.ErrStoreReplaced {
+		return errSlowDown
+	}
+	if err != nil {
+		return err
+	}
+	// S3 clients check the ETag of an upload against its MD5, the ETag
+	// served for the object afterwards is its content hash.
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	return nil
+}
+
+// checkParents returns errKeyConflict if a file is in the way of the
+// directories above p.
+func checkParents(store bpy.CStore, root [32]byte, p string) error {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		ent, ok, err := fs.Lookup(store, root, dir)
+		if err != nil {
+			return err
+		}
+		if ok && !ent.IsDir() {
+			return errKeyConflict
+		}
+	}
+	return nil
+}
+
+// deleteObject succeeds if the key does not exist like S3, directories
+// are only removed through their key with a trailing slash, and only
+// when empty.
+func (h *Handler) deleteObject(w http.ResponseWriter, r *http.Request, objPath string, isDir bool) error {
+	err := h.fs.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		unchanged := func() (fs.DirEnt, error) {
+			rootEnt, _, err := fs.Lookup(store, root, "/")
+			return rootEnt, err
+		}
+		ent, ok, err := fs.Lookup(store, root, objPath)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if !ok || ent.IsDir() != isDir {
+			return unchanged()
+		}
+		if isDir {
+			ents, err := fs.ReadDir(store, ent.HTree.Data)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			if len(ents) > 1 {
+				return unchanged()
+			}
+		}
+		return fs.Remove(store, root, objPath)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
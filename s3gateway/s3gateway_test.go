@@ -0,0 +1,176 @@
+package s3gateway
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/rootfs/rootfstest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type listResult struct {
+	Keys                  []string `xml:"Contents>Key"`
+	Prefixes              []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func TestS3Gateway(t *testing.T) {
+	f, cleanup := rootfstest.New(t)
+	defer cleanup()
+	srv := httptest.NewServer(NewHandler(f, []Bucket{
+		{Name: "root", Path: "/"},
+		{Name: "photos", Path: "/home/photos"},
+	}))
+	defer srv.Close()
+
+	do := func(method, p string, hdr map[string]string, body string, expected int) (string, http.Header) {
+		req, err := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, p, expected, resp.StatusCode, data)
+		}
+		return string(data), resp.Header
+	}
+	list := func(query string) listResult {
+		body, _ := do("GET", "/photos?list-type=2&"+query, nil, "", http.StatusOK)
+		var result listResult
+		err := xml.Unmarshal([]byte(body), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	body, _ := do("GET", "/", nil, "", http.StatusOK)
+	if !strings.Contains(body, "<Name>photos</Name>") || !strings.Contains(body, "<Name>root</Name>") {
+		t.Fatalf("bad bucket listing: %s", body)
+	}
+	do("HEAD", "/photos", nil, "", http.StatusOK)
+	do("GET", "/missing?list-type=2", nil, "", http.StatusNotFound)
+	if len(list("").Keys) != 0 {
+		t.Fatal("expected an empty bucket")
+	}
+
+	contents := strings.Repeat("0123456789", 1000)
+	sum := md5.Sum([]byte(contents))
+	_, hdr := do("PUT", "/photos/2016/a.jpg", map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}, contents, http.StatusOK)
+	if hdr.Get("ETag") != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Fatalf("PUT etag %s is not the md5", hdr.Get("ETag"))
+	}
+	do("PUT", "/photos/2016/b.jpg", map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}, "corrupt", http.StatusBadRequest)
+	do("PUT", "/photos/2016/b.jpg", map[string]string{
+		"X-Amz-Content-Sha256": "STREAMING-AWS4-HMAC-SHA256-PAYLOAD",
+		"Content-Encoding":     "aws-chunked",
+	}, "5;chunk-signature=abc\r\nhello\r\n6;chunk-signature=def\r\n world\r\n0;chunk-signature=ghi\r\n\r\n", http.StatusOK)
+	do("PUT", "/photos/2017/c.jpg", nil, "c", http.StatusOK)
+	do("PUT", "/photos/top.txt", nil, "top", http.StatusOK)
+	do("PUT", "/photos/2016/a.jpg/x", nil, "x", http.StatusConflict)
+	do("PUT", "/photos/2016/a.jpg/x/y", nil, "y", http.StatusConflict)
+	do("PUT", "/photos/2016/a.jpg/z/", nil, "", http.StatusConflict)
+	do("PUT", "/photos/../x", nil, "x", http.StatusBadRequest)
+
+	body, hdr = do("GET", "/photos/2016/a.jpg", nil, "", http.StatusOK)
+	if body != contents {
+		t.Fatal("GET returned the wrong contents")
+	}
+	body, _ = do("GET", "/photos/2016/a.jpg", map[string]string{"Range": "bytes=10-14"}, "", http.StatusPartialContent)
+	if body != "01234" {
+		t.Fatalf("range GET returned %q", body)
+	}
+	_, headHdr := do("HEAD", "/photos/2016/a.jpg", nil, "", http.StatusOK)
+	if headHdr.Get("Content-Length") != fmt.Sprint(len(contents)) || headHdr.Get("ETag") != hdr.Get("ETag") {
+		t.Fatalf("bad HEAD headers: %v", headHdr)
+	}
+	body, _ = do("GET", "/photos/2016/b.jpg", nil, "", http.StatusOK)
+	if body != "hello world" {
+		t.Fatalf("chunked PUT stored %q", body)
+	}
+	body, _ = do("GET", "/root/home/photos/top.txt", nil, "", http.StatusOK)
+	if body != "top" {
+		t.Fatal("buckets do not share the drive")
+	}
+	do("GET", "/photos/2016", nil, "", http.StatusNotFound)
+	do("GET", "/photos/missing", nil, "", http.StatusNotFound)
+
+	all := []string{"2016/a.jpg", "2016/b.jpg", "2017/c.jpg", "top.txt"}
+	if result := list(""); !reflect.DeepEqual(result.Keys, all) {
+		t.Fatalf("bad listing: %v", result.Keys)
+	}
+	result := list("delimiter=/")
+	if !reflect.DeepEqual(result.Keys, []string{"top.txt"}) || !reflect.DeepEqual(result.Prefixes, []string{"2016/", "2017/"}) {
+		t.Fatalf("bad delimited listing: %+v", result)
+	}
+	result = list("prefix=2016/&delimiter=/")
+	if !reflect.DeepEqual(result.Keys, []string{"2016/a.jpg", "2016/b.jpg"}) || len(result.Prefixes) != 0 {
+		t.Fatalf("bad prefix listing: %+v", result)
+	}
+	result = list("prefix=201")
+	if !reflect.DeepEqual(result.Keys, all[:3]) {
+		t.Fatalf("bad partial prefix listing: %+v", result)
+	}
+
+	keys := []string{}
+	token := ""
+	for {
+		result = list("max-keys=3&continuation-token=" + token)
+		keys = append(keys, result.Keys...)
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if !reflect.DeepEqual(keys, all) {
+		t.Fatalf("bad paged listing: %v", keys)
+	}
+
+	do("DELETE", "/photos/2016/a.jpg", nil, "", http.StatusNoContent)
+	do("DELETE", "/photos/2016/a.jpg", nil, "", http.StatusNoContent)
+	do("DELETE", "/photos/2017/c.jpg", nil, "", http.StatusNoContent)
+	do("DELETE", "/photos/2017/", nil, "", http.StatusNoContent)
+	do("PUT", "/photos/empty/", nil, "", http.StatusOK)
+	if result := list(""); !reflect.DeepEqual(result.Keys, []string{"2016/b.jpg", "top.txt"}) {
+		t.Fatalf("bad listing after delete: %v", result.Keys)
+	}
+
+	store, root, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Release()
+	for p, exists := range map[string]bool{"/home/photos/2017": false, "/home/photos/empty": true} {
+		_, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != exists {
+			t.Fatalf("%s: expected exists=%v", p, exists)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/rootfs"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Handler serves the drive over WebDAV (RFC 4918). Every change is
+// committed as a new ref. Locks are granted so clients that require them
+// work, but they are not enforced.
+type Handler struct {
+	fs *rootfs.FS
+}
+
+func NewHandler(f *rootfs.FS) *Handler {
+	return &Handler{fs: f}
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func errStatus(code int) error {
+	return &httpError{code: code, msg: http.StatusText(code)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var code int
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		code, err = h.handleOptions(w, r)
+	case "GET", "HEAD":
+		code, err = h.handleGet(w, r)
+	case "PROPFIND":
+		code, err = h.handlePropfind(w, r)
+	case "PROPPATCH":
+		code, err = h.handleProppatch(w, r)
+	case "PUT":
+		code, err = h.handlePut(w, r)
+	case "MKCOL":
+		code, err = h.handleMkcol(w, r)
+	case "DELETE":
+		code, err = h.handleDelete(w, r)
+	case "COPY", "MOVE":
+		code, err = h.handleCopyMove(w, r)
+	case "LOCK":
+		code, err = h.handleLock(w, r)
+	case "UNLOCK":
+		code, err = http.StatusNoContent, nil
+	default:
+		code = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		herr, ok := err.(*httpError)
+		if ok {
+			code = herr.code
+		} else {
+			code = http.StatusInternalServerError
+			log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if code != 0 {
+		w.WriteHeader(code)
+	}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// checkParent returns a conflict if the parent of p is not a directory.
+func checkParent(store bpy.CStore, root [32]byte, p string) error {
+	parent, ok, err := fs.Lookup(store, root, path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !ok || !parent.IsDir() {
+		return errStatus(http.StatusConflict)
+	}
+	return nil
+}
+
+func etag(ent fs.DirEnt) string {
+	return `"` + hex.EncodeToString(ent.HTree.Data[:]) + `"`
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND, PROPPATCH, PUT, MKCOL, DELETE, COPY, MOVE, LOCK, UNLOCK")
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	return http.StatusOK, nil
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request) (int, error) {
+	store, root, err := h.fs.Root()
+	if err != nil {
+		return 0, err
+	}
+	defer store.Release()
+	p := cleanPath(r.URL.Path)
+	ent, ok, err := fs.Lookup(store, root, p)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errStatus(http.StatusNotFound)
+	}
+	if ent.IsDir() {
+		return 0, errStatus(http.StatusMethodNotAllowed)
+	}
+	f, err := fs.OpenEnt(store, ent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w.Header().Set("ETag", etag(ent))
+	http.ServeContent(w, r, ent.EntName, ent.ModTime(), f)
+	return 0, nil
+}
+
+type multistatus struct {
+	buf bytes.Buffer
+}
+
+func newMultistatus() *multistatus {
+	ms := &multistatus{}
+	ms.buf.WriteString(xml.Header)
+	ms.buf.WriteString(`<D:multistatus xmlns:D="DAV:">` + "\n")
+	return ms
+}
+
+func (ms *multistatus) text(s string) {
+	xml.EscapeText(&ms.buf, []byte(s))
+}
+
+func (ms *multistatus) href(p string, isDir bool) {
+	if isDir && p != "/" {
+		p += "/"
+	}
+	u := url.URL{Path: p}
+	ms.buf.WriteString("<D:href>")
+	ms.text(u.EscapedPath())
+	ms.buf.WriteString("</D:href>")
+}
+
+func (ms *multistatus) prop(name, value string) {
+	fmt.Fprintf(&ms.buf, "<D:%s>", name)
+	ms.text(value)
+	fmt.Fprintf(&ms.buf, "</D:%s>", name)
+}
+
+func (ms *multistatus) entry(p string, ent fs.DirEnt) {
+	ms.buf.WriteString("<D:response>")
+	ms.href(p, ent.IsDir())
+	ms.buf.WriteString("<D:propstat><D:prop>")
+	if p != "/" {
+		ms.prop("displayname", ent.EntName)
+	}
+	modTime := ent.ModTime().UTC()
+	ms.prop("getlastmodified", modTime.Format(http.TimeFormat))
+	ms.prop("creationdate", modTime.Format(time.RFC3339))
+	if ent.IsDir() {
+		ms.buf.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		ms.buf.WriteString("<D:resourcetype/>")
+		ms.prop("getcontentlength", fmt.Sprintf("%d", ent.EntSize))
+		ctype := mime.TypeByExtension(path.Ext(ent.EntName))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		ms.prop("getcontenttype", ctype)
+		ms.prop("getetag", etag(ent))
+	}
+	ms.buf.WriteString("<D:supportedlock><D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+		"<D:locktype><D:write/></D:locktype></D:lockentry></D:supportedlock>")
+	ms.buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>\n")
+}
+
+func (ms *multistatus) write(w http.ResponseWriter) {
+	ms.buf.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(ms.buf.Bytes())
+}
+
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (int, error) {
+	// Every request is answered with all properties.
+	_, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		return 0, err
+	}
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// Listing a whole tree could take a very long time.
+		return 0, errStatus(http.StatusForbidden)
+	}
+	store, root, err := h.fs.Root()
+	if err != nil {
+		return 0, err
+	}
+	defer store.Release()
+	p := cleanPath(r.URL.Path)
+	ent, ok, err := fs.Lookup(store, root, p)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errStatus(http.StatusNotFound)
+	}
+	ms := newMultistatus()
+	ms.entry(p, ent)
+	if ent.IsDir() && depth == "1" {
+		ents, err := fs.ReadDir(store, ent.HTree.Data)
+		if err != nil {
+			return 0, err
+		}
+		for _, child := range ents[1:] {
+			ms.entry(path.Join(p, child.EntName), child)
+		}
+	}
+	ms.write(w)
+	return 0, nil
+}
+
+// handleProppatch refuses every change, there are no writable properties.
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (int, error) {
+	store, root, err := h.fs.Root()
+	if err != nil {
+		return 0, err
+	}
+	defer store.Release()
+	p := cleanPath(r.URL.Path)
+	ent, ok, err := fs.Lookup(store, root, p)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errStatus(http.StatusNotFound)
+	}
+	names, err := patchedProps(r.Body)
+	if err != nil {
+		return 0, errStatus(http.StatusBadRequest)
+	}
+	ms := newMultistatus()
+	ms.buf.WriteString("<D:response>")
+	ms.href(p, ent.IsDir())
+	for _, name := range names {
+		ms.buf.WriteString("<D:propstat><D:prop>")
+		fmt.Fprintf(&ms.buf, `<R:%s xmlns:R="`, name.Local)
+		ms.text(name.Space)
+		ms.buf.WriteString(`"/>`)
+		ms.buf.WriteString("</D:prop><D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat>")
+	}
+	ms.buf.WriteString("</D:response>\n")
+	ms.write(w)
+	return 0, nil
+}
+
+// patchedProps returns the names of the properties a PROPPATCH body sets or removes.
+func patchedProps(body io.Reader) ([]xml.Name, error) {
+	names := []xml.Name{}
+	d := xml.NewDecoder(body)
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			// propertyupdate > set|remove > prop > property
+			if depth == 4 {
+				names = append(names, tok.Name)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (int, error) {
+	p := cleanPath(r.URL.Path)
+	if p == "/" {
+		return 0, errStatus(http.StatusMethodNotAllowed)
+	}
+	store := h.fs.Store()
+	defer store.Release()
+	tw := htree.NewWriter(store)
+	size, err := io.Copy(tw, r.Body)
+	if err != nil {
+		return 0, err
+	}
+	tree, err := tw.Close()
+	if err != nil {
+		return 0, err
+	}
+	code := http.StatusCreated
+	err = h.fs.UpdateWith(store, func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		err := checkParent(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		ent, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		mode := os.FileMode(0644)
+		code = http.StatusCreated
+		if ok {
+			if ent.IsDir() {
+				return fs.DirEnt{}, errStatus(http.StatusMethodNotAllowed)
+			}
+			mode = ent.EntMode
+			code = http.StatusNoContent
+			newRoot, err := fs.Remove(store, root, p)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			root = newRoot.HTree.Data
+		}
+		return fs.Insert(store, root, p, fs.DirEnt{
+			EntSize:    size,
+			EntMode:    mode,
+			EntModTime: time.Now().Unix(),
+			HTree:      tree,
+		})
+	})
+	if err == rootfs.ErrStoreReplaced {
+		return 0, errStatus(http.StatusServiceUnavailable)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return code, nil
+}
+
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.ContentLength > 0 {
+		return 0, errStatus(http.StatusUnsupportedMediaType)
+	}
+	p := cleanPath(r.URL.Path)
+	err := h.fs.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		err := checkParent(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		_, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok {
+			return fs.DirEnt{}, errStatus(http.StatusMethodNotAllowed)
+		}
+		dir, err := fs.EmptyDir(store, os.ModeDir|0755)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		dir.EntModTime = time.Now().Unix()
+		return fs.Insert(store, root, p, dir)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (int, error) {
+	p := cleanPath(r.URL.Path)
+	if p == "/" {
+		return 0, errStatus(http.StatusForbidden)
+	}
+	err := h.fs.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		_, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if !ok {
+			return fs.DirEnt{}, errStatus(http.StatusNotFound)
+		}
+		return fs.Remove(store, root, p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (int, error) {
+	src := cleanPath(r.URL.Path)
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return 0, errStatus(http.StatusBadRequest)
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return 0, errStatus(http.StatusBadGateway)
+	}
+	dest := cleanPath(u.Path)
+	if src == "/" || dest == "/" || src == dest || strings.HasPrefix(dest, src+"/") {
+		return 0, errStatus(http.StatusForbidden)
+	}
+	overwrite := r.Header.Get("Overwrite") != "F"
+	shallow := r.Method == "COPY" && r.Header.Get("Depth") == "0"
+
+	code := http.StatusCreated
+	err = h.fs.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		srcEnt, ok, err := fs.Lookup(store, root, src)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if !ok {
+			return fs.DirEnt{}, errStatus(http.StatusNotFound)
+		}
+		err = checkParent(store, root, dest)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		_, exists, err := fs.Lookup(store, root, dest)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		code = http.StatusCreated
+		if exists {
+			if !overwrite {
+				return fs.DirEnt{}, errStatus(http.StatusPreconditionFailed)
+			}
+			code = http.StatusNoContent
+			newRoot, err := fs.Remove(store, root, dest)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			root = newRoot.HTree.Data
+		}
+		if shallow && srcEnt.IsDir() {
+			dir, err := fs.EmptyDir(store, srcEnt.EntMode)
+			if err != nil {
+				return fs.DirEnt{}, err
+			}
+			dir.EntModTime = srcEnt.EntModTime
+			return fs.Insert(store, root, dest, dir)
+		}
+		if r.Method == "MOVE" {
+			return fs.Move(store, root, dest, src)
+		}
+		return fs.Copy(store, root, dest, src)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return code, nil
+}
+
+// handleLock grants every lock request, creating an empty file when the
+// resource does not exist as clients expect.
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (int, error) {
+	_, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		return 0, err
+	}
+	p := cleanPath(r.URL.Path)
+	code := http.StatusOK
+	err = h.fs.Update(func(store bpy.CStore, root [32]byte) (fs.DirEnt, error) {
+		_, ok, err := fs.Lookup(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		if ok {
+			code = http.StatusOK
+			rootEnt, _, err := fs.Lookup(store, root, "/")
+			return rootEnt, err
+		}
+		err = checkParent(store, root, p)
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		tree, err := htree.NewWriter(store).Close()
+		if err != nil {
+			return fs.DirEnt{}, err
+		}
+		code = http.StatusCreated
+		return fs.Insert(store, root, p, fs.DirEnt{
+			EntMode:    0644,
+			EntModTime: time.Now().Unix(),
+			HTree:      tree,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	token, err := bpy.RandomFileName()
+	if err != nil {
+		return 0, err
+	}
+	token = "opaquelocktoken:" + token
+	timeout := r.Header.Get("Timeout")
+	if timeout == "" {
+		timeout = "Infinite"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>` +
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope><D:depth>infinity</D:depth>`)
+	buf.WriteString("<D:timeout>")
+	xml.EscapeText(&buf, []byte(timeout))
+	buf.WriteString("</D:timeout><D:locktoken><D:href>")
+	xml.EscapeText(&buf, []byte(token))
+	buf.WriteString("</D:href></D:locktoken><D:lockroot><D:href>")
+	xml.EscapeText(&buf, []byte((&url.URL{Path: p}).EscapedPath()))
+	buf.WriteString("</D:href></D:lockroot></D:activelock></D:lockdiscovery></D:prop>\n")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+	return 0, nil
+}
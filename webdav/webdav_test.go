@@ -0,0 +1,118 @@
+package webdav
+
+import (
+	"bytes"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/rootfs/rootfstest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	f, cleanup := rootfstest.New(t)
+	defer cleanup()
+	srv := httptest.NewServer(NewHandler(f))
+	defer srv.Close()
+
+	do := func(method, p string, hdr map[string]string, body string, expected int) string {
+		req, err := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, p, expected, resp.StatusCode, data)
+		}
+		return string(data)
+	}
+	depth1 := map[string]string{"Depth": "1"}
+	contents := strings.Repeat("hello webdav ", 10000)
+
+	do("MKCOL", "/d", nil, "", http.StatusCreated)
+	do("MKCOL", "/d", nil, "", http.StatusMethodNotAllowed)
+	do("MKCOL", "/x/y", nil, "", http.StatusConflict)
+	do("PUT", "/d/a.txt", nil, "old", http.StatusCreated)
+	do("PUT", "/d/a.txt", nil, contents, http.StatusNoContent)
+	do("PUT", "/x/a.txt", nil, contents, http.StatusConflict)
+	if do("GET", "/d/a.txt", nil, "", http.StatusOK) != contents {
+		t.Fatal("GET returned the wrong contents")
+	}
+	if do("GET", "/d/a.txt", map[string]string{"Range": "bytes=6-11"}, "", http.StatusPartialContent) != "webdav" {
+		t.Fatal("range GET returned the wrong contents")
+	}
+	do("GET", "/d/missing", nil, "", http.StatusNotFound)
+
+	listing := do("PROPFIND", "/d", depth1, "", http.StatusMultiStatus)
+	if !strings.Contains(listing, "<D:href>/d/a.txt</D:href>") ||
+		!strings.Contains(listing, "<D:getcontentlength>130000</D:getcontentlength>") {
+		t.Fatalf("bad listing: %s", listing)
+	}
+	do("PROPFIND", "/d", map[string]string{"Depth": "infinity"}, "", http.StatusForbidden)
+
+	do("COPY", "/d/a.txt", map[string]string{"Destination": srv.URL + "/d/b.txt"}, "", http.StatusCreated)
+	do("COPY", "/d/a.txt", map[string]string{"Destination": "/d/b.txt", "Overwrite": "F"}, "", http.StatusPreconditionFailed)
+	do("MOVE", "/d/b.txt", map[string]string{"Destination": "/c%20d.txt"}, "", http.StatusCreated)
+	do("MOVE", "/d", map[string]string{"Destination": "/d/e"}, "", http.StatusForbidden)
+	if do("GET", "/c%20d.txt", nil, "", http.StatusOK) != contents {
+		t.Fatal("GET of a moved file returned the wrong contents")
+	}
+	do("DELETE", "/d", nil, "", http.StatusNoContent)
+	do("DELETE", "/d", nil, "", http.StatusNotFound)
+
+	lock := do("LOCK", "/new.txt", nil, "", http.StatusCreated)
+	if !strings.Contains(lock, "opaquelocktoken:") {
+		t.Fatalf("bad lock response: %s", lock)
+	}
+	do("UNLOCK", "/new.txt", nil, "", http.StatusNoContent)
+
+	patch := do("PROPPATCH", "/new.txt", nil, `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+<D:set><D:prop><Z:Win32LastModifiedTime>x</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`, http.StatusMultiStatus)
+	if !strings.Contains(patch, "Win32LastModifiedTime") || !strings.Contains(patch, "403 Forbidden") {
+		t.Fatalf("bad proppatch response: %s", patch)
+	}
+
+	listing = do("PROPFIND", "/", depth1, "", http.StatusMultiStatus)
+	for _, href := range []string{"/c%20d.txt", "/new.txt"} {
+		if !strings.Contains(listing, "<D:href>"+href+"</D:href>") {
+			t.Fatalf("%s missing from listing: %s", href, listing)
+		}
+	}
+	if strings.Contains(listing, "<D:href>/d/</D:href>") {
+		t.Fatalf("deleted directory in listing: %s", listing)
+	}
+
+	store, root, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Release()
+	rdr, err := fs.Open(store, root, "/c d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != contents {
+		t.Fatal("committed file has the wrong contents")
+	}
+}